@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -10,8 +11,14 @@ import (
 	"time"
 
 	"github.com/jmirfield/auth-service/internals/apple"
+	"github.com/jmirfield/auth-service/internals/google"
 	"github.com/jmirfield/auth-service/internals/handlers"
 	authhttp "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/identity"
+	"github.com/jmirfield/auth-service/internals/nonce"
+	"github.com/jmirfield/auth-service/internals/oauth2"
+	"github.com/jmirfield/auth-service/internals/oidc"
+	"github.com/jmirfield/auth-service/internals/provider"
 	"github.com/jmirfield/auth-service/internals/secret"
 	"github.com/jmirfield/auth-service/internals/session"
 	"github.com/jmirfield/auth-service/internals/storage"
@@ -26,6 +33,26 @@ func main() {
 		log.Fatal(err)
 	}
 
+	googleCfg, err := google.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	oidcCfgs, err := oidc.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	oauth2Cfgs, err := oauth2.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	identityCfg, err := identity.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	sessionCfg, err := session.Load()
 	if err != nil {
 		log.Fatal(err)
@@ -41,41 +68,122 @@ func main() {
 		log.Fatal(err)
 	}
 
-	appleMgr, err := apple.NewManager(appleCfg)
+	secretMgr, err := secret.NewManager(secretCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	secretMgr, err := secret.NewManager(secretCfg)
+	appleMgr, err := apple.NewManager(appleCfg, secretMgr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var store = storage.NewMemoryStore()
-	go func(ctx context.Context) {
-		t := time.NewTicker(12 * time.Hour)
-		defer t.Stop()
-		for {
-			select {
-			case <-t.C:
-				if n, err := store.PruneAllExpired(ctx, time.Now()); err == nil && n > 0 {
-					log.Printf("pruned %d expired refresh tokens", n)
+	storageCfg, err := storage.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := storage.Open(ctx, storageCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c, ok := store.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	// Redis expires refresh tokens natively; every other store needs pruning.
+	if storageCfg.Driver != storage.DriverRedis {
+		go func(ctx context.Context) {
+			t := time.NewTicker(12 * time.Hour)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					if n, err := store.PruneAllExpired(ctx, time.Now()); err == nil && n > 0 {
+						log.Printf("pruned %d expired refresh tokens", n)
+					}
+				case <-ctx.Done():
+					return
 				}
-			case <-ctx.Done():
-				return
 			}
+		}(ctx)
+	}
+
+	identities := identity.NewManager(identityCfg, store)
+	// Users stored before identities existed are also linked as they sign
+	// in; this catches the rest.
+	go func(ctx context.Context) {
+		n, err := identities.Migrate(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("identity migration: %v", err)
+		}
+		if n > 0 {
+			log.Printf("linked identities of %d existing users", n)
 		}
 	}(ctx)
 
-	var sessionHandler = handlers.NewSessionHandler(sessionMgr, store)
-	var appleHandler = handlers.NewAppleHandler(appleCfg, store, sessionMgr, appleMgr, secretMgr)
+	if appleCfg.ValidateInterval > 0 {
+		validator := &appleTokenValidator{store: store, cfg: appleCfg, scm: secretMgr, refresh: appleMgr.Refresh}
+		go validator.run(ctx)
+	}
+
+	providers := provider.NewRegistry()
+	providers.Register(storage.ProviderApple, apple.NewProvider(appleMgr))
+	if googleCfg.Enabled() {
+		googleMgr, err := google.NewManager(googleCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		providers.Register(storage.ProviderGoogle, google.NewProvider(googleMgr))
+	}
+	for _, cfg := range oidcCfgs {
+		p, err := oidc.NewProvider(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		providers.Register(cfg.Name, p)
+	}
+	for _, cfg := range oauth2Cfgs {
+		if _, ok := providers.Get(cfg.Name); ok {
+			log.Fatalf("provider %q is configured as both OIDC and OAuth2", cfg.Name)
+		}
+		p, err := oauth2.NewProvider(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		providers.Register(cfg.Name, p)
+	}
+
+	var revokeAll *provider.Registry
+	if appleCfg.RevokeOnRevokeAll {
+		revokeAll = provider.NewRegistry()
+		revokeAll.Register(storage.ProviderApple, apple.NewProvider(appleMgr))
+	}
+
+	var sessionHandler = handlers.NewSessionHandler(sessionMgr, store, revokeAll, secretMgr)
+	var signInHandler = handlers.NewSignInHandler(store, sessionMgr, providers, secretMgr, identities)
+	var appleHandler = handlers.NewAppleHandler(appleCfg, store, appleMgr, signInHandler)
+	var accountHandler = handlers.NewAccountHandler(store, providers, secretMgr)
+	var jwksHandler = handlers.NewJWKSHandler(sessionMgr)
+	var nonceHandler = handlers.NewNonceHandler(nonce.NewStore(store, 0))
 	var authMiddleware = authhttp.NewAuth(sessionMgr).Middleware
 
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jwks.json", jwksHandler.Keys)
+	mux.HandleFunc("GET /auth/nonce", nonceHandler.Issue)
 	mux.HandleFunc("POST /auth/refresh", sessionHandler.Refresh)
-	mux.HandleFunc("POST /auth/apple", appleHandler.Auth)
+	mux.HandleFunc("POST /auth/{provider}", signInHandler.Auth)
+	mux.HandleFunc("GET /auth/{provider}/start", signInHandler.Start)
+	mux.HandleFunc("GET /auth/{provider}/callback", signInHandler.Callback)
+	mux.HandleFunc("GET /auth/apple/start", appleHandler.Start)
+	mux.HandleFunc("POST /auth/apple/callback", appleHandler.Callback)
+	mux.HandleFunc("POST /auth/apple/notifications", appleHandler.Notifications)
 	mux.Handle("POST /auth/revoke", authMiddleware(http.HandlerFunc(sessionHandler.RevokeSingle)))
 	mux.Handle("POST /auth/revoke/all", authMiddleware(http.HandlerFunc(sessionHandler.RevokeAll)))
+	mux.Handle("DELETE /auth/account", authMiddleware(http.HandlerFunc(accountHandler.Delete)))
+	mux.Handle("GET /auth/identities", authMiddleware(http.HandlerFunc(signInHandler.Identities)))
+	mux.Handle("POST /auth/link/{provider}", authMiddleware(http.HandlerFunc(signInHandler.Link)))
+	mux.Handle("DELETE /auth/link/{provider}", authMiddleware(http.HandlerFunc(signInHandler.Unlink)))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/apple"
+	"github.com/jmirfield/auth-service/internals/secret"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// validatePassInterval is how often the store is walked for Apple tokens that
+// are due for validation.
+const validatePassInterval = time.Hour
+
+// appleTokenValidator periodically checks stored Apple refresh tokens with
+// Apple and signs out users whose token Apple no longer accepts, which is how
+// we learn they revoked the app outside of it.
+type appleTokenValidator struct {
+	store storage.Store
+	cfg   *apple.Config
+	scm   *secret.Manager
+	// refresh is apple.Manager.Refresh; tests replace it.
+	refresh func(ctx context.Context, refreshToken string, opts ...apple.RequestOption) (*apple.TokenResponse, error)
+}
+
+func (v *appleTokenValidator) run(ctx context.Context) {
+	t := time.NewTicker(validatePassInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := v.pass(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				log.Printf("apple token validation: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pass validates every Apple token last validated more than cfg.ValidateInterval
+// before now, at most cfg.ValidateRate per second.
+func (v *appleTokenValidator) pass(ctx context.Context, now time.Time) error {
+	limit := time.NewTicker(time.Duration(float64(time.Second) / v.cfg.ValidateRate))
+	defer limit.Stop()
+
+	return v.store.ForEach(ctx, func(rec storage.Record) error {
+		enc := rec.RefreshTokensByProvider[storage.ProviderApple]
+		if enc == "" || now.Sub(rec.ProviderValidatedAt[storage.ProviderApple]) < v.cfg.ValidateInterval {
+			return nil
+		}
+
+		select {
+		case <-limit.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		tok, err := v.scm.Decrypt(enc)
+		if err != nil {
+			log.Printf("apple token validation: decrypt token for %s: %v", rec.UserID, err)
+			return nil
+		}
+
+		_, err = v.refresh(ctx, tok, apple.WithClientID(rec.ProviderClientIDs[storage.ProviderApple]))
+		switch {
+		case errors.Is(err, apple.ErrInvalidGrant):
+			return v.record(ctx, rec.UserID, enc, func(r *storage.Record) {
+				r.RefreshTokens = nil
+				r.RemoveProviderToken(storage.ProviderApple)
+			})
+		case errors.Is(err, apple.ErrUnavailable):
+			// No point walking on during an outage; the next pass resumes.
+			return err
+		case err != nil:
+			log.Printf("apple token validation: refresh for %s: %v", rec.UserID, err)
+			return nil
+		default:
+			return v.record(ctx, rec.UserID, enc, func(r *storage.Record) {
+				r.ProviderValidatedAt[storage.ProviderApple] = now
+			})
+		}
+	})
+}
+
+// record applies fn to the user's record unless the user or the validated
+// token has since gone away, e.g. the account was deleted or the user signed
+// in again with a fresh token.
+func (v *appleTokenValidator) record(ctx context.Context, userID, enc string, fn func(*storage.Record)) error {
+	// Update would recreate a record deleted during the pass.
+	exists, err := v.store.UserExists(ctx, userID)
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = v.store.Update(ctx, userID, func(rec storage.Record) storage.Record {
+		if rec.RefreshTokensByProvider[storage.ProviderApple] == enc {
+			fn(&rec)
+		}
+		return rec
+	})
+	return err
+}
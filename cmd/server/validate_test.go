@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/apple"
+	"github.com/jmirfield/auth-service/internals/apple/appletest"
+	"github.com/jmirfield/auth-service/internals/handlers"
+	"github.com/jmirfield/auth-service/internals/identity"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/secret"
+	"github.com/jmirfield/auth-service/internals/session"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+func TestAppleTokenValidator_Pass(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+	encrypt := func(s string) string {
+		enc, err := scm.Encrypt(s)
+		if err != nil {
+			t.Fatalf("encrypt: %v", err)
+		}
+		return enc
+	}
+
+	store := storage.NewMemoryStore()
+	session := []storage.RefreshTokenRecord{{Hash: "h", JTI: "j", ExpiresAt: now.Add(time.Hour)}}
+	put := func(uid, appleToken string, validatedAt time.Time) {
+		rec := storage.Record{
+			RefreshTokens:           session,
+			RefreshTokensByProvider: map[string]string{storage.ProviderApple: encrypt(appleToken)},
+			ProviderValidatedAt:     map[string]time.Time{},
+		}
+		if !validatedAt.IsZero() {
+			rec.ProviderValidatedAt[storage.ProviderApple] = validatedAt
+		}
+		if err := store.Put(ctx, uid, rec); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	put("valid", "good", time.Time{})
+	put("revoked", "bad", now.Add(-48*time.Hour))
+	put("fresh", "bad", now.Add(-time.Hour))
+
+	var calls int
+	v := &appleTokenValidator{
+		store: store,
+		cfg:   &apple.Config{ValidateInterval: 24 * time.Hour, ValidateRate: 1000},
+		scm:   scm,
+		refresh: func(_ context.Context, tok string, _ ...apple.RequestOption) (*apple.TokenResponse, error) {
+			calls++
+			if tok == "bad" {
+				return nil, apple.ErrInvalidGrant
+			}
+			return &apple.TokenResponse{}, nil
+		},
+	}
+
+	if err := v.pass(ctx, now); err != nil {
+		t.Fatalf("pass: %v", err)
+	}
+
+	if calls != 2 {
+		t.Fatalf("expected 2 validations (recently validated token skipped), got %d", calls)
+	}
+
+	valid, _ := store.Get(ctx, "valid")
+	if !valid.ProviderValidatedAt[storage.ProviderApple].Equal(now) || len(valid.RefreshTokens) != 1 {
+		t.Fatalf("valid user: unexpected record %+v", valid)
+	}
+
+	revoked, _ := store.Get(ctx, "revoked")
+	if len(revoked.RefreshTokens) != 0 || revoked.RefreshTokensByProvider[storage.ProviderApple] != "" {
+		t.Fatalf("revoked user should be signed out, got %+v", revoked)
+	}
+
+	fresh, _ := store.Get(ctx, "fresh")
+	if len(fresh.RefreshTokens) != 1 {
+		t.Fatalf("recently validated user should be untouched, got %+v", fresh)
+	}
+}
+
+func TestAppleTokenValidator_SkipsNewSignIn(t *testing.T) {
+	ctx := context.Background()
+	fake := appletest.NewServer()
+	defer fake.Close()
+
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+	cfg := fake.Config()
+	am, err := apple.NewManager(cfg, scm)
+	if err != nil {
+		t.Fatalf("apple manager: %v", err)
+	}
+
+	store := storage.NewMemoryStore()
+	reg := provider.NewRegistry()
+	reg.Register(storage.ProviderApple, apple.NewProvider(am))
+	signin := handlers.NewSignInHandler(store, sm, reg, scm, identity.NewManager(&identity.Config{}, store))
+
+	code := fake.IssueCode(appletest.Identity{Subject: "001234.user"})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/auth/apple", strings.NewReader(`{"code":"`+code+`"}`))
+	req.SetPathValue("provider", storage.ProviderApple)
+	signin.Auth(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	// The token Apple just issued needs no check until a full interval on.
+	var calls int
+	v := &appleTokenValidator{
+		store: store,
+		cfg:   &apple.Config{ValidateInterval: 24 * time.Hour, ValidateRate: 1000},
+		scm:   scm,
+		refresh: func(ctx context.Context, tok string, opts ...apple.RequestOption) (*apple.TokenResponse, error) {
+			calls++
+			return am.Refresh(ctx, tok, opts...)
+		},
+	}
+	if err := v.pass(ctx, time.Now()); err != nil {
+		t.Fatalf("pass: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("just signed in user validated %d times, want 0", calls)
+	}
+
+	if err := v.pass(ctx, time.Now().Add(25*time.Hour)); err != nil {
+		t.Fatalf("pass a day later: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("a day later: %d validations, want 1", calls)
+	}
+}
@@ -0,0 +1,298 @@
+// Package appletest runs an in-process fake of Apple's ID server so the Sign in
+// with Apple flow can be tested without the network.
+package appletest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmirfield/auth-service/internals/apple"
+	"github.com/jmirfield/auth-service/internals/oauthtest"
+)
+
+const (
+	// Issuer is the iss of every token the server signs, as with Apple.
+	Issuer = "https://appleid.apple.com"
+
+	teamID   = "TEAMID1234"
+	keyID    = "CLIENTKEY1"
+	clientID = "com.example.app"
+	webID    = "com.example.web"
+	signKID  = "fake-apple-kid"
+)
+
+// Server fakes the token, keys and revoke endpoints of appleid.apple.com.
+// Codes are issued with IssueCode, or Authorize for the web flow, and can be
+// exchanged once; the refresh tokens they yield stay valid until revoked.
+type Server struct {
+	*httptest.Server
+
+	// ClientID is the app's client id, the default audience of the ID
+	// tokens it signs and the audience of its notifications.
+	ClientID string
+	// ServicesID is a second client id, as used by a website.
+	ServicesID string
+
+	signKey   *oauthtest.Key
+	clientKey *ecdsa.PrivateKey
+
+	codes         oauthtest.Codes[Identity]
+	refreshTokens oauthtest.Tokens[Identity]
+}
+
+// Identity is the user a code signs in.
+type Identity struct {
+	// ClientID is the client the code is issued to. It defaults to the
+	// server's ClientID.
+	ClientID       string
+	Subject        string
+	Nonce          string
+	Email          string
+	EmailVerified  bool
+	IsPrivateEmail bool
+	RealUserStatus apple.RealUserStatus
+}
+
+func (id Identity) clientID(s *Server) string {
+	if id.ClientID == "" {
+		return s.ClientID
+	}
+	return id.ClientID
+}
+
+// NewServer starts a fake Apple ID server. Callers must Close it.
+func NewServer() *Server {
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("appletest: " + err.Error())
+	}
+
+	s := &Server{
+		ClientID:   clientID,
+		ServicesID: webID,
+		signKey:    oauthtest.NewKey(signKID),
+		clientKey:  clientKey,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /auth/token", s.token)
+	mux.HandleFunc("GET /auth/keys", s.signKey.ServeJWKS)
+	mux.HandleFunc("POST /auth/revoke", s.revoke)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Config returns an apple.Config that talks to s, with a client key s accepts.
+func (s *Server) Config() *apple.Config {
+	return &apple.Config{
+		TeamID:     teamID,
+		ClientID:   s.ClientID,
+		ClientIDs:  []string{s.ServicesID},
+		KeyID:      keyID,
+		PrivateKey: s.clientKey,
+		BaseURL:    s.URL,
+		HTTPClient: s.Client(),
+	}
+}
+
+// IssueCode returns an authorization code that signs in id once.
+func (s *Server) IssueCode(id Identity) string {
+	return s.codes.Issue(id, "", "")
+}
+
+// Authorize plays the user signing in as id on the authorize page at
+// authorizeURL and returns the form Apple would post to the redirect URI. The
+// ID token carries the requested nonce, and the code must be redeemed with the
+// same redirect URI and, if a challenge was sent, the matching verifier.
+// user, if set, is posted as on a first sign in.
+func (s *Server) Authorize(authorizeURL string, id Identity, user *apple.User) (url.Values, error) {
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	switch {
+	case u.Path != "/auth/authorize":
+		return nil, errors.New("appletest: not an authorize url: " + authorizeURL)
+	case !s.knownClient(q.Get("client_id")):
+		return nil, errors.New("appletest: unknown client_id")
+	case q.Get("response_type") != "code":
+		return nil, errors.New("appletest: response_type must be code")
+	case q.Get("redirect_uri") == "":
+		return nil, errors.New("appletest: missing redirect_uri")
+	case strings.Contains(q.Get("scope"), "name") && q.Get("response_mode") != "form_post":
+		return nil, errors.New("appletest: requesting scopes requires response_mode=form_post")
+	}
+	if c := q.Get("code_challenge"); c != "" && q.Get("code_challenge_method") != "S256" {
+		return nil, errors.New("appletest: code_challenge_method must be S256")
+	}
+
+	id.Nonce = q.Get("nonce")
+	id.ClientID = q.Get("client_id")
+	form := url.Values{}
+	form.Set("code", s.codes.Issue(id, q.Get("redirect_uri"), q.Get("code_challenge")))
+	form.Set("state", q.Get("state"))
+	if user != nil {
+		b, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("user", string(b))
+	}
+
+	return form, nil
+}
+
+// Revoked reports whether refreshToken was revoked through /auth/revoke or
+// RevokeRefreshToken.
+func (s *Server) Revoked(refreshToken string) bool {
+	return s.refreshTokens.Revoked(refreshToken)
+}
+
+// RevokeRefreshToken revokes refreshToken as if the user had stopped using
+// Sign in with Apple for the app.
+func (s *Server) RevokeRefreshToken(refreshToken string) {
+	s.refreshTokens.Revoke(refreshToken)
+}
+
+// IDToken signs the ID token Apple hands out for id, booleans as strings.
+func (s *Server) IDToken(id Identity) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": Issuer,
+		"aud": id.clientID(s),
+		"sub": id.Subject,
+		"iat": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	}
+	if id.Nonce != "" {
+		claims["nonce"] = id.Nonce
+	}
+	if id.Email != "" {
+		// Apple sends these booleans as strings.
+		claims["email"] = id.Email
+		claims["email_verified"] = strconv.FormatBool(id.EmailVerified)
+		claims["is_private_email"] = strconv.FormatBool(id.IsPrivateEmail)
+	}
+	claims["real_user_status"] = int(id.RealUserStatus)
+
+	return s.signKey.Sign(claims)
+}
+
+// Notification signs a server-to-server notification payload carrying an
+// event of the given type for sub.
+func (s *Server) Notification(eventType, sub string) string {
+	events, _ := json.Marshal(map[string]any{
+		"type":       eventType,
+		"sub":        sub,
+		"event_time": time.Now().UnixMilli(),
+	})
+
+	return s.signKey.Sign(jwt.MapClaims{
+		"iss":    Issuer,
+		"aud":    s.ClientID,
+		"iat":    time.Now().Unix(),
+		"jti":    oauthtest.RandomString(),
+		"events": string(events),
+	})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if !s.validClient(r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")) {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_client")
+		return
+	}
+
+	var (
+		id      Identity
+		ok      bool
+		refresh string
+	)
+	// Codes and refresh tokens only work for the client they were issued to.
+	client := r.PostForm.Get("client_id")
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		id, ok = s.codes.Redeem(r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		ok = ok && id.clientID(s) == client
+		if ok {
+			refresh = s.refreshTokens.Issue(id)
+		}
+	case "refresh_token":
+		id, ok = s.refreshTokens.Lookup(r.PostForm.Get("refresh_token"))
+		ok = ok && id.clientID(s) == client
+	default:
+		oauthtest.Error(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	if !ok {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	oauthtest.WriteJSON(w, http.StatusOK, apple.TokenResponse{
+		AccessToken:  oauthtest.RandomString(),
+		RefreshToken: refresh,
+		IDToken:      s.IDToken(id),
+		TokenType:    "bearer",
+		ExpiresIn:    3600,
+	})
+}
+
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if !s.validClient(r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")) {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_client")
+		return
+	}
+
+	// Like Apple, answer 200 for tokens of other clients but leave them be.
+	token := r.PostForm.Get("token")
+	if id, ok := s.refreshTokens.Lookup(token); ok && id.clientID(s) == r.PostForm.Get("client_id") {
+		s.refreshTokens.Revoke(token)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) knownClient(id string) bool {
+	return id == s.ClientID || id == s.ServicesID
+}
+
+// validClient checks the client secret JWT the way Apple does.
+func (s *Server) validClient(id, secret string) bool {
+	if !s.knownClient(id) {
+		return false
+	}
+
+	_, err := jwt.Parse(secret, func(t *jwt.Token) (any, error) {
+		return &s.clientKey.PublicKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}),
+		jwt.WithIssuer(teamID),
+		jwt.WithSubject(id),
+		jwt.WithAudience(Issuer),
+		jwt.WithExpirationRequired(),
+	)
+	return err == nil
+}
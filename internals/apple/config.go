@@ -5,16 +5,80 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/provider"
 )
 
 type Config struct {
-	TeamID        string
-	ClientID      string
+	TeamID string
+	// ClientID is the default client, e.g. the app's bundle id. Requests
+	// that name no client are made for it.
+	ClientID string
+	// ClientIDs lists further clients, e.g. a Services ID for the web next
+	// to the bundle id. ID tokens for any configured client are accepted.
+	ClientIDs []string
+	// WebClientID is the client the web flow signs in with. It defaults to
+	// ClientID.
+	WebClientID   string
 	KeyID         string
 	PrivateKey    *ecdsa.PrivateKey
 	PrivateKeyPEM []byte
+	// RevokeOnRevokeAll also revokes the user's Apple token when they sign
+	// out of every session, not only when their account is deleted.
+	RevokeOnRevokeAll bool
+	// ValidateInterval is how often each stored Apple refresh token is
+	// checked with Apple; zero disables the check. Apple asks for at most
+	// once a day.
+	ValidateInterval time.Duration
+	// ValidateRate caps validation requests per second.
+	ValidateRate float64
+	// RequireNonce rejects native sign ins without a nonce from GET
+	// /auth/nonce.
+	RequireNonce bool
+	// RedirectURI is where Apple posts the result of the web flow. It must
+	// be registered for ClientID; leaving it empty disables the web flow.
+	RedirectURI string
+
+	// BaseURL is Apple's ID server. It defaults to DefaultBaseURL and only
+	// needs setting to point the service at a fake server in tests.
+	BaseURL string
+	// HTTPClient makes every request to Apple. If nil, provider.HTTPClient
+	// supplies the default.
+	HTTPClient *http.Client
+}
+
+// DefaultBaseURL is Apple's ID server, which is also the issuer of its tokens.
+const DefaultBaseURL = "https://appleid.apple.com"
+
+// HasClient reports whether clientID is one of the configured clients.
+func (c *Config) HasClient(clientID string) bool {
+	return clientID != "" && (clientID == c.ClientID || slices.Contains(c.ClientIDs, clientID))
+}
+
+// WebClient is the client id the web flow signs in with.
+func (c *Config) WebClient() string {
+	if c.WebClientID == "" {
+		return c.ClientID
+	}
+	return c.WebClientID
+}
+
+func (c *Config) baseURL() string {
+	if c.BaseURL == "" {
+		return DefaultBaseURL
+	}
+	return strings.TrimSuffix(c.BaseURL, "/")
+}
+
+func (c *Config) httpClient() *http.Client {
+	return provider.HTTPClient(c.HTTPClient)
 }
 
 func (c *Config) Validate() error {
@@ -26,6 +90,10 @@ func (c *Config) Validate() error {
 		return errors.New("missing required Apple client id env var")
 	}
 
+	if c.WebClientID != "" && !c.HasClient(c.WebClientID) {
+		return errors.New("invalid Apple web client id env var: not one of the client ids")
+	}
+
 	if c.KeyID == "" {
 		return errors.New("missing required Apple key id env var")
 	}
@@ -34,6 +102,14 @@ func (c *Config) Validate() error {
 		return errors.New("missing required Apple private key")
 	}
 
+	if c.ValidateInterval != 0 && c.ValidateInterval < 24*time.Hour {
+		return errors.New("invalid Apple validate interval env var: must be at least 24h")
+	}
+
+	if c.ValidateInterval != 0 && c.ValidateRate <= 0 {
+		return errors.New("invalid Apple validate rate env var")
+	}
+
 	return nil
 }
 
@@ -64,11 +140,53 @@ func Load() (*Config, error) {
 	}
 
 	cfg := &Config{
-		TeamID:        team,
-		ClientID:      client,
-		KeyID:         kid,
-		PrivateKey:    ecdsaKey,
-		PrivateKeyPEM: pemBytes,
+		TeamID:           team,
+		ClientID:         client,
+		KeyID:            kid,
+		PrivateKey:       ecdsaKey,
+		PrivateKeyPEM:    pemBytes,
+		ValidateInterval: 24 * time.Hour,
+		ValidateRate:     5,
+		RedirectURI:      os.Getenv("APPLE_REDIRECT_URI"),
+		WebClientID:      os.Getenv("APPLE_WEB_CLIENT_ID"),
+	}
+
+	if s := os.Getenv("APPLE_CLIENT_IDS"); s != "" {
+		for _, id := range strings.Split(s, ",") {
+			if id = strings.TrimSpace(id); id != "" && id != cfg.ClientID {
+				cfg.ClientIDs = append(cfg.ClientIDs, id)
+			}
+		}
+	}
+
+	if s := os.Getenv("APPLE_REVOKE_ON_REVOKE_ALL"); s != "" {
+		if b, err := strconv.ParseBool(s); err == nil {
+			cfg.RevokeOnRevokeAll = b
+		}
+	}
+
+	if s := os.Getenv("APPLE_REQUIRE_NONCE"); s != "" {
+		if b, err := strconv.ParseBool(s); err == nil {
+			cfg.RequireNonce = b
+		}
+	}
+
+	if s := os.Getenv("APPLE_HTTP_TIMEOUT"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.HTTPClient = &http.Client{Timeout: d}
+		}
+	}
+
+	if s := os.Getenv("APPLE_VALIDATE_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			cfg.ValidateInterval = d
+		}
+	}
+
+	if s := os.Getenv("APPLE_VALIDATE_RATE"); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err == nil && f > 0 {
+			cfg.ValidateRate = f
+		}
 	}
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -0,0 +1,73 @@
+package apple
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Error is an OAuth error answered by Apple's token or revoke endpoint.
+// errors.Is matches it against the Err* values by Code.
+type Error struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	msg := "apple: " + e.Code
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	if e.StatusCode != 0 {
+		msg += " (status " + strconv.Itoa(e.StatusCode) + ")"
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// OAuth error codes Apple answers with.
+var (
+	// ErrInvalidRequest means the request was malformed, e.g. a missing code.
+	ErrInvalidRequest = &Error{Code: "invalid_request"}
+	// ErrInvalidClient means Apple rejected our client id or client secret.
+	ErrInvalidClient = &Error{Code: "invalid_client"}
+	// ErrInvalidGrant means the code or refresh token is invalid, expired,
+	// already used or revoked, e.g. because the user stopped using Sign in
+	// with Apple.
+	ErrInvalidGrant = &Error{Code: "invalid_grant"}
+	// ErrUnauthorizedClient means the client may not use the grant type.
+	ErrUnauthorizedClient = &Error{Code: "unauthorized_client"}
+	// ErrUnsupportedGrantType means Apple does not know the grant type.
+	ErrUnsupportedGrantType = &Error{Code: "unsupported_grant_type"}
+	// ErrInvalidScope means a requested scope is not allowed.
+	ErrInvalidScope = &Error{Code: "invalid_scope"}
+)
+
+var (
+	// ErrUnavailable means Apple kept failing with server errors or could not
+	// be reached, even after retrying.
+	ErrUnavailable = errors.New("apple: service unavailable")
+	// ErrCircuitOpen means recent calls to Apple failed so often that calls
+	// are failing fast for a while. It wraps ErrUnavailable.
+	ErrCircuitOpen = fmt.Errorf("%w: circuit open", ErrUnavailable)
+)
+
+// parseError turns a non-200 answer into an *Error when Apple sent an OAuth
+// error body.
+func parseError(status int, body []byte) error {
+	var e struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if json.Unmarshal(body, &e) != nil || e.Error == "" {
+		return fmt.Errorf("apple: unexpected status %d: %s", status, body)
+	}
+
+	return &Error{StatusCode: status, Code: e.Error, Description: e.ErrorDescription}
+}
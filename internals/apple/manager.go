@@ -1,37 +1,57 @@
 package apple
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"io"
 	"net/http"
 	"net/url"
 	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmirfield/auth-service/internals/jwks"
+	"github.com/jmirfield/auth-service/internals/secret"
 )
 
 type Manager struct {
-	config *Config
+	config  *Config
+	scm     *secret.Manager
+	keys    *jwks.Cache
+	retry   retryPolicy
+	breaker *breaker
 }
 
-func NewManager(cfg *Config) (*Manager, error) {
+// NewManager returns a Manager. scm decrypts the Apple tokens we store so they
+// can be revoked.
+func NewManager(cfg *Config, scm *secret.Manager) (*Manager, error) {
 	return &Manager{
-		config: cfg,
+		config:  cfg,
+		scm:     scm,
+		keys:    jwks.NewCache(cfg.baseURL()+"/auth/keys", cfg.httpClient()),
+		retry:   retryPolicy{attempts: sendAttempts, base: retryBaseDelay, max: retryMaxDelay},
+		breaker: newBreaker(),
 	}, nil
 }
 
 type Claims struct {
 	Nonce string `json:"nonce,omitempty"`
+
+	// Email is the user's address, or their private relay address when
+	// IsPrivateEmail is set. It is missing if the user shared no email.
+	Email          string         `json:"email,omitempty"`
+	EmailVerified  Bool           `json:"email_verified,omitempty"`
+	IsPrivateEmail Bool           `json:"is_private_email,omitempty"`
+	RealUserStatus RealUserStatus `json:"real_user_status,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
-func (m *Manager) VerifyIDToken(idToken string, nonce ...string) (*Claims, error) {
+// VerifyIDToken verifies an ID token against Apple's keys, fetching them with
+// ctx if they are not cached.
+func (m *Manager) VerifyIDToken(ctx context.Context, idToken string, nonce ...string) (*Claims, error) {
 	if idToken == "" {
 		return nil, errors.New("empty id_token")
 	}
@@ -41,19 +61,8 @@ func (m *Manager) VerifyIDToken(idToken string, nonce ...string) (*Claims, error
 		jwt.WithLeeway(60*time.Second),
 	)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	claims := &Claims{}
-	_, err := parser.ParseWithClaims(idToken, claims, func(t *jwt.Token) (any, error) {
-		kid, _ := t.Header["kid"].(string)
-		if kid == "" {
-			return nil, errors.New("missing kid in header")
-		}
-		return fetchApplePublicKey(ctx, kid)
-	})
-
-	if err != nil {
+	if _, err := parser.ParseWithClaims(idToken, claims, m.keys.Keyfunc(ctx)); err != nil {
 		return nil, err
 	}
 
@@ -61,7 +70,7 @@ func (m *Manager) VerifyIDToken(idToken string, nonce ...string) (*Claims, error
 		return nil, errors.New("invalid issuer")
 	}
 
-	if !slices.Contains(claims.Audience, m.config.ClientID) {
+	if !slices.ContainsFunc(claims.Audience, m.config.HasClient) {
 		return nil, errors.New("invalid audience")
 	}
 
@@ -95,67 +104,164 @@ type TokenResponse struct {
 	ExpiresIn    int    `json:"expires_in"`
 }
 
-func (m *Manager) ExchangeCode(code string) (*TokenResponse, error) {
-	secret, err := generateClientSecret(m.config)
+// AuthorizeURL is where the web flow sends the browser to sign in. Apple
+// posts the result to cfg.RedirectURI as a form.
+func (m *Manager) AuthorizeURL(state, nonce, codeChallenge string) string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("response_mode", "form_post")
+	q.Set("client_id", m.config.WebClient())
+	q.Set("redirect_uri", m.config.RedirectURI)
+	q.Set("scope", "name email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	if codeChallenge != "" {
+		q.Set("code_challenge", codeChallenge)
+		q.Set("code_challenge_method", "S256")
+	}
+
+	return m.config.baseURL() + "/auth/authorize?" + q.Encode()
+}
+
+// RequestOption adds a parameter to a request to Apple's token or revoke
+// endpoint.
+type RequestOption func(url.Values)
+
+// WithClientID makes the request for one of the configured client ids rather
+// than cfg.ClientID. Tokens must be redeemed by the client they were issued to.
+func WithClientID(clientID string) RequestOption {
+	return func(v url.Values) {
+		if clientID != "" {
+			v.Set("client_id", clientID)
+		}
+	}
+}
+
+// WithRedirectURI passes the redirect URI the code was issued for, which Apple
+// requires for codes from the web flow.
+func WithRedirectURI(uri string) RequestOption {
+	return func(v url.Values) { v.Set("redirect_uri", uri) }
+}
+
+// WithCodeVerifier passes the PKCE code verifier for the challenge sent to
+// the authorize endpoint.
+func WithCodeVerifier(verifier string) RequestOption {
+	return func(v url.Values) { v.Set("code_verifier", verifier) }
+}
+
+func (m *Manager) ExchangeCode(ctx context.Context, code string, opts ...RequestOption) (*TokenResponse, error) {
+	data, err := m.clientValues(opts)
 	if err != nil {
 		return nil, err
 	}
-
-	data := url.Values{}
-	data.Set("client_id", m.config.ClientID)
-	data.Set("client_secret", secret)
 	data.Set("code", code)
 	data.Set("grant_type", "authorization_code")
 
-	return postToken(data)
+	return m.postToken(ctx, data)
 }
 
-func Refresh(cfg *Config, refreshToken string) (*TokenResponse, error) {
+// Refresh redeems an Apple refresh token. It fails with ErrInvalidGrant once
+// the user has revoked the app.
+func (m *Manager) Refresh(ctx context.Context, refreshToken string, opts ...RequestOption) (*TokenResponse, error) {
 	if refreshToken == "" {
 		return nil, errors.New("missing refresh token")
 	}
 
-	secret, err := generateClientSecret(cfg)
+	data, err := m.clientValues(opts)
 	if err != nil {
 		return nil, err
 	}
+	data.Set("refresh_token", refreshToken)
+	data.Set("grant_type", "refresh_token")
 
+	return m.postToken(ctx, data)
+}
+
+// clientValues starts a request with opts applied and the client id and
+// matching client secret set.
+func (m *Manager) clientValues(opts []RequestOption) (url.Values, error) {
 	data := url.Values{}
-	data.Set("client_id", cfg.ClientID)
+	data.Set("client_id", m.config.ClientID)
+	for _, opt := range opts {
+		opt(data)
+	}
+
+	clientID := data.Get("client_id")
+	if !m.config.HasClient(clientID) {
+		return nil, errors.New("unknown Apple client id " + clientID)
+	}
+
+	secret, err := generateClientSecret(m.config, clientID)
+	if err != nil {
+		return nil, err
+	}
 	data.Set("client_secret", secret)
-	data.Set("refresh_token", refreshToken)
-	data.Set("grant_type", "refresh_token")
 
-	return postToken(data)
+	return data, nil
+}
+
+// Token type hints for Revoke.
+const (
+	TokenTypeHintRefresh = "refresh_token"
+	TokenTypeHintAccess  = "access_token"
+)
+
+// Revoke decrypts a stored Apple token and asks Apple to invalidate it, which
+// also removes the user's Sign in with Apple grant for the app.
+func (m *Manager) Revoke(ctx context.Context, encToken, hint string, opts ...RequestOption) error {
+	if encToken == "" {
+		return errors.New("missing token")
+	}
+
+	token, err := m.scm.Decrypt(encToken)
+	if err != nil {
+		return err
+	}
+
+	return m.revoke(ctx, token, hint, opts)
+}
+
+func (m *Manager) revoke(ctx context.Context, token, hint string, opts []RequestOption) error {
+	data, err := m.clientValues(opts)
+	if err != nil {
+		return err
+	}
+	data.Set("token", token)
+	data.Set("token_type_hint", hint)
+
+	status, body, err := m.send(ctx, http.MethodPost, "/auth/revoke", data)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusOK {
+		return parseError(status, body)
+	}
+
+	return nil
 }
 
-func generateClientSecret(cfg *Config) (string, error) {
+func generateClientSecret(cfg *Config, clientID string) (string, error) {
 	claims := jwt.MapClaims{
 		"iss": cfg.TeamID,
 		"iat": time.Now().Unix(),
 		"exp": time.Now().Add(5 * time.Minute).Unix(),
 		"aud": "https://appleid.apple.com",
-		"sub": cfg.ClientID,
+		"sub": clientID,
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
 	token.Header["kid"] = cfg.KeyID
 	return token.SignedString(cfg.PrivateKey)
 }
 
-func postToken(values url.Values) (*TokenResponse, error) {
-	resp, err := http.Post(
-		"https://appleid.apple.com/auth/token",
-		"application/x-www-form-urlencoded",
-		bytes.NewBufferString(values.Encode()),
-	)
+func (m *Manager) postToken(ctx context.Context, values url.Values) (*TokenResponse, error) {
+	status, body, err := m.send(ctx, http.MethodPost, "/auth/token", values)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(string(body))
+	if status != http.StatusOK {
+		return nil, parseError(status, body)
 	}
 
 	var out TokenResponse
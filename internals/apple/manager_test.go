@@ -0,0 +1,60 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExchangeCode_StopsWithContext(t *testing.T) {
+	// An Apple endpoint that does not answer until the test is over.
+	release := make(chan struct{})
+	m := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := m.ExchangeCode(ctx, "code")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("ExchangeCode ignored the context for %v", time.Since(start))
+	}
+}
+
+func TestUser_UnmarshalJSON(t *testing.T) {
+	const obj = `{"name":{"firstName":"Jane","lastName":"Doe"},"email":"jane@example.com"}`
+	encoded, _ := json.Marshal(obj)
+
+	for _, in := range []string{obj, string(encoded)} {
+		var u User
+		if err := json.Unmarshal([]byte(in), &u); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", in, err)
+		}
+		if u.Name.FirstName != "Jane" || u.Name.LastName != "Doe" || u.Email != "jane@example.com" {
+			t.Fatalf("Unmarshal(%s) = %+v", in, u)
+		}
+	}
+}
+
+func TestClaims_StringBooleans(t *testing.T) {
+	var c Claims
+	if err := json.Unmarshal([]byte(`{"email_verified":"true","is_private_email":false,"real_user_status":2}`), &c); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !c.EmailVerified || c.IsPrivateEmail || c.RealUserStatus != RealUserStatusLikelyReal {
+		t.Fatalf("got %+v", c)
+	}
+
+	if err := json.Unmarshal([]byte(`{"email_verified":"maybe"}`), &c); err == nil {
+		t.Fatalf("expected an error for a malformed boolean")
+	}
+}
@@ -0,0 +1,77 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Server-to-server notification event types.
+const (
+	EventEmailDisabled  = "email-disabled"
+	EventEmailEnabled   = "email-enabled"
+	EventConsentRevoked = "consent-revoked"
+	EventAccountDelete  = "account-delete"
+)
+
+// NotificationEvent is the event carried by an Apple server-to-server
+// notification.
+type NotificationEvent struct {
+	Type      string `json:"type"`
+	Subject   string `json:"sub"`
+	Email     string `json:"email,omitempty"`
+	EventTime int64  `json:"event_time"`
+}
+
+type notificationClaims struct {
+	// Apple sends events as a JSON document encoded in a string.
+	Events json.RawMessage `json:"events"`
+	jwt.RegisteredClaims
+}
+
+// VerifyNotification verifies the signed payload of a server-to-server
+// notification and returns its event.
+func (m *Manager) VerifyNotification(ctx context.Context, payload string) (*NotificationEvent, error) {
+	if payload == "" {
+		return nil, errors.New("empty notification payload")
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithLeeway(60*time.Second),
+	)
+
+	claims := &notificationClaims{}
+	if _, err := parser.ParseWithClaims(payload, claims, m.keys.Keyfunc(ctx)); err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != "https://appleid.apple.com" {
+		return nil, errors.New("invalid issuer")
+	}
+
+	if !slices.ContainsFunc(claims.Audience, m.config.HasClient) {
+		return nil, errors.New("invalid audience")
+	}
+
+	raw := []byte(claims.Events)
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err == nil {
+		raw = []byte(encoded)
+	}
+
+	var ev NotificationEvent
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return nil, errors.New("invalid notification events")
+	}
+
+	if ev.Type == "" || ev.Subject == "" {
+		return nil, errors.New("missing event type or sub")
+	}
+
+	return &ev, nil
+}
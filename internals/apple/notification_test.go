@@ -0,0 +1,63 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmirfield/auth-service/internals/jwks"
+	"github.com/jmirfield/auth-service/internals/oauthtest"
+)
+
+func TestVerifyNotification(t *testing.T) {
+	m, _ := NewManager(&Config{ClientID: "com.example.app"}, nil)
+	key := serveTestKey(t, m, "test-kid")
+
+	event := `{"type":"consent-revoked","sub":"001234.abcd","event_time":1700000000000}`
+
+	sign := func(aud string, events any) string {
+		t.Helper()
+		return key.Sign(jwt.MapClaims{
+			"iss":    "https://appleid.apple.com",
+			"aud":    aud,
+			"iat":    time.Now().Unix(),
+			"jti":    "jti-1",
+			"events": events,
+		})
+	}
+
+	// Apple encodes events as a string; accept a plain object as well.
+	for _, events := range []any{event, json.RawMessage(event)} {
+		ev, err := m.VerifyNotification(context.Background(), sign("com.example.app", events))
+		if err != nil {
+			t.Fatalf("VerifyNotification: %v", err)
+		}
+		if ev.Type != EventConsentRevoked || ev.Subject != "001234.abcd" {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	}
+
+	if _, err := m.VerifyNotification(context.Background(), sign("com.other.app", event)); err == nil {
+		t.Fatalf("expected audience mismatch to be rejected")
+	}
+
+	if _, err := m.VerifyNotification(context.Background(), sign("com.example.app", `{"sub":"001234.abcd"}`)); err == nil {
+		t.Fatalf("expected event without type to be rejected")
+	}
+}
+
+// serveTestKey points m's key cache at a JWKS publishing a fresh key under
+// kid.
+func serveTestKey(t *testing.T, m *Manager, kid string) *oauthtest.Key {
+	t.Helper()
+	key := oauthtest.NewKey(kid)
+	srv := httptest.NewServer(http.HandlerFunc(key.ServeJWKS))
+	t.Cleanup(srv.Close)
+
+	m.keys = jwks.NewCache(srv.URL, srv.Client())
+	return key
+}
@@ -0,0 +1,129 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// Provider is Sign in with Apple as a provider.Provider.
+type Provider struct {
+	m *Manager
+}
+
+func NewProvider(m *Manager) *Provider {
+	return &Provider{m: m}
+}
+
+func (p *Provider) RequireNonce() bool {
+	return p.m.config.RequireNonce
+}
+
+func (p *Provider) ExchangeCode(ctx context.Context, code provider.Code) (*provider.Tokens, error) {
+	clientID := code.ClientID
+	if clientID == "" {
+		clientID = p.m.config.ClientID
+	}
+	if !p.m.config.HasClient(clientID) {
+		return nil, provider.ErrUnknownClient
+	}
+
+	opts := []RequestOption{WithClientID(clientID)}
+	if code.RedirectURI != "" {
+		opts = append(opts, WithRedirectURI(code.RedirectURI))
+	}
+	if code.CodeVerifier != "" {
+		opts = append(opts, WithCodeVerifier(code.CodeVerifier))
+	}
+
+	tok, err := p.m.ExchangeCode(ctx, code.Code, opts...)
+	if err != nil {
+		return nil, providerError(err)
+	}
+	return tokens(tok, clientID), nil
+}
+
+func (p *Provider) VerifyIDToken(ctx context.Context, idToken, nonce string) (*provider.Identity, error) {
+	claims, err := p.m.VerifyIDToken(ctx, idToken, nonce)
+	if err != nil {
+		return nil, providerError(err)
+	}
+
+	attrs := map[string]string{
+		storage.AttrEmailVerified:  strconv.FormatBool(bool(claims.EmailVerified)),
+		storage.AttrIsPrivateEmail: strconv.FormatBool(bool(claims.IsPrivateEmail)),
+		storage.AttrRealUserStatus: claims.RealUserStatus.String(),
+	}
+	if claims.Email != "" {
+		attrs[storage.AttrEmail] = claims.Email
+	}
+	return &provider.Identity{Subject: claims.Subject, Attrs: attrs}, nil
+}
+
+// UserInfo reads the user object Apple hands the client on the first sign in
+// for the user's name, which Apple puts in no token.
+func (p *Provider) UserInfo(raw json.RawMessage) (map[string]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var user User
+	if err := json.Unmarshal(raw, &user); err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{}
+	if user.Name.FirstName != "" {
+		attrs[storage.AttrGivenName] = user.Name.FirstName
+	}
+	if user.Name.LastName != "" {
+		attrs[storage.AttrFamilyName] = user.Name.LastName
+	}
+	return attrs, nil
+}
+
+func (p *Provider) Refresh(ctx context.Context, refreshToken, clientID string) (*provider.Tokens, error) {
+	tok, err := p.m.Refresh(ctx, refreshToken, WithClientID(clientID))
+	if err != nil {
+		return nil, providerError(err)
+	}
+	return tokens(tok, clientID), nil
+}
+
+func (p *Provider) Revoke(ctx context.Context, refreshToken, clientID string) error {
+	return providerError(p.m.revoke(ctx, refreshToken, TokenTypeHintRefresh, []RequestOption{WithClientID(clientID)}))
+}
+
+func tokens(tok *TokenResponse, clientID string) *provider.Tokens {
+	return &provider.Tokens{
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		IDToken:      tok.IDToken,
+		ClientID:     clientID,
+	}
+}
+
+// providerError wraps err with the provider.Err* value it stands for.
+func providerError(err error) error {
+	var target error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrInvalidGrant):
+		target = provider.ErrInvalidGrant
+	case errors.Is(err, ErrInvalidRequest):
+		target = provider.ErrInvalidRequest
+	case errors.Is(err, ErrInvalidClient), errors.Is(err, ErrUnauthorizedClient):
+		target = provider.ErrClientRejected
+	case errors.Is(err, ErrUnavailable):
+		target = provider.ErrUnavailable
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", target, err)
+}
@@ -0,0 +1,143 @@
+package apple
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Transient failures are retried up to sendAttempts times in all, backing
+	// off from retryBaseDelay up to retryMaxDelay.
+	sendAttempts   = 3
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = time.Second
+
+	// After breakerThreshold calls in a row fail even with retries, calls
+	// fail fast with ErrCircuitOpen for breakerCooldown.
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+
+	maxResponseBytes = 1 << 20
+)
+
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+// send makes a request to Apple and returns the status and body of its
+// answer. Server errors, rate limiting and network failures are retried with
+// jittered backoff; if they persist send fails with ErrUnavailable. A request
+// whose code or token may already have been consumed by a lost attempt can
+// come back as ErrInvalidGrant.
+func (m *Manager) send(ctx context.Context, method, path string, form url.Values) (int, []byte, error) {
+	if !m.breaker.allow() {
+		return 0, nil, ErrCircuitOpen
+	}
+
+	var lastErr error
+	delay := m.retry.base
+	for attempt := range m.retry.attempts {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay/2 + rand.N(delay/2+1)):
+			case <-ctx.Done():
+				return 0, nil, ctx.Err()
+			}
+			delay = min(2*delay, m.retry.max)
+		}
+
+		status, body, err := m.sendOnce(ctx, method, path, form)
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about Apple.
+			return 0, nil, ctx.Err()
+		}
+
+		if err == nil && status < 500 && status != http.StatusTooManyRequests {
+			m.breaker.success()
+			return status, body, nil
+		}
+
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("status %d", status)
+		}
+	}
+
+	m.breaker.failure()
+	return 0, nil, fmt.Errorf("%w: %v", ErrUnavailable, lastErr)
+}
+
+func (m *Manager) sendOnce(ctx context.Context, method, path string, form url.Values) (int, []byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, m.config.baseURL()+path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := m.config.httpClient().Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, raw, nil
+}
+
+// breaker is a consecutive-failure circuit breaker. Once open it rejects
+// calls until the cooldown passes; the next call is let through and a
+// failure opens it again straight away.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker() *breaker {
+	return &breaker{threshold: breakerThreshold, cooldown: breakerCooldown}
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.mu.Unlock()
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,126 @@
+package apple
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestManager returns a Manager talking to h with retries that do not
+// slow the tests down.
+func newTestManager(t *testing.T, h http.HandlerFunc) *Manager {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+
+	m, _ := NewManager(&Config{
+		TeamID:     "team",
+		ClientID:   "com.example.app",
+		KeyID:      "kid",
+		PrivateKey: key,
+		BaseURL:    srv.URL,
+		HTTPClient: srv.Client(),
+	}, nil)
+	m.retry = retryPolicy{attempts: 3, base: time.Millisecond, max: time.Millisecond}
+	return m
+}
+
+func TestExchangeCode_TypedErrors(t *testing.T) {
+	for _, want := range []*Error{ErrInvalidGrant, ErrInvalidClient, ErrInvalidRequest} {
+		m := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"` + want.Code + `","error_description":"nope"}`))
+		})
+
+		_, err := m.ExchangeCode(context.Background(), "code")
+		if !errors.Is(err, want) {
+			t.Fatalf("expected %v, got %v", want, err)
+		}
+
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Description != "nope" {
+			t.Fatalf("unexpected error details: %#v", err)
+		}
+	}
+}
+
+func TestExchangeCode_RetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	m := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id_token":"tok"}`))
+	})
+
+	tok, err := m.ExchangeCode(context.Background(), "code")
+	if err != nil {
+		t.Fatalf("ExchangeCode: %v", err)
+	}
+	if tok.IDToken != "tok" || calls.Load() != 3 {
+		t.Fatalf("got %+v after %d calls", tok, calls.Load())
+	}
+}
+
+func TestExchangeCode_CircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	m := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	for range breakerThreshold {
+		if _, err := m.ExchangeCode(context.Background(), "code"); !errors.Is(err, ErrUnavailable) || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected ErrUnavailable, got %v", err)
+		}
+	}
+	if got, want := calls.Load(), int32(breakerThreshold*3); got != want {
+		t.Fatalf("got %d calls, want %d", got, want)
+	}
+
+	// The breaker is open now: fail fast without calling Apple.
+	if _, err := m.ExchangeCode(context.Background(), "code"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if got := calls.Load(); got != int32(breakerThreshold*3) {
+		t.Fatalf("open breaker still called apple: %d calls", got)
+	}
+
+	// After the cooldown one call goes through again; a success closes it.
+	m.breaker.mu.Lock()
+	m.breaker.openUntil = time.Now().Add(-time.Second)
+	m.breaker.mu.Unlock()
+	if _, err := m.ExchangeCode(context.Background(), "code"); errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a trial call after the cooldown, got %v", err)
+	}
+	if _, err := m.ExchangeCode(context.Background(), "code"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("a failed trial call should reopen the breaker, got %v", err)
+	}
+}
+
+func TestExchangeCode_UnknownClient(t *testing.T) {
+	var calls atomic.Int32
+	m := newTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	})
+
+	if _, err := m.ExchangeCode(context.Background(), "code", WithClientID("com.example.other")); err == nil {
+		t.Fatalf("expected an error for an unconfigured client id")
+	}
+	if calls.Load() != 0 {
+		t.Fatalf("unconfigured client id still called apple")
+	}
+}
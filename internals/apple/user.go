@@ -0,0 +1,68 @@
+package apple
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Bool decodes Apple's boolean claims, which arrive either as JSON booleans or
+// as the strings "true" and "false".
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.New("invalid boolean claim " + string(data))
+	}
+	*b = Bool(v)
+	return nil
+}
+
+// RealUserStatus is Apple's estimate of whether the user is a real person.
+type RealUserStatus int
+
+const (
+	RealUserStatusUnsupported RealUserStatus = 0
+	RealUserStatusUnknown     RealUserStatus = 1
+	RealUserStatusLikelyReal  RealUserStatus = 2
+)
+
+func (s RealUserStatus) String() string {
+	switch s {
+	case RealUserStatusUnknown:
+		return "unknown"
+	case RealUserStatusLikelyReal:
+		return "likely_real"
+	default:
+		return "unsupported"
+	}
+}
+
+// User is the user object Apple gives the client on the first authorization
+// only; it is the one place the user's name appears. It is not signed, so it
+// is only as trustworthy as the client that forwards it.
+type User struct {
+	Name struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+	} `json:"name"`
+	Email string `json:"email"`
+}
+
+// UnmarshalJSON accepts the object itself or, as Apple posts it to web
+// redirects, the object encoded in a string.
+func (u *User) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if json.Unmarshal(data, &encoded) == nil {
+		if encoded == "" {
+			return nil
+		}
+		data = []byte(encoded)
+	}
+
+	type plain User
+	return json.Unmarshal(data, (*plain)(u))
+}
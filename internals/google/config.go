@@ -0,0 +1,114 @@
+package google
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+)
+
+// Google's endpoints, used unless the Config overrides them.
+const (
+	DefaultJWKSURL   = "https://www.googleapis.com/oauth2/v3/certs"
+	DefaultTokenURL  = "https://oauth2.googleapis.com/token"
+	DefaultRevokeURL = "https://oauth2.googleapis.com/revoke"
+)
+
+type Config struct {
+	// ClientIDs are the OAuth client ids whose ID tokens are accepted, e.g.
+	// the Android, iOS and web clients. The first one redeems server auth
+	// codes, so it must be the web client when codes are used.
+	ClientIDs []string
+	// ClientSecret is the first client's secret. It is only needed to
+	// redeem server auth codes.
+	ClientSecret string
+	// RedirectURI is passed when redeeming codes. Codes from Android apps
+	// need none; codes from the JavaScript library need "postmessage".
+	RedirectURI string
+	// HostedDomain, when set, only accepts Google Workspace accounts of
+	// that domain.
+	HostedDomain string
+
+	// JWKSURL, TokenURL and RevokeURL default to Google's; tests point them
+	// at a fake.
+	JWKSURL   string
+	TokenURL  string
+	RevokeURL string
+	// HTTPClient makes every request to Google; nil means
+	// provider.HTTPClient's default.
+	HTTPClient *http.Client
+}
+
+// Enabled reports whether Google sign in is configured.
+func (c *Config) Enabled() bool {
+	return len(c.ClientIDs) > 0
+}
+
+func (c *Config) jwksURL() string {
+	if c.JWKSURL == "" {
+		return DefaultJWKSURL
+	}
+	return c.JWKSURL
+}
+
+func (c *Config) tokenURL() string {
+	if c.TokenURL == "" {
+		return DefaultTokenURL
+	}
+	return c.TokenURL
+}
+
+func (c *Config) revokeURL() string {
+	if c.RevokeURL == "" {
+		return DefaultRevokeURL
+	}
+	return c.RevokeURL
+}
+
+func (c *Config) httpClient() *http.Client {
+	return provider.HTTPClient(c.HTTPClient)
+}
+
+func (c *Config) Validate() error {
+	for _, id := range c.ClientIDs {
+		if id == "" {
+			return errors.New("invalid Google client ids env var: empty client id")
+		}
+	}
+
+	return nil
+}
+
+// Load reads the Google configuration. Google sign in stays disabled unless
+// GOOGLE_CLIENT_IDS is set.
+func Load() (*Config, error) {
+	cfg := &Config{
+		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+		RedirectURI:  os.Getenv("GOOGLE_REDIRECT_URI"),
+		HostedDomain: os.Getenv("GOOGLE_HOSTED_DOMAIN"),
+		JWKSURL:      os.Getenv("GOOGLE_JWKS_URL"),
+		TokenURL:     os.Getenv("GOOGLE_TOKEN_URL"),
+		RevokeURL:    os.Getenv("GOOGLE_REVOKE_URL"),
+	}
+
+	if s := os.Getenv("GOOGLE_CLIENT_IDS"); s != "" {
+		for _, id := range strings.Split(s, ",") {
+			cfg.ClientIDs = append(cfg.ClientIDs, strings.TrimSpace(id))
+		}
+	}
+
+	if s := os.Getenv("GOOGLE_HTTP_TIMEOUT"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.HTTPClient = &http.Client{Timeout: d}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
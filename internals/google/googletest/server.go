@@ -0,0 +1,176 @@
+// Package googletest runs an in-process fake of Google's token and key
+// endpoints so Google sign in can be tested without the network.
+package googletest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmirfield/auth-service/internals/google"
+	"github.com/jmirfield/auth-service/internals/oauthtest"
+)
+
+const (
+	// Issuer is the iss of every ID token the server signs, as with Google.
+	Issuer = "https://accounts.google.com"
+
+	clientID     = "1234-web.apps.googleusercontent.com"
+	clientSecret = "web-client-secret"
+	signKID      = "fake-google-kid"
+)
+
+// Server fakes Google's JWKS, token and revoke endpoints. Server auth codes
+// are issued with IssueCode and can be redeemed once; the refresh tokens they
+// yield stay valid until revoked.
+type Server struct {
+	*httptest.Server
+
+	// ClientID is the web client: the audience of the ID tokens it signs
+	// and the client that redeems codes.
+	ClientID string
+
+	signKey       *oauthtest.Key
+	codes         oauthtest.Codes[Identity]
+	refreshTokens oauthtest.Tokens[Identity]
+}
+
+// Identity is the Google account a token or code is for.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	HostedDomain  string
+	GivenName     string
+	FamilyName    string
+	Nonce         string
+}
+
+// NewServer starts a fake Google server. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{
+		ClientID: clientID,
+		signKey:  oauthtest.NewKey(signKID),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /oauth2/v3/certs", s.signKey.ServeJWKS)
+	mux.HandleFunc("POST /token", s.token)
+	mux.HandleFunc("POST /revoke", s.revoke)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Config returns a google.Config that talks to s.
+func (s *Server) Config() *google.Config {
+	return &google.Config{
+		ClientIDs:    []string{s.ClientID},
+		ClientSecret: clientSecret,
+		JWKSURL:      s.URL + "/oauth2/v3/certs",
+		TokenURL:     s.URL + "/token",
+		RevokeURL:    s.URL + "/revoke",
+		HTTPClient:   s.Client(),
+	}
+}
+
+// IssueCode returns a server auth code that signs in id once.
+func (s *Server) IssueCode(id Identity) string {
+	return s.codes.Issue(id, "", "")
+}
+
+// Revoked reports whether refreshToken was revoked through /revoke.
+func (s *Server) Revoked(refreshToken string) bool {
+	return s.refreshTokens.Revoked(refreshToken)
+}
+
+// IDToken signs an ID token for id the way Google issues them to the web
+// client, with azp set.
+func (s *Server) IDToken(id Identity) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": Issuer,
+		"aud": s.ClientID,
+		"azp": s.ClientID,
+		"sub": id.Subject,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	if id.Email != "" {
+		claims["email"] = id.Email
+		claims["email_verified"] = id.EmailVerified
+	}
+	if id.HostedDomain != "" {
+		claims["hd"] = id.HostedDomain
+	}
+	if id.GivenName != "" {
+		claims["given_name"] = id.GivenName
+	}
+	if id.FamilyName != "" {
+		claims["family_name"] = id.FamilyName
+	}
+	if id.Nonce != "" {
+		claims["nonce"] = id.Nonce
+	}
+
+	return s.signKey.Sign(claims)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if r.PostForm.Get("client_id") != s.ClientID || r.PostForm.Get("client_secret") != clientSecret {
+		oauthtest.Error(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var (
+		id           Identity
+		ok           bool
+		refreshToken string
+	)
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		id, ok = s.codes.Redeem(r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		if ok {
+			refreshToken = s.refreshTokens.Issue(id)
+		}
+	case "refresh_token":
+		// Google keeps the refresh token and leaves it out of the answer.
+		id, ok = s.refreshTokens.Lookup(r.PostForm.Get("refresh_token"))
+	default:
+		oauthtest.Error(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	if !ok {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	oauthtest.WriteJSON(w, http.StatusOK, google.TokenResponse{
+		AccessToken:  oauthtest.RandomString(),
+		RefreshToken: refreshToken,
+		IDToken:      s.IDToken(id),
+		TokenType:    "Bearer",
+		ExpiresIn:    3599,
+		Scope:        "openid email profile",
+	})
+}
+
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if !s.refreshTokens.Revoke(r.PostForm.Get("token")) {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_token")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,252 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmirfield/auth-service/internals/jwks"
+	"github.com/jmirfield/auth-service/internals/provider"
+)
+
+// Issuers Google signs ID tokens as.
+var issuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+type Manager struct {
+	config *Config
+	keys   *jwks.Cache
+}
+
+func NewManager(cfg *Config) (*Manager, error) {
+	return &Manager{
+		config: cfg,
+		keys:   jwks.NewCache(cfg.jwksURL(), cfg.httpClient()),
+	}, nil
+}
+
+type Claims struct {
+	Nonce string `json:"nonce,omitempty"`
+
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	// HostedDomain is the Google Workspace domain of the account, if any.
+	HostedDomain string `json:"hd,omitempty"`
+	GivenName    string `json:"given_name,omitempty"`
+	FamilyName   string `json:"family_name,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
+// UnmarshalJSON accepts email_verified as a boolean or, as in some older
+// tokens, the string "true".
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type plain Claims
+	var raw struct {
+		*plain
+		EmailVerified any `json:"email_verified,omitempty"`
+	}
+	raw.plain = (*plain)(c)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	switch v := raw.EmailVerified.(type) {
+	case bool:
+		c.EmailVerified = v
+	case string:
+		c.EmailVerified, _ = strconv.ParseBool(v)
+	}
+	return nil
+}
+
+// VerifyIDToken verifies a Google ID token for one of the configured clients.
+// Tokens with an unverified email or, if a hosted domain is configured, from
+// another domain are rejected.
+func (m *Manager) VerifyIDToken(ctx context.Context, idToken string, nonce ...string) (*Claims, error) {
+	if idToken == "" {
+		return nil, errors.New("empty id_token")
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithLeeway(60*time.Second),
+		jwt.WithExpirationRequired(),
+	)
+
+	claims := &Claims{}
+	if _, err := parser.ParseWithClaims(idToken, claims, m.keys.Keyfunc(ctx)); err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(issuers, claims.Issuer) {
+		return nil, errors.New("invalid issuer")
+	}
+
+	if !slices.ContainsFunc(claims.Audience, func(aud string) bool {
+		return slices.Contains(m.config.ClientIDs, aud)
+	}) {
+		return nil, errors.New("invalid audience")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("missing sub")
+	}
+
+	if claims.Email != "" && !claims.EmailVerified {
+		return nil, errors.New("email not verified")
+	}
+
+	if m.config.HostedDomain != "" && !strings.EqualFold(claims.HostedDomain, m.config.HostedDomain) {
+		return nil, errors.New("invalid hosted domain")
+	}
+
+	if len(nonce) > 0 && nonce[0] != "" && claims.Nonce != nonce[0] {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+// Error is an OAuth error answered by Google's token endpoint. errors.Is
+// matches it against ErrInvalidGrant by Code.
+type Error struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	msg := "google: " + e.Code
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+var (
+	// ErrInvalidGrant means the code or refresh token is invalid, expired,
+	// already used or revoked.
+	ErrInvalidGrant = &Error{Code: "invalid_grant"}
+	// ErrInvalidToken is how the revoke endpoint answers a token it does
+	// not know, e.g. one already revoked.
+	ErrInvalidToken = &Error{Code: "invalid_token"}
+)
+
+// ExchangeCode redeems a server auth code for the first configured client.
+func (m *Manager) ExchangeCode(ctx context.Context, code string) (*TokenResponse, error) {
+	if m.config.ClientSecret == "" {
+		return nil, errors.New("google: no client secret configured to redeem codes")
+	}
+
+	data := url.Values{}
+	data.Set("client_id", m.config.ClientIDs[0])
+	data.Set("client_secret", m.config.ClientSecret)
+	data.Set("code", code)
+	data.Set("grant_type", "authorization_code")
+	data.Set("redirect_uri", m.config.RedirectURI)
+
+	return m.postToken(ctx, data)
+}
+
+// Refresh redeems a refresh token from a server auth code. It fails with
+// ErrInvalidGrant once the user has revoked the app's access.
+func (m *Manager) Refresh(ctx context.Context, refreshToken string) (*TokenResponse, error) {
+	if refreshToken == "" {
+		return nil, errors.New("missing refresh token")
+	}
+	if m.config.ClientSecret == "" {
+		return nil, errors.New("google: no client secret configured to refresh tokens")
+	}
+
+	data := url.Values{}
+	data.Set("client_id", m.config.ClientIDs[0])
+	data.Set("client_secret", m.config.ClientSecret)
+	data.Set("refresh_token", refreshToken)
+	data.Set("grant_type", "refresh_token")
+
+	return m.postToken(ctx, data)
+}
+
+// Revoke invalidates a token, which also removes the user's grant for the app.
+func (m *Manager) Revoke(ctx context.Context, token string) error {
+	if token == "" {
+		return errors.New("missing token")
+	}
+
+	data := url.Values{}
+	data.Set("token", token)
+
+	_, err := m.post(ctx, m.config.revokeURL(), data)
+	return err
+}
+
+func (m *Manager) postToken(ctx context.Context, data url.Values) (*TokenResponse, error) {
+	body, err := m.post(ctx, m.config.tokenURL(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out TokenResponse
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// post sends a form to one of Google's OAuth endpoints and returns the body
+// of a 200 answer.
+func (m *Manager) post(ctx context.Context, endpoint string, data url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := m.config.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: google: %w", provider.ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &e) != nil || e.Error == "" {
+			return nil, fmt.Errorf("google: unexpected status %d: %s", resp.StatusCode, body)
+		}
+		return nil, &Error{StatusCode: resp.StatusCode, Code: e.Error, Description: e.ErrorDescription}
+	}
+
+	return body, nil
+}
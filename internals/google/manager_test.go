@@ -0,0 +1,144 @@
+package google_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmirfield/auth-service/internals/google"
+	"github.com/jmirfield/auth-service/internals/google/googletest"
+	"github.com/jmirfield/auth-service/internals/provider"
+)
+
+func TestVerifyIDToken(t *testing.T) {
+	fake := googletest.NewServer()
+	defer fake.Close()
+
+	ctx := context.Background()
+	valid := googletest.Identity{Subject: "1089", Email: "jane@example.com", EmailVerified: true, HostedDomain: "example.com", Nonce: "n-1"}
+
+	tests := []struct {
+		name    string
+		cfg     func(*google.Config)
+		id      func(*googletest.Identity)
+		nonce   string
+		wantErr bool
+	}{
+		{name: "valid", nonce: "n-1"},
+		{name: "no nonce expected"},
+		{name: "nonce mismatch", nonce: "other", wantErr: true},
+		{name: "unverified email", id: func(id *googletest.Identity) { id.EmailVerified = false }, wantErr: true},
+		{name: "no email", id: func(id *googletest.Identity) { id.Email, id.EmailVerified = "", false }},
+		{name: "hosted domain", cfg: func(c *google.Config) { c.HostedDomain = "example.com" }},
+		{name: "other hosted domain", cfg: func(c *google.Config) { c.HostedDomain = "corp.example" }, wantErr: true},
+		{name: "consumer account, hosted domain required", cfg: func(c *google.Config) { c.HostedDomain = "example.com" }, id: func(id *googletest.Identity) { id.HostedDomain = "" }, wantErr: true},
+		{name: "other audience", cfg: func(c *google.Config) { c.ClientIDs = []string{"android-client"} }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fake.Config()
+			if tt.cfg != nil {
+				tt.cfg(cfg)
+			}
+			m, _ := google.NewManager(cfg)
+
+			id := valid
+			if tt.id != nil {
+				tt.id(&id)
+			}
+
+			claims, err := m.VerifyIDToken(ctx, fake.IDToken(id), tt.nonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyIDToken: %v", err)
+			}
+			if claims.Subject != id.Subject || claims.Email != id.Email {
+				t.Fatalf("unexpected claims %+v", claims)
+			}
+		})
+	}
+
+	// A key set that cannot be fetched means Google is unavailable, not that
+	// the token is invalid.
+	cfg := fake.Config()
+	cfg.JWKSURL = fake.URL + "/missing"
+	m, _ := google.NewManager(cfg)
+	if _, err := m.VerifyIDToken(ctx, fake.IDToken(valid)); !errors.Is(err, provider.ErrUnavailable) {
+		t.Fatalf("key set unavailable: expected provider.ErrUnavailable, got %v", err)
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	fake := googletest.NewServer()
+	defer fake.Close()
+
+	ctx := context.Background()
+	m, _ := google.NewManager(fake.Config())
+
+	code := fake.IssueCode(googletest.Identity{Subject: "1089"})
+	tok, err := m.ExchangeCode(ctx, code)
+	if err != nil {
+		t.Fatalf("ExchangeCode: %v", err)
+	}
+	if claims, err := m.VerifyIDToken(ctx, tok.IDToken); err != nil || claims.Subject != "1089" || tok.RefreshToken == "" {
+		t.Fatalf("exchanged tokens: %+v, %+v, %v", tok, claims, err)
+	}
+
+	if _, err := m.ExchangeCode(ctx, code); !errors.Is(err, google.ErrInvalidGrant) {
+		t.Fatalf("reused code: expected ErrInvalidGrant, got %v", err)
+	}
+}
+
+func TestRefreshAndRevoke(t *testing.T) {
+	fake := googletest.NewServer()
+	defer fake.Close()
+
+	ctx := context.Background()
+	m, _ := google.NewManager(fake.Config())
+
+	tok, err := m.ExchangeCode(ctx, fake.IssueCode(googletest.Identity{Subject: "1089"}))
+	if err != nil {
+		t.Fatalf("ExchangeCode: %v", err)
+	}
+
+	refreshed, err := m.Refresh(ctx, tok.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if claims, err := m.VerifyIDToken(ctx, refreshed.IDToken); err != nil || claims.Subject != "1089" {
+		t.Fatalf("refreshed id token: %+v, %v", claims, err)
+	}
+
+	if err := m.Revoke(ctx, tok.RefreshToken); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if !fake.Revoked(tok.RefreshToken) {
+		t.Fatalf("token not revoked at Google")
+	}
+	if _, err := m.Refresh(ctx, tok.RefreshToken); !errors.Is(err, google.ErrInvalidGrant) {
+		t.Fatalf("revoked token: expected ErrInvalidGrant, got %v", err)
+	}
+	if err := m.Revoke(ctx, tok.RefreshToken); !errors.Is(err, google.ErrInvalidToken) {
+		t.Fatalf("revoking twice: expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	fake := googletest.NewServer()
+	ctx := context.Background()
+	m, _ := google.NewManager(fake.Config())
+	fake.Close()
+
+	if _, err := m.ExchangeCode(ctx, "code"); !errors.Is(err, provider.ErrUnavailable) {
+		t.Fatalf("ExchangeCode with Google down: expected provider.ErrUnavailable, got %v", err)
+	}
+	if err := m.Revoke(ctx, "refresh"); !errors.Is(err, provider.ErrUnavailable) {
+		t.Fatalf("Revoke with Google down: expected provider.ErrUnavailable, got %v", err)
+	}
+}
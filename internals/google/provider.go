@@ -0,0 +1,99 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// Provider is Google Sign-In as a provider.Provider. Google has one client
+// that redeems codes, so the tokens it returns carry no client id, and it
+// puts everything about the user in the ID token.
+type Provider struct {
+	provider.NoUserInfo
+	m *Manager
+}
+
+func NewProvider(m *Manager) *Provider {
+	return &Provider{m: m}
+}
+
+func (p *Provider) ExchangeCode(ctx context.Context, code provider.Code) (*provider.Tokens, error) {
+	if code.ClientID != "" && code.ClientID != p.m.config.ClientIDs[0] {
+		return nil, provider.ErrUnknownClient
+	}
+
+	tok, err := p.m.ExchangeCode(ctx, code.Code)
+	if err != nil {
+		return nil, providerError(err)
+	}
+	return tokens(tok), nil
+}
+
+func (p *Provider) VerifyIDToken(ctx context.Context, idToken, nonce string) (*provider.Identity, error) {
+	claims, err := p.m.VerifyIDToken(ctx, idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{}
+	if claims.Email != "" {
+		attrs[storage.AttrEmail] = claims.Email
+		attrs[storage.AttrEmailVerified] = strconv.FormatBool(claims.EmailVerified)
+	}
+	if claims.GivenName != "" {
+		attrs[storage.AttrGivenName] = claims.GivenName
+	}
+	if claims.FamilyName != "" {
+		attrs[storage.AttrFamilyName] = claims.FamilyName
+	}
+	return &provider.Identity{Subject: claims.Subject, Attrs: attrs}, nil
+}
+
+func (p *Provider) Refresh(ctx context.Context, refreshToken, _ string) (*provider.Tokens, error) {
+	tok, err := p.m.Refresh(ctx, refreshToken)
+	if err != nil {
+		return nil, providerError(err)
+	}
+	return tokens(tok), nil
+}
+
+func (p *Provider) Revoke(ctx context.Context, refreshToken, _ string) error {
+	return providerError(p.m.Revoke(ctx, refreshToken))
+}
+
+func tokens(tok *TokenResponse) *provider.Tokens {
+	return &provider.Tokens{
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		IDToken:      tok.IDToken,
+	}
+}
+
+// providerError wraps err with the provider.Err* value it stands for. A token
+// the revoke endpoint does not know is reported like an invalid grant.
+func providerError(err error) error {
+	var target error
+	var e *Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrInvalidGrant), errors.Is(err, ErrInvalidToken):
+		target = provider.ErrInvalidGrant
+	case !errors.As(err, &e):
+		return err
+	case e.Code == "invalid_request":
+		target = provider.ErrInvalidRequest
+	case e.Code == "invalid_client", e.Code == "unauthorized_client":
+		target = provider.ErrClientRejected
+	case e.StatusCode >= 500:
+		target = provider.ErrUnavailable
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", target, err)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/secret"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+type AccountHandler struct {
+	s   storage.Store
+	reg *provider.Registry
+	scm *secret.Manager
+}
+
+func NewAccountHandler(store storage.Store, reg *provider.Registry, scm *secret.Manager) *AccountHandler {
+	return &AccountHandler{s: store, reg: reg, scm: scm}
+}
+
+// Delete removes the caller's account. Stored provider tokens are revoked
+// first so the user's grants, like their Sign in with Apple one, go with it;
+// if a provider cannot be reached nothing is deleted and the client may retry.
+func (h *AccountHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, ok := httpx.UserIDFromContext(ctx)
+	if !ok {
+		httpx.Error(w, http.StatusUnauthorized, "missing or invalid session")
+		return
+	}
+
+	// A user with no record may still have identities linked; Delete
+	// removes those too.
+	rec, err := h.s.Get(ctx, uid)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(rec.RefreshTokensByProvider)) {
+		if err := revokeProviderToken(ctx, h.reg, h.scm, rec, name); err != nil {
+			providerError(w, r, name, err)
+			return
+		}
+	}
+
+	if err := h.s.Delete(ctx, uid); err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	httpx.NoContent(w)
+}
@@ -1,97 +1,180 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/jmirfield/auth-service/internals/apple"
 	httpx "github.com/jmirfield/auth-service/internals/http"
-	"github.com/jmirfield/auth-service/internals/secret"
-	"github.com/jmirfield/auth-service/internals/session"
+	"github.com/jmirfield/auth-service/internals/oauthstate"
+	"github.com/jmirfield/auth-service/internals/provider"
 	"github.com/jmirfield/auth-service/internals/storage"
 )
 
+// AppleHandler serves Apple's web flow and server-to-server notifications;
+// native apps sign in through SignInHandler.
 type AppleHandler struct {
-	c   *apple.Config
-	s   storage.Store
-	sm  *session.Manager
-	am  *apple.Manager
-	scm *secret.Manager
+	c      *apple.Config
+	s      storage.Store
+	am     *apple.Manager
+	signin *SignInHandler
+	states *oauthstate.Store
 }
 
-func NewAppleHandler(cfg *apple.Config, store storage.Store, mgr *session.Manager, am *apple.Manager, scm *secret.Manager) *AppleHandler {
-	return &AppleHandler{c: cfg, s: store, sm: mgr, am: am, scm: scm}
+func NewAppleHandler(cfg *apple.Config, store storage.Store, am *apple.Manager, signin *SignInHandler) *AppleHandler {
+	return &AppleHandler{c: cfg, s: store, am: am, signin: signin, states: oauthstate.NewStore(store, 0)}
 }
 
-type appleAuthReq struct {
-	Code  string `json:"code"`
-	Nonce string `json:"nonce,omitempty"`
-}
+// appleStateCookie ties a web sign in to the browser that started it, so a
+// callback carrying someone else's state is refused.
+const appleStateCookie = "apple_state"
+
+// Start begins the web flow: it remembers a fresh state, nonce and PKCE
+// verifier and redirects the browser to Apple.
+func (h *AppleHandler) Start(w http.ResponseWriter, r *http.Request) {
+	if h.c.RedirectURI == "" {
+		httpx.Error(w, http.StatusNotFound, "web sign in is not configured")
+		return
+	}
 
-type authResponse struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	state, st, err := h.states.Begin(r.Context(), storage.ProviderApple)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	// Apple posts the callback cross-site, so the cookie must be SameSite=None.
+	http.SetCookie(w, &http.Cookie{
+		Name:     appleStateCookie,
+		Value:    state,
+		Path:     "/auth/apple",
+		MaxAge:   int(oauthstate.DefaultTTL / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	http.Redirect(w, r, h.am.AuthorizeURL(state, st.Nonce, st.CodeChallenge()), http.StatusFound)
 }
 
-func (h *AppleHandler) Auth(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// Callback receives the form Apple posts at the end of the web flow.
+func (h *AppleHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid form")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     appleStateCookie,
+		Path:     "/auth/apple",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
 
-	var in appleAuthReq
-	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Code == "" {
-		httpx.Error(w, http.StatusBadRequest, "missing code")
+	state := r.PostForm.Get("state")
+	cookie, err := r.Cookie(appleStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_state", "invalid state")
 		return
 	}
 
-	tok, err := h.am.ExchangeCode(in.Code)
+	st, err := h.states.Take(r.Context(), state)
+	if errors.Is(err, oauthstate.ErrUnknownState) || (err == nil && st.Provider != storage.ProviderApple) {
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_state", "invalid state")
+		return
+	}
 	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, "bad code")
+		httpx.InternalServerError(w)
 		return
 	}
 
-	var claims *apple.Claims
-	claims, err = h.am.VerifyIDToken(tok.IDToken, in.Nonce)
-	if err != nil {
-		httpx.Error(w, http.StatusBadRequest, "invalid id token")
+	// e.g. user_cancelled_authorize
+	if e := r.PostForm.Get("error"); e != "" {
+		httpx.ErrorCode(w, http.StatusBadRequest, e, "sign in with apple failed")
 		return
 	}
 
-	userID := claims.Subject
-	appAccess, appRefresh, err := h.sm.IssuePair(userID, nil)
-	if err != nil {
-		httpx.InternalServerError(w)
+	code := r.PostForm.Get("code")
+	if code == "" {
+		httpx.ErrorCode(w, http.StatusBadRequest, "missing_code", "missing code")
 		return
 	}
 
-	rClaims, err := h.sm.ParseRefresh(appRefresh)
+	// Apple posts the user object, as JSON, on the first sign in only.
+	var user json.RawMessage
+	if s := r.PostForm.Get("user"); s != "" {
+		user = json.RawMessage(s)
+	}
+
+	h.signin.signIn(w, r, storage.ProviderApple, apple.NewProvider(h.am), provider.Code{
+		Code:         code,
+		ClientID:     h.c.WebClient(),
+		RedirectURI:  h.c.RedirectURI,
+		CodeVerifier: st.CodeVerifier,
+	}, "", st.Nonce, user)
+}
+
+type appleNotificationReq struct {
+	Payload string `json:"payload"`
+}
+
+// Notifications receives Apple's server-to-server events. When a user stops
+// using Sign in with Apple or deletes their Apple account, every session they
+// hold is revoked and the stored Apple refresh token is dropped.
+func (h *AppleHandler) Notifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var in appleNotificationReq
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Payload == "" {
+		httpx.Error(w, http.StatusBadRequest, "missing payload")
+		return
+	}
+
+	ev, err := h.am.VerifyNotification(ctx, in.Payload)
 	if err != nil {
-		httpx.InternalServerError(w)
+		httpx.Error(w, http.StatusBadRequest, "invalid notification")
 		return
 	}
 
-	enctok, err := h.scm.Encrypt(tok.RefreshToken)
+	switch ev.Type {
+	case apple.EventConsentRevoked, apple.EventAccountDelete:
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	uid, err := h.signin.ids.Lookup(ctx, storage.ProviderApple, ev.Subject)
+	if errors.Is(err, storage.ErrNotFound) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	if err != nil {
 		httpx.InternalServerError(w)
 		return
 	}
 
-	if _, err := h.s.Update(ctx, userID, func(rec storage.Record) storage.Record {
-		rec.UserID = userID
-		rec.RefreshTokensByProvider[storage.ProviderApple] = enctok
-		rec.RefreshTokens = append(rec.RefreshTokens, storage.RefreshTokenRecord{
-			Hash:      secret.Hash(appRefresh),
-			JTI:       rClaims.ID,
-			ExpiresAt: rClaims.ExpiresAt.Time,
-			CreatedAt: rClaims.IssuedAt.Time,
-		})
-
-		return rec
-	}); err != nil {
+	// Update would create a record for a user whose first sign in never
+	// got as far as storing one.
+	exists, err := h.s.UserExists(ctx, uid)
+	if err != nil {
 		httpx.InternalServerError(w)
 		return
 	}
 
-	httpx.Json(w, http.StatusOK, authResponse{
-		AccessToken:  appAccess,
-		RefreshToken: appRefresh,
-	})
+	if exists {
+		if _, err := h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
+			rec.RefreshTokens = nil
+			rec.RemoveProviderToken(storage.ProviderApple)
+			return rec
+		}); err != nil {
+			httpx.InternalServerError(w)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,511 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/apple"
+	"github.com/jmirfield/auth-service/internals/apple/appletest"
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/identity"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/secret"
+	"github.com/jmirfield/auth-service/internals/session"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+type appleEnv struct {
+	fake    *appletest.Server
+	store   storage.Store
+	sm      *session.Manager
+	scm     *secret.Manager
+	am      *apple.Manager
+	reg     *provider.Registry
+	signin  *SignInHandler
+	apple   *AppleHandler
+	account *AccountHandler
+}
+
+func newAppleEnv(t *testing.T) *appleEnv {
+	t.Helper()
+
+	fake := appletest.NewServer()
+	t.Cleanup(fake.Close)
+
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+
+	cfg := fake.Config()
+	cfg.RedirectURI = "https://app.example.com/auth/apple/callback"
+	cfg.WebClientID = fake.ServicesID
+	am, err := apple.NewManager(cfg, scm)
+	if err != nil {
+		t.Fatalf("apple manager: %v", err)
+	}
+
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		Issuer:          "issuer.test",
+		Audience:        "aud.test",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+
+	store := storage.NewMemoryStore()
+	reg := provider.NewRegistry()
+	reg.Register(storage.ProviderApple, apple.NewProvider(am))
+	signin := NewSignInHandler(store, sm, reg, scm, identity.NewManager(&identity.Config{}, store))
+	return &appleEnv{
+		fake:    fake,
+		store:   store,
+		sm:      sm,
+		scm:     scm,
+		am:      am,
+		reg:     reg,
+		signin:  signin,
+		apple:   NewAppleHandler(cfg, store, am, signin),
+		account: NewAccountHandler(store, reg, scm),
+	}
+}
+
+// auth runs POST /auth/apple with in and returns the recorder.
+func (e *appleEnv) auth(in signInReq) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(in)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/auth/apple", bytes.NewReader(body))
+	req.SetPathValue("provider", storage.ProviderApple)
+	e.signin.Auth(rec, req)
+	return rec
+}
+
+// signIn runs POST /auth/apple with a code and returns the recorder.
+func (e *appleEnv) signIn(t *testing.T, code, nonce string) *httptest.ResponseRecorder {
+	t.Helper()
+	return e.auth(signInReq{Code: code, Nonce: nonce})
+}
+
+// user returns the id of the user the Apple account signs in as.
+func (e *appleEnv) user(t *testing.T, subject string) string {
+	t.Helper()
+	return userOf(t, e.store, storage.ProviderApple, subject)
+}
+
+// appleToken returns the user's stored Apple refresh token, decrypted.
+func (e *appleEnv) appleToken(t *testing.T, uid string) string {
+	t.Helper()
+	rec, err := e.store.Get(context.Background(), uid)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	tok, err := e.scm.Decrypt(rec.RefreshTokensByProvider[storage.ProviderApple])
+	if err != nil {
+		t.Fatalf("decrypt apple token: %v", err)
+	}
+	return tok
+}
+
+// nonce runs GET /auth/nonce and returns the nonce.
+func (e *appleEnv) nonce(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	NewNonceHandler(e.signin.nonces).Issue(rec, httptest.NewRequest(http.MethodGet, "/auth/nonce", nil))
+	var out nonceRes
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil || out.Nonce == "" {
+		t.Fatalf("nonce: status %d, body %s", rec.Code, rec.Body)
+	}
+	return out.Nonce
+}
+
+func TestAppleAuth_EndToEnd(t *testing.T) {
+	env := newAppleEnv(t)
+	nonce := env.nonce(t)
+	id := appletest.Identity{Subject: "001234.user", Nonce: nonce}
+
+	code := env.fake.IssueCode(id)
+	rec := env.signIn(t, code, nonce)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	var out authResponse
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	claims, err := env.sm.ParseAccess(out.AccessToken)
+	if err != nil || claims.UserID != env.user(t, id.Subject) {
+		t.Fatalf("access token for %q: %+v, %v", id.Subject, claims, err)
+	}
+
+	exists, err := env.store.RefreshTokenExists(context.Background(), secret.Hash(out.RefreshToken))
+	if err != nil || !exists {
+		t.Fatalf("app refresh token not stored: %v, %v", exists, err)
+	}
+
+	// The stored Apple token is live: Apple accepts it for a refresh.
+	if _, err := env.am.Refresh(context.Background(), env.appleToken(t, env.user(t, id.Subject))); err != nil {
+		t.Fatalf("apple refresh with stored token: %v", err)
+	}
+
+	if rec := env.signIn(t, code, env.nonce(t)); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"invalid_grant"`) {
+		t.Fatalf("reused code: status %d, body %s; want 400 invalid_grant", rec.Code, rec.Body)
+	}
+
+	if rec := env.signIn(t, env.fake.IssueCode(id), env.nonce(t)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("nonce mismatch: status %d, want 400", rec.Code)
+	}
+}
+
+func TestAppleAuth_Nonces(t *testing.T) {
+	env := newAppleEnv(t)
+	nonce := env.nonce(t)
+	id := appletest.Identity{Subject: "001234.user", Nonce: sha256Hex(nonce)}
+
+	if rec := env.signIn(t, env.fake.IssueCode(id), nonce); rec.Code != http.StatusOK {
+		t.Fatalf("sign in with hashed nonce: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	// The nonce is used up, so a second code for the same ID token nonce,
+	// or a replayed ID token, is refused before Apple is asked.
+	if rec := env.signIn(t, env.fake.IssueCode(id), nonce); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"invalid_nonce"`) {
+		t.Fatalf("replayed nonce: status %d, body %s; want 400 invalid_nonce", rec.Code, rec.Body)
+	}
+
+	// Nonces we did not issue are refused.
+	chosen := appletest.Identity{Subject: "001234.user", Nonce: "client-chosen"}
+	if rec := env.signIn(t, env.fake.IssueCode(chosen), "client-chosen"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("client-chosen nonce: status %d, want 400", rec.Code)
+	}
+
+	// Without a nonce the sign in only passes while nonces are optional.
+	if rec := env.signIn(t, env.fake.IssueCode(appletest.Identity{Subject: "001234.user"}), ""); rec.Code != http.StatusOK {
+		t.Fatalf("no nonce, optional: status %d, body %s", rec.Code, rec.Body)
+	}
+	env.apple.c.RequireNonce = true
+	if rec := env.signIn(t, env.fake.IssueCode(appletest.Identity{Subject: "001234.user"}), ""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"missing_nonce"`) {
+		t.Fatalf("no nonce, required: status %d, body %s; want 400 missing_nonce", rec.Code, rec.Body)
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAccountDelete_RevokesAppleToken(t *testing.T) {
+	env := newAppleEnv(t)
+	id := appletest.Identity{Subject: "001234.user"}
+
+	rec := env.signIn(t, env.fake.IssueCode(id), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+	var out authResponse
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	uid := env.user(t, id.Subject)
+	appleToken := env.appleToken(t, uid)
+
+	req := httptest.NewRequest(http.MethodDelete, "/auth/account", nil)
+	req.Header.Set("Authorization", "Bearer "+out.AccessToken)
+	rec = httptest.NewRecorder()
+	httpx.NewAuth(env.sm).Middleware(http.HandlerFunc(env.account.Delete)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	if !env.fake.Revoked(appleToken) {
+		t.Fatalf("apple token was not revoked")
+	}
+	if ok, err := env.store.UserExists(context.Background(), uid); err != nil || ok {
+		t.Fatalf("account still stored: %v, %v", ok, err)
+	}
+	if _, err := env.store.GetIdentity(context.Background(), storage.ProviderApple, id.Subject); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("identity still linked: %v", err)
+	}
+
+	// Identities left pointing at a user without a record go too.
+	orphan := storage.Identity{Provider: storage.ProviderApple, Subject: "001234.orphan", UserID: "usr_orphan", CreatedAt: time.Now()}
+	if err := env.store.LinkIdentity(context.Background(), orphan); err != nil {
+		t.Fatalf("LinkIdentity: %v", err)
+	}
+	access, _, err := env.sm.IssuePair(orphan.UserID, nil)
+	if err != nil {
+		t.Fatalf("IssuePair: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodDelete, "/auth/account", nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	rec = httptest.NewRecorder()
+	httpx.NewAuth(env.sm).Middleware(http.HandlerFunc(env.account.Delete)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete without record: status %d, body %s", rec.Code, rec.Body)
+	}
+	if _, err := env.store.GetIdentity(context.Background(), orphan.Provider, orphan.Subject); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("orphaned identity still linked: %v", err)
+	}
+}
+
+func TestAppleNotifications_ConsentRevoked(t *testing.T) {
+	env := newAppleEnv(t)
+	id := appletest.Identity{Subject: "001234.user"}
+
+	if rec := env.signIn(t, env.fake.IssueCode(id), ""); rec.Code != http.StatusOK {
+		t.Fatalf("sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	send := func(payload string) int {
+		body, _ := json.Marshal(appleNotificationReq{Payload: payload})
+		rec := httptest.NewRecorder()
+		env.apple.Notifications(rec, httptest.NewRequest(http.MethodPost, "/auth/apple/notifications", bytes.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := send("not-a-jwt"); code != http.StatusBadRequest {
+		t.Fatalf("garbage payload: status %d, want 400", code)
+	}
+
+	if code := send(env.fake.Notification(apple.EventConsentRevoked, id.Subject)); code != http.StatusOK {
+		t.Fatalf("notification: status %d", code)
+	}
+
+	got, err := env.store.Get(context.Background(), env.user(t, id.Subject))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got.RefreshTokens) != 0 || got.RefreshTokensByProvider[storage.ProviderApple] != "" {
+		t.Fatalf("sessions not revoked: %+v", got)
+	}
+
+	// Events for users we never saw must not create records.
+	if code := send(env.fake.Notification(apple.EventAccountDelete, "unknown")); code != http.StatusOK {
+		t.Fatalf("notification: status %d", code)
+	}
+	if ok, _ := env.store.UserExists(context.Background(), "unknown"); ok {
+		t.Fatalf("notification created a record for an unknown user")
+	}
+}
+
+func TestAppleAuth_StoresUserAttrs(t *testing.T) {
+	env := newAppleEnv(t)
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+		AccessAttrs:     []string{storage.AttrEmail, storage.AttrGivenName},
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+	env.sm = sm
+	env.signin = NewSignInHandler(env.store, sm, env.reg, env.scm, identity.NewManager(&identity.Config{}, env.store))
+
+	id := appletest.Identity{
+		Subject:        "001234.user",
+		Email:          "abc@privaterelay.appleid.com",
+		EmailVerified:  true,
+		IsPrivateEmail: true,
+		RealUserStatus: apple.RealUserStatusLikelyReal,
+	}
+
+	// Only the first sign in carries the user object.
+	user := json.RawMessage(`{"name":{"firstName":"Jane","lastName":"Doe"},"email":"abc@privaterelay.appleid.com"}`)
+	rec := env.auth(signInReq{Code: env.fake.IssueCode(id), User: user})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := env.signIn(t, env.fake.IssueCode(id), ""); rec.Code != http.StatusOK {
+		t.Fatalf("second sign in: status %d, body %s", rec.Code, rec.Body)
+	} else {
+		var out authResponse
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		claims, err := sm.ParseAccess(out.AccessToken)
+		if err != nil {
+			t.Fatalf("ParseAccess: %v", err)
+		}
+		want := map[string]string{storage.AttrEmail: id.Email, storage.AttrGivenName: "Jane"}
+		if len(claims.Attrs) != len(want) || claims.Attrs[storage.AttrEmail] != want[storage.AttrEmail] || claims.Attrs[storage.AttrGivenName] != "Jane" {
+			t.Fatalf("access attrs: got %v, want %v", claims.Attrs, want)
+		}
+	}
+
+	got, err := env.store.Get(context.Background(), env.user(t, id.Subject))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	want := map[string]string{
+		storage.AttrEmail:          id.Email,
+		storage.AttrEmailVerified:  "true",
+		storage.AttrIsPrivateEmail: "true",
+		storage.AttrRealUserStatus: "likely_real",
+		storage.AttrGivenName:      "Jane",
+		storage.AttrFamilyName:     "Doe",
+	}
+	for k, v := range want {
+		if got.Attrs[k] != v {
+			t.Fatalf("attr %s: got %q, want %q (all: %v)", k, got.Attrs[k], v, got.Attrs)
+		}
+	}
+}
+
+// startWeb runs GET /auth/apple/start and returns Apple's authorize URL and
+// the state cookie.
+func (e *appleEnv) startWeb(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.apple.Start(rec, httptest.NewRequest(http.MethodGet, "/auth/apple/start", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("start: status %d, body %s", rec.Code, rec.Body)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != appleStateCookie || cookies[0].SameSite != http.SameSiteNoneMode || !cookies[0].Secure {
+		t.Fatalf("start: unexpected cookies %+v", cookies)
+	}
+	return rec.Header().Get("Location"), cookies[0]
+}
+
+// callback posts form to the callback as Apple would, with cookie if set.
+func (e *appleEnv) callback(form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/auth/apple/callback", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	e.apple.Callback(rec, req)
+	return rec
+}
+
+func TestAppleWebFlow(t *testing.T) {
+	env := newAppleEnv(t)
+	id := appletest.Identity{Subject: "001234.user", Email: "jane@example.com", EmailVerified: true}
+
+	authorizeURL, cookie := env.startWeb(t)
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		t.Fatalf("parse authorize url: %v", err)
+	}
+	if q := u.Query(); q.Get("response_mode") != "form_post" || q.Get("state") != cookie.Value || q.Get("nonce") == "" || q.Get("code_challenge") == "" {
+		t.Fatalf("unexpected authorize url %s", authorizeURL)
+	}
+
+	user := &apple.User{Email: id.Email}
+	user.Name.FirstName = "Jane"
+	form, err := env.fake.Authorize(authorizeURL, id, user)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	rec := env.callback(form, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: status %d, body %s", rec.Code, rec.Body)
+	}
+	var out authResponse
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if claims, err := env.sm.ParseAccess(out.AccessToken); err != nil || claims.UserID != env.user(t, id.Subject) {
+		t.Fatalf("access token for %q: %+v, %v", id.Subject, claims, err)
+	}
+	if got, _ := env.store.Get(context.Background(), env.user(t, id.Subject)); got.Attrs[storage.AttrGivenName] != "Jane" {
+		t.Fatalf("name from the posted user object not stored: %v", got.Attrs)
+	}
+
+	// A state works once.
+	if rec := env.callback(form, cookie); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"invalid_state"`) {
+		t.Fatalf("replayed callback: status %d, body %s; want 400 invalid_state", rec.Code, rec.Body)
+	}
+}
+
+func TestAppleWebFlow_RejectsForeignState(t *testing.T) {
+	env := newAppleEnv(t)
+	id := appletest.Identity{Subject: "001234.user"}
+
+	authorizeURL, cookie := env.startWeb(t)
+	form, err := env.fake.Authorize(authorizeURL, id, nil)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	// Without the browser's cookie the state is not accepted.
+	if rec := env.callback(form, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("callback without cookie: status %d, want 400", rec.Code)
+	}
+
+	// A code paired with another sign in's state fails PKCE at Apple.
+	_, other := env.startWeb(t)
+	form.Set("state", other.Value)
+	if rec := env.callback(form, other); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"invalid_grant"`) {
+		t.Fatalf("mismatched verifier: status %d, body %s; want 400 invalid_grant", rec.Code, rec.Body)
+	}
+
+	// The user cancelling at Apple is reported as such.
+	_, cookie = env.startWeb(t)
+	cancelled := url.Values{"state": {cookie.Value}, "error": {"user_cancelled_authorize"}}
+	if rec := env.callback(cancelled, cookie); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "user_cancelled_authorize") {
+		t.Fatalf("cancelled: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAppleAuth_SecondClient(t *testing.T) {
+	env := newAppleEnv(t)
+	web := env.fake.ServicesID
+	id := appletest.Identity{Subject: "001234.user", ClientID: web}
+
+	if rec := env.auth(signInReq{Code: env.fake.IssueCode(id), ClientID: "com.example.other"}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"unknown_client"`) {
+		t.Fatalf("unknown client: status %d, body %s; want 400 unknown_client", rec.Code, rec.Body)
+	}
+
+	// A code for the Services ID cannot be redeemed as the default client.
+	if rec := env.auth(signInReq{Code: env.fake.IssueCode(id)}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("code for another client: status %d, want 400", rec.Code)
+	}
+
+	rec := env.auth(signInReq{Code: env.fake.IssueCode(id), ClientID: web})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+	var out authResponse
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	got, err := env.store.Get(context.Background(), env.user(t, id.Subject))
+	if err != nil || got.ProviderClientIDs[storage.ProviderApple] != web {
+		t.Fatalf("client id not stored: %+v, %v", got.ProviderClientIDs, err)
+	}
+
+	// The stored token is refreshed and revoked as the client it belongs to.
+	appleToken := env.appleToken(t, env.user(t, id.Subject))
+	if _, err := env.am.Refresh(context.Background(), appleToken, apple.WithClientID(web)); err != nil {
+		t.Fatalf("apple refresh as %s: %v", web, err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/auth/account", nil)
+	req.Header.Set("Authorization", "Bearer "+out.AccessToken)
+	rec = httptest.NewRecorder()
+	httpx.NewAuth(env.sm).Middleware(http.HandlerFunc(env.account.Delete)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d, body %s", rec.Code, rec.Body)
+	}
+	if !env.fake.Revoked(appleToken) {
+		t.Fatalf("apple token was not revoked as %s", web)
+	}
+}
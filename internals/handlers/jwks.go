@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/session"
+)
+
+// jwksMaxAge is how long gateways may cache the key set. Keep it well below
+// how long a retired key keeps verifying so caches pick up new keys first.
+const jwksMaxAge = time.Hour
+
+type JWKSHandler struct {
+	m *session.Manager
+}
+
+func NewJWKSHandler(mgr *session.Manager) *JWKSHandler {
+	return &JWKSHandler{m: mgr}
+}
+
+func (h *JWKSHandler) Keys(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(h.m.JWKS())
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge.Seconds())))
+	w.Header().Set("ETag", etag)
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	httpx.Json(w, http.StatusOK, json.RawMessage(body))
+}
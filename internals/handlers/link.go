@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/identity"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+type identityResp struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type identitiesResp struct {
+	Identities []identityResp `json:"identities"`
+}
+
+// Identities serves GET /auth/identities: the providers the caller can sign
+// in with.
+func (h *SignInHandler) Identities(w http.ResponseWriter, r *http.Request) {
+	uid, ok := httpx.UserIDFromContext(r.Context())
+	if !ok {
+		httpx.Error(w, http.StatusUnauthorized, "missing or invalid session")
+		return
+	}
+
+	h.writeIdentities(w, r, uid)
+}
+
+// Link serves POST /auth/link/{provider}. The caller signs in with the
+// provider as with POST /auth/{provider}, and the account is linked to their
+// user rather than signing them in. That sign in is the only proof of the
+// account that is accepted; a matching email never is.
+func (h *SignInHandler) Link(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, ok := httpx.UserIDFromContext(ctx)
+	if !ok {
+		httpx.Error(w, http.StatusUnauthorized, "missing or invalid session")
+		return
+	}
+
+	// The session may outlive a deleted account, which must not come back.
+	exists, err := h.s.UserExists(ctx, uid)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+	if !exists {
+		httpx.Error(w, http.StatusUnauthorized, "missing or invalid session")
+		return
+	}
+
+	name, p, in, ok := h.readSignIn(w, r)
+	if !ok {
+		return
+	}
+
+	code := provider.Code{Code: in.Code, ClientID: in.ClientID, RedirectURI: in.RedirectURI, CodeVerifier: in.CodeVerifier}
+	v, ok := h.verify(w, r, name, p, code, in.IDToken, in.Nonce, in.User)
+	if !ok {
+		return
+	}
+
+	err = h.ids.Link(ctx, uid, name, v.subject, v.attrs)
+	switch {
+	case errors.Is(err, identity.ErrTaken):
+		httpx.ErrorCode(w, http.StatusConflict, "identity_taken", "this "+name+" account belongs to another user")
+		return
+	case errors.Is(err, identity.ErrProviderLinked):
+		httpx.ErrorCode(w, http.StatusConflict, "provider_linked", "another "+name+" account is already linked")
+		return
+	case err != nil:
+		httpx.InternalServerError(w)
+		return
+	}
+
+	update, err := h.storeProviderToken(name, v.tok)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+	if update != nil {
+		if _, err := h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
+			update(&rec)
+			return rec
+		}); err != nil {
+			httpx.InternalServerError(w)
+			return
+		}
+	}
+
+	h.writeIdentities(w, r, uid)
+}
+
+// Unlink serves DELETE /auth/link/{provider}. The provider's token is revoked
+// first; if the provider cannot be reached nothing is unlinked and the client
+// may retry. A user's only identity cannot be unlinked.
+func (h *SignInHandler) Unlink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, ok := httpx.UserIDFromContext(ctx)
+	if !ok {
+		httpx.Error(w, http.StatusUnauthorized, "missing or invalid session")
+		return
+	}
+
+	name := r.PathValue("provider")
+	hasToken := false
+	_, err := h.ids.Unlink(ctx, uid, name, func(storage.Identity) error {
+		rec, err := h.s.Get(ctx, uid)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := revokeProviderToken(ctx, h.reg, h.scm, rec, name); err != nil {
+			return providerErr{err}
+		}
+		hasToken = rec.RefreshTokensByProvider[name] != ""
+		return nil
+	})
+	var perr providerErr
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		httpx.ErrorCode(w, http.StatusNotFound, "not_linked", "no "+name+" account is linked")
+		return
+	case errors.Is(err, identity.ErrLastIdentity):
+		httpx.ErrorCode(w, http.StatusConflict, "last_identity", "the only way to sign in cannot be unlinked")
+		return
+	case errors.As(err, &perr):
+		providerError(w, r, name, perr.err)
+		return
+	case err != nil:
+		httpx.InternalServerError(w)
+		return
+	}
+
+	if hasToken {
+		if _, err := h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
+			rec.RemoveProviderToken(name)
+			return rec
+		}); err != nil {
+			httpx.InternalServerError(w)
+			return
+		}
+	}
+
+	httpx.NoContent(w)
+}
+
+// providerErr marks an error as the provider's, to be answered with
+// providerError.
+type providerErr struct{ err error }
+
+func (e providerErr) Error() string { return e.err.Error() }
+
+func (h *SignInHandler) writeIdentities(w http.ResponseWriter, r *http.Request, uid string) {
+	ids, err := h.ids.List(r.Context(), uid)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	out := identitiesResp{Identities: make([]identityResp, len(ids))}
+	for i, id := range ids {
+		out.Identities[i] = identityResp{Provider: id.Provider, Email: id.Email, CreatedAt: id.CreatedAt}
+	}
+	httpx.Json(w, http.StatusOK, out)
+}
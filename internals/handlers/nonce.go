@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/nonce"
+)
+
+type NonceHandler struct {
+	n *nonce.Store
+}
+
+func NewNonceHandler(store *nonce.Store) *NonceHandler {
+	return &NonceHandler{n: store}
+}
+
+type nonceRes struct {
+	Nonce     string `json:"nonce"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// useNonce consumes n, if set, so that a replayed ID token fails the nonce
+// check. It answers the request and returns false if n cannot be used.
+func useNonce(w http.ResponseWriter, r *http.Request, nonces *nonce.Store, n string) bool {
+	if n == "" {
+		return true
+	}
+
+	err := nonces.Consume(r.Context(), n)
+	if errors.Is(err, nonce.ErrUnknownNonce) {
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_nonce", "invalid nonce")
+		return false
+	}
+	if err != nil {
+		httpx.InternalServerError(w)
+		return false
+	}
+	return true
+}
+
+// Issue hands out a nonce for the client to put into its next sign in.
+func (h *NonceHandler) Issue(w http.ResponseWriter, r *http.Request) {
+	n, err := h.n.Issue(r.Context())
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	httpx.Json(w, http.StatusOK, nonceRes{Nonce: n, ExpiresIn: int(h.n.TTL().Seconds())})
+}
@@ -2,9 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
+	"maps"
 	"net/http"
+	"slices"
 
 	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/secret"
 	"github.com/jmirfield/auth-service/internals/session"
 	"github.com/jmirfield/auth-service/internals/storage"
 )
@@ -12,10 +18,14 @@ import (
 type SessionHandler struct {
 	m *session.Manager
 	s storage.Store
+	// revoke, when set, makes RevokeAll revoke the user's tokens for these
+	// providers as well; scm decrypts them.
+	revoke *provider.Registry
+	scm    *secret.Manager
 }
 
-func NewSessionHandler(mgr *session.Manager, store storage.Store) *SessionHandler {
-	return &SessionHandler{m: mgr, s: store}
+func NewSessionHandler(mgr *session.Manager, store storage.Store, revoke *provider.Registry, scm *secret.Manager) *SessionHandler {
+	return &SessionHandler{m: mgr, s: store, revoke: revoke, scm: scm}
 }
 
 type refreshReq struct {
@@ -48,25 +58,68 @@ func (h *SessionHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rec, err := h.s.Get(ctx, uid)
+	oldHash := secret.Hash(in.RefreshToken)
+	owner, _, err := h.s.FindRefreshTokenByHash(ctx, oldHash)
+	if errors.Is(err, storage.ErrNotFound) {
+		h.rejectUnknownRefresh(w, r, claims)
+		return
+	}
 	if err != nil {
-		httpx.Error(w, http.StatusUnauthorized, "user not found or disabled")
+		httpx.InternalServerError(w)
 		return
 	}
 
-	if len(rec.RefreshTokens) <= 0 {
+	if owner != uid {
 		httpx.Error(w, http.StatusUnauthorized, "invalid refresh token")
 		return
 	}
 
-	_, found := rec.FindRefreshToken(in.RefreshToken)
-	if !found {
+	var attrs map[string]string
+	if h.m.HasAccessAttrs() {
+		rec, err := h.s.Get(ctx, uid)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			httpx.InternalServerError(w)
+			return
+		}
+		attrs = h.m.AccessAttrs(rec.Attrs)
+	}
+
+	newAccess, newRefresh, err := h.m.RefreshFrom(in.RefreshToken, attrs, true)
+	if err != nil {
 		httpx.Error(w, http.StatusUnauthorized, "invalid refresh token")
 		return
 	}
 
-	newAccess, newRefresh, err := h.m.RefreshFrom(in.RefreshToken, nil, true)
+	newClaims, err := h.m.ParseRefresh(newRefresh)
 	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	// Swap the presented token for its successor. If a concurrent request
+	// rotated it first, this one is a replay: revoke the whole family.
+	var rotated, reused bool
+	if _, err := h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
+		rotated = rec.RotateRefreshToken(oldHash, storage.RefreshTokenRecord{
+			Hash:      secret.Hash(newRefresh),
+			JTI:       newClaims.ID,
+			FamilyID:  newClaims.FamilyID,
+			ExpiresAt: newClaims.ExpiresAt.Time,
+			CreatedAt: newClaims.IssuedAt.Time,
+		})
+		reused = !rotated && rec.RevokeFamily(claims.FamilyID) > 0
+		return rec
+	}); err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	if reused {
+		httpx.Error(w, http.StatusUnauthorized, "refresh token reuse detected")
+		return
+	}
+
+	if !rotated {
 		httpx.Error(w, http.StatusUnauthorized, "invalid refresh token")
 		return
 	}
@@ -77,6 +130,36 @@ func (h *SessionHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// rejectUnknownRefresh answers a validly signed refresh token that is no longer
+// stored. If other tokens from its family still are, it has already been
+// rotated and is being replayed, so the whole family is revoked.
+func (h *SessionHandler) rejectUnknownRefresh(w http.ResponseWriter, r *http.Request, claims *session.Claims) {
+	ctx := r.Context()
+
+	tokens, err := h.s.ListRefreshTokens(ctx, claims.UserID)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	if claims.FamilyID == "" || !slices.ContainsFunc(tokens, func(rt storage.RefreshTokenRecord) bool {
+		return rt.FamilyID == claims.FamilyID
+	}) {
+		httpx.Error(w, http.StatusUnauthorized, "invalid refresh token")
+		return
+	}
+
+	if _, err := h.s.Update(ctx, claims.UserID, func(rec storage.Record) storage.Record {
+		rec.RevokeFamily(claims.FamilyID)
+		return rec
+	}); err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	httpx.Error(w, http.StatusUnauthorized, "refresh token reuse detected")
+}
+
 type revokeReq struct {
 	RefreshToken string `json:"refresh_token"`
 }
@@ -106,18 +189,7 @@ func (h *SessionHandler) RevokeSingle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
-		out := rec.RefreshTokens[:0]
-		for _, rt := range rec.RefreshTokens {
-			if rt.JTI == claims.ID {
-				continue
-			}
-			out = append(out, rt)
-		}
-		rec.RefreshTokens = out
-		return rec
-	})
-	if err != nil {
+	if _, err := h.s.RevokeRefreshTokenByJTI(ctx, uid, claims.ID); err != nil {
 		httpx.InternalServerError(w)
 		return
 	}
@@ -133,7 +205,21 @@ func (h *SessionHandler) RevokeAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
+	// Update would create a record for an unknown user; there is nothing to
+	// revoke for one anyway.
+	exists, err := h.s.UserExists(ctx, uid)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+	if !exists {
+		httpx.NoContent(w)
+		return
+	}
+
+	// The app's own sessions end first, so that signing out everywhere holds
+	// even when a provider cannot be reached.
+	rec, err := h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
 		rec.RefreshTokens = nil
 		return rec
 	})
@@ -142,5 +228,33 @@ func (h *SessionHandler) RevokeAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Provider tokens are revoked as well as possible. One that fails stays
+	// stored, to be revoked again when the account is deleted.
+	var revoked []string
+	if h.revoke != nil {
+		for _, name := range slices.Sorted(maps.Keys(rec.RefreshTokensByProvider)) {
+			if _, ok := h.revoke.Get(name); !ok {
+				continue
+			}
+			if err := revokeProviderToken(ctx, h.revoke, h.scm, rec, name); err != nil {
+				log.Printf("revoke all: revoking %s token of %s: %v", name, uid, err)
+				continue
+			}
+			revoked = append(revoked, name)
+		}
+	}
+
+	if len(revoked) > 0 {
+		if _, err := h.s.Update(ctx, uid, func(rec storage.Record) storage.Record {
+			for _, name := range revoked {
+				rec.RemoveProviderToken(name)
+			}
+			return rec
+		}); err != nil {
+			httpx.InternalServerError(w)
+			return
+		}
+	}
+
 	httpx.NoContent(w)
 }
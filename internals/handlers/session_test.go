@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/google"
+	"github.com/jmirfield/auth-service/internals/google/googletest"
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/secret"
+	"github.com/jmirfield/auth-service/internals/session"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+type sessionEnv struct {
+	store storage.Store
+	sm    *session.Manager
+	scm   *secret.Manager
+	reg   *provider.Registry
+	h     *SessionHandler
+}
+
+func newSessionEnv(t *testing.T) *sessionEnv {
+	t.Helper()
+
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+	store := storage.NewMemoryStore()
+	reg := provider.NewRegistry()
+
+	return &sessionEnv{store: store, sm: sm, scm: scm, reg: reg, h: NewSessionHandler(sm, store, reg, scm)}
+}
+
+// start signs uid in and returns the session pair.
+func (e *sessionEnv) start(t *testing.T, uid string) *authResponse {
+	t.Helper()
+	out, err := startSession(context.Background(), e.store, e.sm, uid, nil, nil)
+	if err != nil {
+		t.Fatalf("startSession: %v", err)
+	}
+	return out
+}
+
+func (e *sessionEnv) refresh(refreshToken string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(refreshReq{RefreshToken: refreshToken})
+	rec := httptest.NewRecorder()
+	e.h.Refresh(rec, httptest.NewRequest(http.MethodPost, "/auth/refresh", bytes.NewReader(body)))
+	return rec
+}
+
+// authed serves handler to a request made with access.
+func (e *sessionEnv) authed(handler http.HandlerFunc, path, access string, in any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(in)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+access)
+	rec := httptest.NewRecorder()
+	httpx.NewAuth(e.sm).Middleware(handler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRevokeAll_ProviderUnavailable(t *testing.T) {
+	fake := googletest.NewServer()
+	env := newSessionEnv(t)
+	gm, _ := google.NewManager(fake.Config())
+	env.reg.Register(storage.ProviderGoogle, google.NewProvider(gm))
+
+	const uid = "usr_1"
+	enc, err := env.scm.Encrypt("google-refresh")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if err := env.store.Put(context.Background(), uid, storage.Record{
+		UserID:                  uid,
+		RefreshTokensByProvider: map[string]string{storage.ProviderGoogle: enc},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	first := env.start(t, uid)
+	second := env.start(t, uid)
+
+	// Google is down: the app's sessions end all the same, and Google's token
+	// is kept to be revoked later.
+	fake.Close()
+	if rec := env.authed(env.h.RevokeAll, "/auth/revoke/all", first.AccessToken, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke all: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	tokens, err := env.store.ListRefreshTokens(context.Background(), uid)
+	if err != nil || len(tokens) != 0 {
+		t.Fatalf("refresh tokens after revoke all: %+v, %v", tokens, err)
+	}
+	for _, out := range []*authResponse{first, second} {
+		if rec := env.refresh(out.RefreshToken); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("refresh after revoke all: expected 401, got %d", rec.Code)
+		}
+	}
+	if rec, _ := env.store.Get(context.Background(), uid); rec.RefreshTokensByProvider[storage.ProviderGoogle] != enc {
+		t.Fatalf("google token dropped although it was not revoked")
+	}
+}
+
+func TestRefresh_Rotates(t *testing.T) {
+	env := newSessionEnv(t)
+	const uid = "usr_1"
+	first := env.start(t, uid)
+
+	rec := env.refresh(first.RefreshToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d, body %s", rec.Code, rec.Body)
+	}
+	var out refreshRes
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil || out.RefreshToken == "" || out.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh response: %+v, %v", out, err)
+	}
+	if claims, err := env.sm.ParseAccess(out.AccessToken); err != nil || claims.Subject != uid {
+		t.Fatalf("access token: %+v, %v", claims, err)
+	}
+
+	// The successor replaces the presented token in storage.
+	tokens, _ := env.store.ListRefreshTokens(context.Background(), uid)
+	if len(tokens) != 1 || tokens[0].Hash != secret.Hash(out.RefreshToken) {
+		t.Fatalf("stored tokens after rotation: %+v", tokens)
+	}
+
+	// Replaying the rotated token revokes the whole family, successor too.
+	if rec := env.refresh(first.RefreshToken); rec.Code != http.StatusUnauthorized || !bytes.Contains(rec.Body.Bytes(), []byte("refresh token reuse detected")) {
+		t.Fatalf("replay: status %d, body %s; want 401 reuse detected", rec.Code, rec.Body)
+	}
+	if rec := env.refresh(out.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("successor after replay: expected 401, got %d", rec.Code)
+	}
+	if tokens, _ := env.store.ListRefreshTokens(context.Background(), uid); len(tokens) != 0 {
+		t.Fatalf("family not revoked: %+v", tokens)
+	}
+}
+
+func TestRefresh_Concurrent(t *testing.T) {
+	env := newSessionEnv(t)
+	first := env.start(t, "usr_1")
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes []int
+	)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := env.refresh(first.RefreshToken)
+			mu.Lock()
+			codes = append(codes, rec.Code)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	wins := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			wins++
+		case http.StatusUnauthorized:
+		default:
+			t.Fatalf("concurrent refresh: unexpected status %d", code)
+		}
+	}
+	if wins != 1 {
+		t.Fatalf("concurrent refreshes with one token: %d succeeded, want 1", wins)
+	}
+}
+
+func TestRefresh_UnknownToken(t *testing.T) {
+	env := newSessionEnv(t)
+	const uid = "usr_1"
+	phone := env.start(t, uid)
+	laptop := env.start(t, uid)
+
+	// A signed token that was never stored has no family left to revoke.
+	stray, err := env.sm.IssueRefresh(uid)
+	if err != nil {
+		t.Fatalf("IssueRefresh: %v", err)
+	}
+	if rec := env.refresh(stray); rec.Code != http.StatusUnauthorized || !bytes.Contains(rec.Body.Bytes(), []byte("invalid refresh token")) {
+		t.Fatalf("unknown token: status %d, body %s; want 401 invalid refresh token", rec.Code, rec.Body)
+	}
+	if tokens, _ := env.store.ListRefreshTokens(context.Background(), uid); len(tokens) != 2 {
+		t.Fatalf("unknown token revoked other sessions: %+v", tokens)
+	}
+
+	// A rotated token is unknown too, but its family lives on: it is revoked.
+	rec := env.refresh(phone.RefreshToken)
+	var out refreshRes
+	if err := json.NewDecoder(rec.Body).Decode(&out); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("refresh: status %d, %v", rec.Code, err)
+	}
+	if rec := env.refresh(phone.RefreshToken); rec.Code != http.StatusUnauthorized || !bytes.Contains(rec.Body.Bytes(), []byte("refresh token reuse detected")) {
+		t.Fatalf("rotated token: status %d, body %s; want 401 reuse detected", rec.Code, rec.Body)
+	}
+	if rec := env.refresh(out.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("family member after reuse: expected 401, got %d", rec.Code)
+	}
+
+	// Other families are left alone.
+	if rec := env.refresh(laptop.RefreshToken); rec.Code != http.StatusOK {
+		t.Fatalf("other session: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRevokeSingle(t *testing.T) {
+	env := newSessionEnv(t)
+	const uid = "usr_1"
+	phone := env.start(t, uid)
+	laptop := env.start(t, uid)
+
+	if rec := env.authed(env.h.RevokeSingle, "/auth/revoke", laptop.AccessToken, revokeReq{RefreshToken: phone.RefreshToken}); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := env.refresh(phone.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked session: expected 401, got %d", rec.Code)
+	}
+	if rec := env.refresh(laptop.RefreshToken); rec.Code != http.StatusOK {
+		t.Fatalf("sibling session: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	// Another user's token is left alone.
+	other := env.start(t, "usr_2")
+	if rec := env.authed(env.h.RevokeSingle, "/auth/revoke", phone.AccessToken, revokeReq{RefreshToken: other.RefreshToken}); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke other user's token: status %d", rec.Code)
+	}
+	if rec := env.refresh(other.RefreshToken); rec.Code != http.StatusOK {
+		t.Fatalf("other user's session: status %d, body %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"time"
+
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/identity"
+	"github.com/jmirfield/auth-service/internals/nonce"
+	"github.com/jmirfield/auth-service/internals/oauthstate"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/secret"
+	"github.com/jmirfield/auth-service/internals/session"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// SignInHandler signs users in with any registered identity provider, and
+// runs the browser flow for those that are a provider.Authorizer. Signed in
+// users link and unlink further providers through it as well.
+type SignInHandler struct {
+	s      storage.Store
+	sm     *session.Manager
+	reg    *provider.Registry
+	scm    *secret.Manager
+	ids    *identity.Manager
+	nonces *nonce.Store
+	states *oauthstate.Store
+}
+
+func NewSignInHandler(store storage.Store, mgr *session.Manager, reg *provider.Registry, scm *secret.Manager, ids *identity.Manager) *SignInHandler {
+	return &SignInHandler{s: store, sm: mgr, reg: reg, scm: scm, ids: ids, nonces: nonce.NewStore(store, 0), states: oauthstate.NewStore(store, 0)}
+}
+
+// signInReq carries either a code to redeem or an ID token the client got
+// from the provider itself.
+type signInReq struct {
+	Code    string `json:"code,omitempty"`
+	IDToken string `json:"id_token,omitempty"`
+	// ClientID is the configured client the code was issued to, e.g. the
+	// app's bundle id. It defaults to the provider's first client.
+	ClientID string `json:"client_id,omitempty"`
+	// RedirectURI and CodeVerifier are sent by native apps that ran the
+	// provider's authorization code flow with PKCE themselves.
+	RedirectURI  string `json:"redirect_uri,omitempty"`
+	CodeVerifier string `json:"code_verifier,omitempty"`
+	// Nonce is one from GET /auth/nonce that the client passed to the
+	// provider, for Apple as is or as its SHA-256.
+	Nonce string `json:"nonce,omitempty"`
+	// User is provider specific, e.g. the user object Apple hands the
+	// client on the first sign in.
+	User json.RawMessage `json:"user,omitempty"`
+}
+
+// Auth serves POST /auth/{provider}.
+func (h *SignInHandler) Auth(w http.ResponseWriter, r *http.Request) {
+	name, p, in, ok := h.readSignIn(w, r)
+	if !ok {
+		return
+	}
+
+	code := provider.Code{Code: in.Code, ClientID: in.ClientID, RedirectURI: in.RedirectURI, CodeVerifier: in.CodeVerifier}
+	h.signIn(w, r, name, p, code, in.IDToken, in.Nonce, in.User)
+}
+
+// readSignIn reads a signInReq for the provider named in the path and uses
+// up its nonce. It answers the request itself if either fails.
+func (h *SignInHandler) readSignIn(w http.ResponseWriter, r *http.Request) (string, provider.Provider, signInReq, bool) {
+	var in signInReq
+
+	name := r.PathValue("provider")
+	p, ok := h.reg.Get(name)
+	if !ok {
+		httpx.Error(w, http.StatusNotFound, "unknown provider")
+		return "", nil, in, false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || (in.Code == "" && in.IDToken == "") {
+		httpx.ErrorCode(w, http.StatusBadRequest, "missing_code", "missing code or id_token")
+		return "", nil, in, false
+	}
+	if in.Code != "" && in.IDToken != "" {
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_request", "send either code or id_token")
+		return "", nil, in, false
+	}
+
+	if nr, ok := p.(provider.NonceRequirer); ok && nr.RequireNonce() && in.Nonce == "" {
+		httpx.ErrorCode(w, http.StatusBadRequest, "missing_nonce", "missing nonce")
+		return "", nil, in, false
+	}
+
+	if !useNonce(w, r, h.nonces, in.Nonce) {
+		return "", nil, in, false
+	}
+
+	return name, p, in, true
+}
+
+// stateCookie ties a browser sign in to the browser that started it, so a
+// callback carrying someone else's state is refused. Its path is the
+// provider's, so sign ins with different providers do not clash.
+const stateCookie = "oauth_state"
+
+// authorizer returns the named provider if it has a browser flow.
+func (h *SignInHandler) authorizer(name string) (provider.Provider, provider.Authorizer, bool) {
+	p, ok := h.reg.Get(name)
+	if !ok {
+		return nil, nil, false
+	}
+	a, ok := p.(provider.Authorizer)
+	return p, a, ok
+}
+
+// Start serves GET /auth/{provider}/start: it remembers a fresh state, nonce
+// and PKCE verifier and redirects the browser to the provider.
+func (h *SignInHandler) Start(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("provider")
+	_, a, ok := h.authorizer(name)
+	if !ok {
+		httpx.Error(w, http.StatusNotFound, "unknown provider")
+		return
+	}
+
+	state, st, err := h.states.Begin(r.Context(), name)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	authorizeURL, err := a.AuthorizeURL(r.Context(), state, st.Nonce, st.CodeChallenge())
+	if err != nil {
+		providerError(w, r, name, err)
+		return
+	}
+
+	// The provider redirects back with a top-level GET, which SameSite=Lax
+	// cookies are sent with.
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/auth/" + name,
+		MaxAge:   int(oauthstate.DefaultTTL / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authorizeURL, http.StatusFound)
+}
+
+// Callback serves GET /auth/{provider}/callback, where the provider sends the
+// browser back with the code, and answers like POST /auth/{provider}.
+func (h *SignInHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("provider")
+	p, _, ok := h.authorizer(name)
+	if !ok {
+		httpx.Error(w, http.StatusNotFound, "unknown provider")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Path:     "/auth/" + name,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := r.URL.Query()
+	state := q.Get("state")
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_state", "invalid state")
+		return
+	}
+
+	st, err := h.states.Take(r.Context(), state)
+	if errors.Is(err, oauthstate.ErrUnknownState) || (err == nil && st.Provider != name) {
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_state", "invalid state")
+		return
+	}
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	// e.g. access_denied
+	if e := q.Get("error"); e != "" {
+		httpx.ErrorCode(w, http.StatusBadRequest, e, "sign in with "+name+" failed")
+		return
+	}
+
+	code := q.Get("code")
+	if code == "" {
+		httpx.ErrorCode(w, http.StatusBadRequest, "missing_code", "missing code")
+		return
+	}
+
+	h.signIn(w, r, name, p, provider.Code{Code: code, CodeVerifier: st.CodeVerifier}, "", st.Nonce, nil)
+}
+
+// signIn issues a session pair for the user the provider says signed in and
+// stores the provider's refresh token.
+func (h *SignInHandler) signIn(w http.ResponseWriter, r *http.Request, name string, p provider.Provider, code provider.Code, idToken, nonce string, user json.RawMessage) {
+	ctx := r.Context()
+
+	v, ok := h.verify(w, r, name, p, code, idToken, nonce, user)
+	if !ok {
+		return
+	}
+
+	uid, err := h.ids.Resolve(ctx, name, v.subject, v.attrs)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	update, err := h.storeProviderToken(name, v.tok)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	out, err := startSession(ctx, h.s, h.sm, uid, v.attrs, update)
+	if err != nil {
+		httpx.InternalServerError(w)
+		return
+	}
+
+	httpx.Json(w, http.StatusOK, out)
+}
+
+// verified is who a provider says signed in with it.
+type verified struct {
+	subject string
+	attrs   map[string]string
+	tok     *provider.Tokens
+}
+
+// verify redeems code, unless the client sent an ID token instead, and finds
+// out who signed in. It answers the request itself if that fails.
+func (h *SignInHandler) verify(w http.ResponseWriter, r *http.Request, name string, p provider.Provider, code provider.Code, idToken, nonce string, user json.RawMessage) (*verified, bool) {
+	ctx := r.Context()
+
+	tok := &provider.Tokens{IDToken: idToken}
+	if code.Code != "" {
+		var err error
+		if tok, err = p.ExchangeCode(ctx, code); err != nil {
+			providerError(w, r, name, err)
+			return nil, false
+		}
+	}
+
+	id, err := h.identify(ctx, p, tok, nonce)
+	if errors.Is(err, errInvalidIDToken) {
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_id_token", "invalid id token")
+		return nil, false
+	}
+	if err != nil {
+		providerError(w, r, name, err)
+		return nil, false
+	}
+
+	userAttrs, err := p.UserInfo(user)
+	if err != nil {
+		httpx.Error(w, http.StatusBadRequest, "invalid user")
+		return nil, false
+	}
+	attrs := maps.Clone(id.Attrs)
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	maps.Copy(attrs, userAttrs)
+
+	return &verified{subject: id.Subject, attrs: attrs, tok: tok}, true
+}
+
+// storeProviderToken returns an update that stores the provider's refresh
+// token, encrypted, in the user's record, or nil if it issued none. The token
+// was just issued, so it counts as validated now.
+func (h *SignInHandler) storeProviderToken(name string, tok *provider.Tokens) (func(*storage.Record), error) {
+	if tok.RefreshToken == "" {
+		return nil, nil
+	}
+
+	enctok, err := h.scm.Encrypt(tok.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return func(rec *storage.Record) {
+		rec.RefreshTokensByProvider[name] = enctok
+		rec.ProviderValidatedAt[name] = now
+		if tok.ClientID != "" {
+			rec.ProviderClientIDs[name] = tok.ClientID
+		}
+	}, nil
+}
+
+var errInvalidIDToken = errors.New("invalid id token")
+
+// identify finds out who signed in: from the ID token or, for providers that
+// issue none, from their user info API.
+func (h *SignInHandler) identify(ctx context.Context, p provider.Provider, tok *provider.Tokens, nonce string) (*provider.Identity, error) {
+	if f, ok := p.(provider.UserInfoFetcher); ok && tok.IDToken == "" && tok.AccessToken != "" {
+		return f.FetchUserInfo(ctx, tok.AccessToken)
+	}
+
+	id, err := p.VerifyIDToken(ctx, tok.IDToken, nonce)
+	if err != nil && !errors.Is(err, provider.ErrUnavailable) {
+		return nil, fmt.Errorf("%w: %w", errInvalidIDToken, err)
+	}
+	return id, err
+}
+
+// providerError answers a failed call to a provider with a status that says
+// whose problem it is: the client's code, our credentials, or the provider.
+func providerError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		// The client went away; nobody is left to read an answer.
+	case errors.Is(err, provider.ErrUnknownClient):
+		httpx.ErrorCode(w, http.StatusBadRequest, "unknown_client", "unknown client id")
+	case errors.Is(err, provider.ErrInvalidGrant):
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_grant", "code is invalid, expired or already used")
+	case errors.Is(err, provider.ErrInvalidRequest):
+		httpx.ErrorCode(w, http.StatusBadRequest, "invalid_request", name+" rejected the request")
+	case errors.Is(err, provider.ErrClientRejected):
+		httpx.ErrorCode(w, http.StatusBadGateway, name+"_client_rejected", name+" rejected this service's credentials")
+	case errors.Is(err, provider.ErrUnavailable):
+		httpx.ErrorCode(w, http.StatusServiceUnavailable, name+"_unavailable", name+" is unavailable, try again later")
+	default:
+		httpx.ErrorCode(w, http.StatusBadGateway, name+"_error", "unexpected response from "+name)
+	}
+}
+
+// revokeProviderToken revokes rec's refresh token for the named provider, if
+// it has one and the provider is registered. A token the provider no longer
+// accepts is as good as revoked.
+func revokeProviderToken(ctx context.Context, reg *provider.Registry, scm *secret.Manager, rec storage.Record, name string) error {
+	enc := rec.RefreshTokensByProvider[name]
+	p, ok := reg.Get(name)
+	if enc == "" || !ok {
+		return nil
+	}
+
+	tok, err := scm.Decrypt(enc)
+	if err != nil {
+		return err
+	}
+
+	err = p.Revoke(ctx, tok, rec.ProviderClientIDs[name])
+	if errors.Is(err, provider.ErrInvalidGrant) {
+		return nil
+	}
+	return err
+}
+
+type authResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// startSession issues a session pair for a user who signed in with an
+// identity provider. attrs are merged into the user's record, and update, if
+// set, records the provider's token, in the same write that stores the new
+// refresh token.
+func startSession(ctx context.Context, s storage.Store, sm *session.Manager, userID string, attrs map[string]string, update func(*storage.Record)) (*authResponse, error) {
+	var accessAttrs map[string]string
+	if sm.HasAccessAttrs() {
+		// Some attributes, like Apple's name, only come with the first
+		// sign in, so start from what is stored.
+		rec, err := s.Get(ctx, userID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		stored := maps.Clone(rec.Attrs)
+		if stored == nil {
+			stored = map[string]string{}
+		}
+		maps.Copy(stored, attrs)
+		accessAttrs = sm.AccessAttrs(stored)
+	}
+
+	access, refresh, err := sm.IssuePair(userID, accessAttrs)
+	if err != nil {
+		return nil, err
+	}
+
+	rClaims, err := sm.ParseRefresh(refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.Update(ctx, userID, func(rec storage.Record) storage.Record {
+		rec.UserID = userID
+		maps.Copy(rec.Attrs, attrs)
+		if update != nil {
+			update(&rec)
+		}
+		rec.RefreshTokens = append(rec.RefreshTokens, storage.RefreshTokenRecord{
+			Hash:      secret.Hash(refresh),
+			JTI:       rClaims.ID,
+			FamilyID:  rClaims.FamilyID,
+			ExpiresAt: rClaims.ExpiresAt.Time,
+			CreatedAt: rClaims.IssuedAt.Time,
+		})
+
+		return rec
+	}); err != nil {
+		return nil, err
+	}
+
+	return &authResponse{AccessToken: access, RefreshToken: refresh}, nil
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/google"
+	"github.com/jmirfield/auth-service/internals/google/googletest"
+	httpx "github.com/jmirfield/auth-service/internals/http"
+	"github.com/jmirfield/auth-service/internals/identity"
+	"github.com/jmirfield/auth-service/internals/oauth2"
+	"github.com/jmirfield/auth-service/internals/oauth2/oauth2test"
+	"github.com/jmirfield/auth-service/internals/oidc"
+	"github.com/jmirfield/auth-service/internals/oidc/oidctest"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/secret"
+	"github.com/jmirfield/auth-service/internals/session"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+func TestSignIn_Google(t *testing.T) {
+	fake := googletest.NewServer()
+	defer fake.Close()
+
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+	gm, _ := google.NewManager(fake.Config())
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		Issuer:          "issuer.test",
+		Audience:        "aud.test",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+	store := storage.NewMemoryStore()
+	reg := provider.NewRegistry()
+	reg.Register(storage.ProviderGoogle, google.NewProvider(gm))
+	h := NewSignInHandler(store, sm, reg, scm, identity.NewManager(&identity.Config{}, store))
+
+	signIn := func(name string, in signInReq) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(in)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/auth/"+name, bytes.NewReader(body))
+		req.SetPathValue("provider", name)
+		h.Auth(rec, req)
+		return rec
+	}
+	nonce := func() string {
+		n, err := h.nonces.Issue(context.Background())
+		if err != nil {
+			t.Fatalf("issue nonce: %v", err)
+		}
+		return n
+	}
+
+	if rec := signIn(storage.ProviderApple, signInReq{IDToken: "x"}); rec.Code != http.StatusNotFound {
+		t.Fatalf("unregistered provider: expected 404, got %d", rec.Code)
+	}
+
+	// A client that signed in with Google on its own sends the ID token.
+	n := nonce()
+	id := googletest.Identity{Subject: "1089", Email: "jane@example.com", EmailVerified: true, GivenName: "Jane", Nonce: n}
+	rec := signIn(storage.ProviderGoogle, signInReq{IDToken: fake.IDToken(id), Nonce: n})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+	var out authResponse
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	uid := userOf(t, store, storage.ProviderGoogle, "1089")
+	claims, err := sm.ParseAccess(out.AccessToken)
+	if err != nil || claims.Subject != uid {
+		t.Fatalf("access token: %+v, %v", claims, err)
+	}
+
+	stored, err := store.Get(context.Background(), uid)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if stored.Attrs[storage.AttrEmail] != "jane@example.com" || stored.Attrs[storage.AttrGivenName] != "Jane" {
+		t.Fatalf("unexpected attrs %v", stored.Attrs)
+	}
+
+	// The nonce was used up, so the same token cannot be replayed.
+	if rec := signIn(storage.ProviderGoogle, signInReq{IDToken: fake.IDToken(id), Nonce: n}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("replay: expected 400, got %d", rec.Code)
+	}
+
+	// A server auth code is redeemed, and Google's refresh token kept.
+	code := fake.IssueCode(googletest.Identity{Subject: "1089"})
+	if rec := signIn(storage.ProviderGoogle, signInReq{Code: code}); rec.Code != http.StatusOK {
+		t.Fatalf("code sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+	stored, _ = store.Get(context.Background(), uid)
+	googleToken, err := scm.Decrypt(stored.RefreshTokensByProvider[storage.ProviderGoogle])
+	if err != nil || googleToken == "" {
+		t.Fatalf("google refresh token: %q, %v", googleToken, err)
+	}
+	if len(stored.RefreshTokens) != 2 {
+		t.Fatalf("expected both sign ins on one user, got %d refresh tokens", len(stored.RefreshTokens))
+	}
+
+	if rec := signIn(storage.ProviderGoogle, signInReq{Code: code}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reused code: expected 400, got %d", rec.Code)
+	}
+	if rec := signIn(storage.ProviderGoogle, signInReq{IDToken: "not-a-token"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad token: expected 400, got %d", rec.Code)
+	}
+	if rec := signIn(storage.ProviderGoogle, signInReq{Code: "c", IDToken: "t"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("code and id_token: expected 400, got %d", rec.Code)
+	}
+
+	// Deleting the account revokes the Google token too.
+	access, _, err := sm.IssuePair(uid, nil)
+	if err != nil {
+		t.Fatalf("IssuePair: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/auth/account", nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	rec = httptest.NewRecorder()
+	httpx.NewAuth(sm).Middleware(http.HandlerFunc(NewAccountHandler(store, reg, scm).Delete)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d, body %s", rec.Code, rec.Body)
+	}
+	if !fake.Revoked(googleToken) {
+		t.Fatalf("google token not revoked")
+	}
+}
+
+func TestSignIn_OIDCBrowserFlow(t *testing.T) {
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+
+	// Two OIDC providers at once, e.g. two customers' identity providers.
+	fakes := map[string]*oidctest.Server{}
+	reg := provider.NewRegistry()
+	for _, name := range []string{"okta", "keycloak"} {
+		fake := oidctest.NewServer()
+		defer fake.Close()
+		fakes[name] = fake
+
+		cfg := fake.Config()
+		cfg.Name = name
+		cfg.RedirectURI = "https://auth.example.com/auth/" + name + "/callback"
+		p, err := oidc.NewProvider(cfg)
+		if err != nil {
+			t.Fatalf("oidc provider: %v", err)
+		}
+		reg.Register(name, p)
+	}
+
+	store := storage.NewMemoryStore()
+	h := NewSignInHandler(store, sm, reg, scm, identity.NewManager(&identity.Config{}, store))
+
+	start := func(name string) (string, *http.Cookie) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/auth/"+name+"/start", nil)
+		req.SetPathValue("provider", name)
+		h.Start(rec, req)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("start: status %d, body %s", rec.Code, rec.Body)
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Path != "/auth/"+name {
+			t.Fatalf("start: unexpected cookies %v", cookies)
+		}
+		return rec.Header().Get("Location"), cookies[0]
+	}
+	callback := func(name string, q url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/auth/"+name+"/callback?"+q.Encode(), nil)
+		req.SetPathValue("provider", name)
+		req.AddCookie(cookie)
+		h.Callback(rec, req)
+		return rec
+	}
+
+	authorizeURL, cookie := start("okta")
+	q, err := fakes["okta"].Authorize(authorizeURL, oidctest.Identity{Subject: "00u1", Email: "jane@corp.example", EmailVerified: true})
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	// The state is only good for the provider it was started with.
+	if rec := callback("keycloak", q, cookie); rec.Code != http.StatusBadRequest {
+		t.Fatalf("other provider's callback: expected 400, got %d", rec.Code)
+	}
+
+	authorizeURL, cookie = start("okta")
+	if q, err = fakes["okta"].Authorize(authorizeURL, oidctest.Identity{Subject: "00u1", Email: "jane@corp.example", EmailVerified: true}); err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	rec := callback("okta", q, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	got, err := store.Get(context.Background(), userOf(t, store, "okta", "00u1"))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Attrs[storage.AttrEmail] != "jane@corp.example" || got.RefreshTokensByProvider["okta"] == "" {
+		t.Fatalf("unexpected record %+v", got)
+	}
+
+	if rec := callback("okta", q, cookie); rec.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback: expected 400, got %d", rec.Code)
+	}
+
+	// Providers without a browser flow have no start page.
+	reg.Register(storage.ProviderGoogle, google.NewProvider(nil))
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/auth/google/start", nil)
+	req.SetPathValue("provider", storage.ProviderGoogle)
+	h.Start(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("google start: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestSignIn_GitHub(t *testing.T) {
+	fake := oauth2test.NewServer()
+	defer fake.Close()
+
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+	p, err := oauth2.NewProvider(fake.Config())
+	if err != nil {
+		t.Fatalf("oauth2 provider: %v", err)
+	}
+	reg := provider.NewRegistry()
+	reg.Register("github", p)
+	store := storage.NewMemoryStore()
+	h := NewSignInHandler(store, sm, reg, scm, identity.NewManager(&identity.Config{}, store))
+
+	signIn := func(in signInReq) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(in)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/auth/github", bytes.NewReader(body))
+		req.SetPathValue("provider", "github")
+		h.Auth(rec, req)
+		return rec
+	}
+
+	id := oauth2test.Identity{ID: 583231, Login: "octocat", Emails: []oauth2test.Email{{Email: "octocat@github.com", Primary: true, Verified: true}}}
+	rec := signIn(signInReq{Code: fake.IssueCode(id)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sign in: status %d, body %s", rec.Code, rec.Body)
+	}
+	var out authResponse
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if claims, err := sm.ParseAccess(out.AccessToken); err != nil || claims.Subject != userOf(t, store, "github", "583231") {
+		t.Fatalf("access token: %+v, %v", claims, err)
+	}
+
+	got, err := store.Get(context.Background(), userOf(t, store, "github", "583231"))
+	if err != nil || got.Attrs[storage.AttrEmail] != "octocat@github.com" || got.Attrs["login"] != "octocat" {
+		t.Fatalf("unexpected record %+v, %v", got, err)
+	}
+
+	if rec := signIn(signInReq{IDToken: "x"}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_id_token") {
+		t.Fatalf("id token: status %d, body %s; want 400 invalid_id_token", rec.Code, rec.Body)
+	}
+	if rec := signIn(signInReq{Code: "bogus"}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_grant") {
+		t.Fatalf("bad code: status %d, body %s; want 400 invalid_grant", rec.Code, rec.Body)
+	}
+}
+
+// userOf returns the id of the user provider's subject signs in as.
+func userOf(t *testing.T, s storage.Store, provider, subject string) string {
+	t.Helper()
+	id, err := s.GetIdentity(context.Background(), provider, subject)
+	if err != nil {
+		t.Fatalf("GetIdentity(%s, %s): %v", provider, subject, err)
+	}
+	return id.UserID
+}
+
+func TestLink(t *testing.T) {
+	fakeGoogle := googletest.NewServer()
+	defer fakeGoogle.Close()
+	fakeGitHub := oauth2test.NewServer()
+	defer fakeGitHub.Close()
+
+	sm, err := session.NewManager(&session.Config{
+		Secret:          "test-secret-32-bytes-minimum-please",
+		AccessLifetime:  15 * time.Minute,
+		RefreshLifetime: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("session manager: %v", err)
+	}
+	scm, err := secret.NewManager(&secret.Config{Key: make([]byte, 32), Prefix: secret.DefaultPrefix})
+	if err != nil {
+		t.Fatalf("secret manager: %v", err)
+	}
+	gm, _ := google.NewManager(fakeGoogle.Config())
+	gh, err := oauth2.NewProvider(fakeGitHub.Config())
+	if err != nil {
+		t.Fatalf("oauth2 provider: %v", err)
+	}
+	reg := provider.NewRegistry()
+	reg.Register(storage.ProviderGoogle, google.NewProvider(gm))
+	reg.Register("github", gh)
+	store := storage.NewMemoryStore()
+	h := NewSignInHandler(store, sm, reg, scm, identity.NewManager(&identity.Config{}, store))
+	auth := httpx.NewAuth(sm)
+
+	signIn := func(name string, in signInReq) string {
+		body, _ := json.Marshal(in)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/auth/"+name, bytes.NewReader(body))
+		req.SetPathValue("provider", name)
+		h.Auth(rec, req)
+		var out authResponse
+		if err := json.NewDecoder(rec.Body).Decode(&out); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("sign in with %s: status %d, %v", name, rec.Code, err)
+		}
+		claims, err := sm.ParseAccess(out.AccessToken)
+		if err != nil {
+			t.Fatalf("access token: %v", err)
+		}
+		return claims.Subject
+	}
+	serve := func(handler http.HandlerFunc, method, uid, name string, in *signInReq) *httptest.ResponseRecorder {
+		access, _, err := sm.IssuePair(uid, nil)
+		if err != nil {
+			t.Fatalf("IssuePair: %v", err)
+		}
+		var body []byte
+		if in != nil {
+			body, _ = json.Marshal(in)
+		}
+		req := httptest.NewRequest(method, "/auth/link/"+name, bytes.NewReader(body))
+		req.SetPathValue("provider", name)
+		req.Header.Set("Authorization", "Bearer "+access)
+		rec := httptest.NewRecorder()
+		auth.Middleware(handler).ServeHTTP(rec, req)
+		return rec
+	}
+	link := func(uid, name string, in signInReq) *httptest.ResponseRecorder {
+		return serve(h.Link, http.MethodPost, uid, name, &in)
+	}
+	unlink := func(uid, name string) *httptest.ResponseRecorder {
+		return serve(h.Unlink, http.MethodDelete, uid, name, nil)
+	}
+
+	jane := signIn("github", signInReq{Code: fakeGitHub.IssueCode(oauth2test.Identity{ID: 1, Login: "jane"})})
+	john := signIn("github", signInReq{Code: fakeGitHub.IssueCode(oauth2test.Identity{ID: 2, Login: "john"})})
+
+	rec := link(jane, storage.ProviderGoogle, signInReq{Code: fakeGoogle.IssueCode(googletest.Identity{Subject: "1089"})})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("link: status %d, body %s", rec.Code, rec.Body)
+	}
+	var out identitiesResp
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil || len(out.Identities) != 2 {
+		t.Fatalf("identities: %+v, %v", out, err)
+	}
+	if uid := signIn(storage.ProviderGoogle, signInReq{Code: fakeGoogle.IssueCode(googletest.Identity{Subject: "1089"})}); uid != jane {
+		t.Fatalf("google sign in = %q; want the linked user %q", uid, jane)
+	}
+
+	if rec := link(john, storage.ProviderGoogle, signInReq{Code: fakeGoogle.IssueCode(googletest.Identity{Subject: "1089"})}); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "identity_taken") {
+		t.Fatalf("linking another user's account: status %d, body %s; want 409 identity_taken", rec.Code, rec.Body)
+	}
+	if rec := link(jane, storage.ProviderGoogle, signInReq{Code: fakeGoogle.IssueCode(googletest.Identity{Subject: "2077"})}); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "provider_linked") {
+		t.Fatalf("second google account: status %d, body %s; want 409 provider_linked", rec.Code, rec.Body)
+	}
+	if rec := link(jane, storage.ProviderGoogle, signInReq{IDToken: "not-a-token"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad token: expected 400, got %d", rec.Code)
+	}
+
+	// Unlinking Google revokes its token; the last identity stays.
+	stored, _ := store.Get(context.Background(), jane)
+	googleToken, err := scm.Decrypt(stored.RefreshTokensByProvider[storage.ProviderGoogle])
+	if err != nil || googleToken == "" {
+		t.Fatalf("google refresh token: %q, %v", googleToken, err)
+	}
+	if rec := unlink(jane, storage.ProviderGoogle); rec.Code != http.StatusNoContent {
+		t.Fatalf("unlink: status %d, body %s", rec.Code, rec.Body)
+	}
+	if !fakeGoogle.Revoked(googleToken) {
+		t.Fatalf("google token not revoked")
+	}
+	if stored, _ := store.Get(context.Background(), jane); stored.RefreshTokensByProvider[storage.ProviderGoogle] != "" {
+		t.Fatalf("google token kept after unlink")
+	}
+	if rec := unlink(jane, storage.ProviderGoogle); rec.Code != http.StatusNotFound {
+		t.Fatalf("unlink again: expected 404, got %d", rec.Code)
+	}
+	if rec := unlink(jane, "github"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "last_identity") {
+		t.Fatalf("unlinking the last identity: status %d, body %s; want 409 last_identity", rec.Code, rec.Body)
+	}
+
+	rec = serve(h.Identities, http.MethodGet, jane, "", nil)
+	if err := json.NewDecoder(rec.Body).Decode(&out); rec.Code != http.StatusOK || err != nil || len(out.Identities) != 1 || out.Identities[0].Provider != "github" {
+		t.Fatalf("identities after unlink: status %d, %+v, %v", rec.Code, out, err)
+	}
+}
@@ -15,6 +15,12 @@ func Error(w http.ResponseWriter, status int, msg string) {
 	Json(w, status, map[string]string{"error": msg})
 }
 
+// ErrorCode writes an error with a stable, machine-readable code alongside the
+// message.
+func ErrorCode(w http.ResponseWriter, status int, code, msg string) {
+	Json(w, status, map[string]string{"error": msg, "code": code})
+}
+
 func InternalServerError(w http.ResponseWriter) {
 	Error(w, http.StatusInternalServerError, "something went wrong")
 }
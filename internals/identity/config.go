@@ -0,0 +1,27 @@
+package identity
+
+import (
+	"os"
+	"strconv"
+)
+
+type Config struct {
+	// LinkVerifiedEmail signs a new identity in as the existing user whose
+	// identities include one with the same email, if both providers verified
+	// the address. Off, every new identity starts a new user; users link
+	// more providers themselves.
+	LinkVerifiedEmail bool
+}
+
+// Load reads the identity configuration from APP_LINK_VERIFIED_EMAIL.
+func Load() (*Config, error) {
+	cfg := &Config{}
+
+	if s := os.Getenv("APP_LINK_VERIFIED_EMAIL"); s != "" {
+		if b, err := strconv.ParseBool(s); err == nil {
+			cfg.LinkVerifiedEmail = b
+		}
+	}
+
+	return cfg, nil
+}
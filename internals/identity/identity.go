@@ -0,0 +1,344 @@
+// Package identity maps the accounts people sign in with at identity
+// providers to internal user ids, which key their records and sessions, so
+// that one user can sign in with several providers.
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// userIDPrefix starts every internal user id, which tells them apart from the
+// ids users were stored under before identities existed.
+const userIDPrefix = "usr_"
+
+var (
+	// ErrTaken means the identity is linked to another user.
+	ErrTaken = errors.New("identity is linked to another user")
+	// ErrProviderLinked means the user already has an identity at the
+	// provider; it has to be unlinked first.
+	ErrProviderLinked = errors.New("user already has an identity at this provider")
+	// ErrLastIdentity means unlinking would leave the user no way to sign in.
+	ErrLastIdentity = errors.New("cannot unlink the user's only identity")
+)
+
+type Manager struct {
+	cfg *Config
+	s   storage.Store
+}
+
+func NewManager(cfg *Config, s storage.Store) *Manager {
+	return &Manager{cfg: cfg, s: s}
+}
+
+// NewUserID returns a fresh internal user id.
+func NewUserID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return userIDPrefix + hex.EncodeToString(b[:]), nil
+}
+
+// LegacyUserID is the id a provider's user was stored under before
+// identities existed: Apple's bare subject, or the subject prefixed with the
+// provider's name.
+func LegacyUserID(provider, subject string) string {
+	if provider == storage.ProviderApple {
+		return subject
+	}
+	return provider + ":" + subject
+}
+
+// legacyIdentity is the inverse of LegacyUserID. It reports false for
+// internal user ids.
+func legacyIdentity(userID string) (provider, subject string, ok bool) {
+	if strings.HasPrefix(userID, userIDPrefix) && !strings.Contains(userID, ":") {
+		return "", "", false
+	}
+	if provider, subject, ok := strings.Cut(userID, ":"); ok {
+		return provider, subject, true
+	}
+	return storage.ProviderApple, userID, true
+}
+
+// Resolve returns the user that provider's subject signs in as. An identity
+// seen for the first time goes to the user stored for it before identities
+// existed, if any; with LinkVerifiedEmail to the one user holding an identity
+// with the same verified email; and otherwise to a new user. attrs are what
+// the provider asserted about the account; only an email it verified is ever
+// recorded or matched.
+func (m *Manager) Resolve(ctx context.Context, provider, subject string, attrs map[string]string) (string, error) {
+	email := verifiedEmail(attrs)
+
+	id, err := m.s.GetIdentity(ctx, provider, subject)
+	if err == nil {
+		if id.Email != email {
+			id.Email = email
+			if err := m.s.LinkIdentity(ctx, id); err != nil {
+				return "", err
+			}
+		}
+		return id.UserID, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+
+	userID, err := m.legacyUser(ctx, provider, subject)
+	if err != nil {
+		return "", err
+	}
+	if userID == "" && m.cfg.LinkVerifiedEmail {
+		if userID, err = m.userByEmail(ctx, provider, email); err != nil {
+			return "", err
+		}
+	}
+	if userID == "" {
+		if userID, err = NewUserID(); err != nil {
+			return "", err
+		}
+	}
+
+	return m.link(ctx, provider, subject, userID, email)
+}
+
+// Lookup returns the user that provider's subject signs in as, without
+// creating one, or storage.ErrNotFound.
+func (m *Manager) Lookup(ctx context.Context, provider, subject string) (string, error) {
+	id, err := m.s.GetIdentity(ctx, provider, subject)
+	if err == nil {
+		return id.UserID, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+
+	userID, err := m.legacyUser(ctx, provider, subject)
+	if err != nil {
+		return "", err
+	}
+	if userID == "" {
+		return "", storage.ErrNotFound
+	}
+
+	return m.link(ctx, provider, subject, userID, "")
+}
+
+// Link links provider's subject to the user, who has proven they hold it by
+// signing in with the provider. A user has at most one identity per provider.
+func (m *Manager) Link(ctx context.Context, userID, provider, subject string, attrs map[string]string) error {
+	if err := m.migrate(ctx, userID); err != nil {
+		return err
+	}
+
+	id, err := m.s.GetIdentity(ctx, provider, subject)
+	switch {
+	case err == nil && id.UserID != userID:
+		return ErrTaken
+	case err == nil:
+		id.Email = verifiedEmail(attrs)
+		return m.s.LinkIdentity(ctx, id)
+	case !errors.Is(err, storage.ErrNotFound):
+		return err
+	}
+
+	// The account may be a user of its own from before identities existed.
+	if other, err := m.legacyUser(ctx, provider, subject); err != nil {
+		return err
+	} else if other != "" && other != userID {
+		return ErrTaken
+	}
+
+	ids, err := m.s.ListIdentities(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(ids, func(id storage.Identity) bool { return id.Provider == provider }) {
+		return ErrProviderLinked
+	}
+
+	err = m.s.LinkIdentity(ctx, newIdentity(provider, subject, userID, verifiedEmail(attrs)))
+	if errors.Is(err, storage.ErrIdentityTaken) {
+		return ErrTaken
+	}
+	return err
+}
+
+// Unlink removes the user's identity at provider and returns it, or
+// storage.ErrNotFound if there is none. before, if set, runs once the identity
+// may go, e.g. to revoke the provider's grant; if it fails nothing is
+// unlinked.
+func (m *Manager) Unlink(ctx context.Context, userID, provider string, before func(storage.Identity) error) (storage.Identity, error) {
+	if err := m.migrate(ctx, userID); err != nil {
+		return storage.Identity{}, err
+	}
+
+	ids, err := m.s.ListIdentities(ctx, userID)
+	if err != nil {
+		return storage.Identity{}, err
+	}
+
+	i := slices.IndexFunc(ids, func(id storage.Identity) bool { return id.Provider == provider })
+	if i < 0 {
+		return storage.Identity{}, storage.ErrNotFound
+	}
+	if len(ids) == 1 {
+		return storage.Identity{}, ErrLastIdentity
+	}
+
+	if before != nil {
+		if err := before(ids[i]); err != nil {
+			return storage.Identity{}, err
+		}
+	}
+
+	ok, err := m.s.UnlinkIdentity(ctx, userID, provider, ids[i].Subject)
+	if err != nil {
+		return storage.Identity{}, err
+	}
+	if !ok {
+		return storage.Identity{}, storage.ErrNotFound
+	}
+	return ids[i], nil
+}
+
+// List returns the user's identities.
+func (m *Manager) List(ctx context.Context, userID string) ([]storage.Identity, error) {
+	if err := m.migrate(ctx, userID); err != nil {
+		return nil, err
+	}
+	return m.s.ListIdentities(ctx, userID)
+}
+
+// Migrate links the identity of every user stored before identities
+// existed, which otherwise happens as each of them next signs in, and
+// returns how many it linked. It is safe to run while serving and again.
+func (m *Manager) Migrate(ctx context.Context) (int, error) {
+	n := 0
+	err := m.s.ForEach(ctx, func(rec storage.Record) error {
+		provider, subject, ok := legacyIdentity(rec.UserID)
+		if !ok {
+			return nil
+		}
+
+		linked, err := m.migrateRecord(ctx, provider, subject, rec)
+		if linked {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
+
+// migrate links the identity a user stored before identities existed was
+// created for, unless that already happened.
+func (m *Manager) migrate(ctx context.Context, userID string) error {
+	provider, subject, ok := legacyIdentity(userID)
+	if !ok {
+		return nil
+	}
+
+	rec, err := m.s.Get(ctx, userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = m.migrateRecord(ctx, provider, subject, rec)
+	return err
+}
+
+func (m *Manager) migrateRecord(ctx context.Context, provider, subject string, rec storage.Record) (bool, error) {
+	userID, err := m.legacyUser(ctx, provider, subject)
+	if err != nil || userID != rec.UserID {
+		return false, err
+	}
+
+	err = m.s.LinkIdentity(ctx, newIdentity(provider, subject, userID, verifiedEmail(rec.Attrs)))
+	if errors.Is(err, storage.ErrIdentityTaken) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// legacyUser returns the id of the user stored for provider's subject before
+// identities existed, or "" if there is none. Once such a user has any
+// identity they have been migrated: if this one is not among them it was
+// unlinked, and no longer signs them in.
+func (m *Manager) legacyUser(ctx context.Context, provider, subject string) (string, error) {
+	userID := LegacyUserID(provider, subject)
+	if _, _, ok := legacyIdentity(userID); !ok {
+		return "", nil
+	}
+
+	exists, err := m.s.UserExists(ctx, userID)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	ids, err := m.s.ListIdentities(ctx, userID)
+	if err != nil || len(ids) > 0 {
+		return "", err
+	}
+	return userID, nil
+}
+
+// userByEmail returns the one user holding an identity recorded with email,
+// or "" if there is no such user, several, or the user already has an
+// identity at provider.
+func (m *Manager) userByEmail(ctx context.Context, provider, email string) (string, error) {
+	if email == "" {
+		return "", nil
+	}
+
+	ids, err := m.s.FindIdentitiesByEmail(ctx, email)
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+
+	userID := ids[0].UserID
+	for _, id := range ids {
+		if id.UserID != userID || id.Provider == provider {
+			return "", nil
+		}
+	}
+	return userID, nil
+}
+
+// link links a new identity to the user and returns who it ended up linked
+// to: someone else if a concurrent sign in got there first.
+func (m *Manager) link(ctx context.Context, provider, subject, userID, email string) (string, error) {
+	err := m.s.LinkIdentity(ctx, newIdentity(provider, subject, userID, email))
+	if errors.Is(err, storage.ErrIdentityTaken) {
+		id, err := m.s.GetIdentity(ctx, provider, subject)
+		return id.UserID, err
+	}
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func newIdentity(provider, subject, userID, email string) storage.Identity {
+	return storage.Identity{Provider: provider, Subject: subject, UserID: userID, Email: email, CreatedAt: time.Now().UTC()}
+}
+
+// verifiedEmail returns the email in attrs, normalized for matching, if the
+// provider verified it.
+func verifiedEmail(attrs map[string]string) string {
+	if ok, _ := strconv.ParseBool(attrs[storage.AttrEmailVerified]); !ok {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(attrs[storage.AttrEmail]))
+}
@@ -0,0 +1,183 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+func verified(email string) map[string]string {
+	return map[string]string{storage.AttrEmail: email, storage.AttrEmailVerified: "true"}
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager(&Config{}, storage.NewMemoryStore())
+
+	uid, err := m.Resolve(ctx, "google", "g1", nil)
+	if err != nil || !strings.HasPrefix(uid, userIDPrefix) {
+		t.Fatalf("Resolve = %q, %v; want a new internal id", uid, err)
+	}
+	if again, err := m.Resolve(ctx, "google", "g1", nil); err != nil || again != uid {
+		t.Fatalf("second Resolve = %q, %v; want %q", again, err, uid)
+	}
+	if other, err := m.Resolve(ctx, "github", "g1", nil); err != nil || other == uid {
+		t.Fatalf("same subject at another provider = %q, %v; want another user", other, err)
+	}
+	if _, err := m.Lookup(ctx, "google", "g2"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Lookup(unknown): expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestResolve_LegacyUsers(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStore()
+	m := NewManager(&Config{}, s)
+
+	for _, uid := range []string{"001234.abcd.0001", "google:g1"} {
+		if err := s.Put(ctx, uid, storage.Record{}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	if uid, err := m.Resolve(ctx, storage.ProviderApple, "001234.abcd.0001", nil); err != nil || uid != "001234.abcd.0001" {
+		t.Fatalf("Resolve(apple) = %q, %v; want the legacy user", uid, err)
+	}
+	if uid, err := m.Lookup(ctx, storage.ProviderGoogle, "g1"); err != nil || uid != "google:g1" {
+		t.Fatalf("Lookup(google) = %q, %v; want the legacy user", uid, err)
+	}
+	if ids, err := s.ListIdentities(ctx, "google:g1"); err != nil || len(ids) != 1 {
+		t.Fatalf("legacy identity not linked: %+v, %v", ids, err)
+	}
+
+	// Once the legacy user links another provider and unlinks Apple, Apple
+	// no longer signs them in.
+	if err := m.Link(ctx, "001234.abcd.0001", "github", "42", nil); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if _, err := m.Unlink(ctx, "001234.abcd.0001", storage.ProviderApple, nil); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+	if uid, err := m.Resolve(ctx, storage.ProviderApple, "001234.abcd.0001", nil); err != nil || uid == "001234.abcd.0001" {
+		t.Fatalf("Resolve(unlinked apple) = %q, %v; want a new user", uid, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemoryStore()
+	m := NewManager(&Config{}, s)
+
+	if err := s.Put(ctx, "001234.abcd.0001", storage.Record{Attrs: verified("Jane@Example.com")}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.Put(ctx, "google:g1", storage.Record{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := m.Resolve(ctx, "github", "42", nil); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	if n, err := m.Migrate(ctx); err != nil || n != 2 {
+		t.Fatalf("Migrate = %d, %v; want 2", n, err)
+	}
+	if n, err := m.Migrate(ctx); err != nil || n != 0 {
+		t.Fatalf("second Migrate = %d, %v; want 0", n, err)
+	}
+
+	id, err := s.GetIdentity(ctx, storage.ProviderApple, "001234.abcd.0001")
+	if err != nil || id.UserID != "001234.abcd.0001" || id.Email != "jane@example.com" {
+		t.Fatalf("migrated identity = %+v, %v", id, err)
+	}
+}
+
+func TestLinkAndUnlink(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager(&Config{}, storage.NewMemoryStore())
+
+	jane, _ := m.Resolve(ctx, storage.ProviderApple, "a1", nil)
+	john, _ := m.Resolve(ctx, storage.ProviderApple, "a2", nil)
+
+	if err := m.Link(ctx, jane, storage.ProviderGoogle, "g1", nil); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if err := m.Link(ctx, jane, storage.ProviderGoogle, "g1", nil); err != nil {
+		t.Fatalf("linking again: %v", err)
+	}
+	if uid, err := m.Resolve(ctx, storage.ProviderGoogle, "g1", nil); err != nil || uid != jane {
+		t.Fatalf("Resolve(linked) = %q, %v; want %q", uid, err, jane)
+	}
+
+	if err := m.Link(ctx, john, storage.ProviderGoogle, "g1", nil); !errors.Is(err, ErrTaken) {
+		t.Fatalf("linking another user's identity: expected ErrTaken, got %v", err)
+	}
+	if err := m.Link(ctx, jane, storage.ProviderGoogle, "g2", nil); !errors.Is(err, ErrProviderLinked) {
+		t.Fatalf("second identity at a provider: expected ErrProviderLinked, got %v", err)
+	}
+
+	if _, err := m.Unlink(ctx, john, storage.ProviderApple, nil); !errors.Is(err, ErrLastIdentity) {
+		t.Fatalf("unlinking the only identity: expected ErrLastIdentity, got %v", err)
+	}
+	if _, err := m.Unlink(ctx, john, storage.ProviderGoogle, nil); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("unlinking a missing identity: expected ErrNotFound, got %v", err)
+	}
+	failed := errors.New("revoke failed")
+	if _, err := m.Unlink(ctx, jane, storage.ProviderGoogle, func(storage.Identity) error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("failing before: expected its error, got %v", err)
+	}
+	if uid, err := m.Lookup(ctx, storage.ProviderGoogle, "g1"); err != nil || uid != jane {
+		t.Fatalf("identity unlinked although before failed: %q, %v", uid, err)
+	}
+	if id, err := m.Unlink(ctx, jane, storage.ProviderGoogle, nil); err != nil || id.Subject != "g1" {
+		t.Fatalf("Unlink = %+v, %v", id, err)
+	}
+	if uid, err := m.Resolve(ctx, storage.ProviderGoogle, "g1", nil); err != nil || uid == jane {
+		t.Fatalf("Resolve(unlinked) = %q, %v; want a new user", uid, err)
+	}
+}
+
+func TestResolve_LinkVerifiedEmail(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		attrs    map[string]string
+		wantSame bool
+	}{
+		{name: "disabled", attrs: verified("jane@example.com")},
+		{name: "verified", enabled: true, attrs: verified("JANE@example.com"), wantSame: true},
+		{name: "unverified", enabled: true, attrs: map[string]string{storage.AttrEmail: "jane@example.com", storage.AttrEmailVerified: "false"}},
+		{name: "verification unknown", enabled: true, attrs: map[string]string{storage.AttrEmail: "jane@example.com"}},
+		{name: "other email", enabled: true, attrs: verified("john@example.com")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(&Config{LinkVerifiedEmail: tt.enabled}, storage.NewMemoryStore())
+
+			jane, err := m.Resolve(ctx, storage.ProviderApple, "a1", verified("jane@example.com"))
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+
+			uid, err := m.Resolve(ctx, storage.ProviderGoogle, "g1", tt.attrs)
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if (uid == jane) != tt.wantSame {
+				t.Fatalf("Resolve = %q, Apple user %q; want same user: %v", uid, jane, tt.wantSame)
+			}
+		})
+	}
+
+	// A second account at the same provider never joins by email.
+	m := NewManager(&Config{LinkVerifiedEmail: true}, storage.NewMemoryStore())
+	jane, _ := m.Resolve(ctx, storage.ProviderGoogle, "g1", verified("jane@example.com"))
+	if uid, _ := m.Resolve(ctx, storage.ProviderGoogle, "g2", verified("jane@example.com")); uid == jane {
+		t.Fatalf("second Google account joined %q by email", jane)
+	}
+}
@@ -0,0 +1,223 @@
+// Package jwks fetches and caches the JSON Web Key Sets identity providers
+// sign their ID tokens with.
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+)
+
+const (
+	// DefaultTTL is how long a fetched key set is used before it is fetched
+	// again.
+	DefaultTTL = 6 * time.Hour
+
+	// minRefetch limits how often a token signed with an unknown kid can
+	// make the cache fetch the key set again, e.g. after a key rotation.
+	minRefetch = time.Minute
+
+	maxBodyBytes = 1 << 20
+)
+
+// ErrUnknownKey means the key set has no usable key with the token's kid.
+var ErrUnknownKey = errors.New("jwks: no key for kid")
+
+type jwk struct {
+	Kty string `json:"kty"` // "RSA" or "EC"
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Cache holds the keys published at a JWKS URL.
+type Cache struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+
+	mu      sync.RWMutex
+	keys    map[string]crypto.PublicKey // kid -> key
+	fetched time.Time
+}
+
+// NewCache returns a Cache for the key set at url, fetched with client, or
+// provider.HTTPClient's default if client is nil.
+func NewCache(url string, client *http.Client) *Cache {
+	return &Cache{url: url, client: provider.HTTPClient(client), ttl: DefaultTTL}
+}
+
+// Keyfunc looks up a token's verification key by its kid header, fetching
+// the key set with ctx when needed.
+func (c *Cache) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("missing kid in header")
+		}
+		return c.Key(ctx, kid)
+	}
+}
+
+// Key returns the key with the given kid. An unknown kid refetches the key
+// set, at most once a minute, in case the provider rotated its keys. If the
+// key set cannot be fetched, a kid that was known keeps its last key; other
+// fetch failures wrap provider.ErrUnavailable.
+func (c *Cache) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.RLock()
+	key, fresh := c.keys[kid], time.Since(c.fetched) < c.ttl
+	c.mu.RUnlock()
+	if key != nil && fresh {
+		return key, nil
+	}
+
+	if err := c.refresh(ctx, kid); err != nil {
+		if key != nil {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if key := c.keys[kid]; key != nil {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (c *Cache) refresh(ctx context.Context, kid string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another caller may have refreshed while this one waited for the lock.
+	age := time.Since(c.fetched)
+	if age < c.ttl && (c.keys[kid] != nil || age < minRefetch) {
+		return nil
+	}
+
+	keys, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.keys = keys
+	c.fetched = time.Now()
+	return nil
+}
+
+func (c *Cache) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: jwks fetch: %w", provider.ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%w: jwks fetch: status %d", provider.ErrUnavailable, resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodyBytes)).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("empty JWKS")
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.New("unsupported key type " + k.Kty)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,132 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+)
+
+func TestCache_Key(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+	}
+
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer srv.Close()
+
+	c := NewCache(srv.URL, srv.Client())
+	ctx := context.Background()
+
+	got, err := c.Key(ctx, "rsa")
+	if err != nil || !rsaKey.PublicKey.Equal(got) {
+		t.Fatalf("Key(rsa) = %v, %v", got, err)
+	}
+	got, err = c.Key(ctx, "ec")
+	if err != nil || !ecKey.PublicKey.Equal(got) {
+		t.Fatalf("Key(ec) = %v, %v", got, err)
+	}
+	if fetches.Load() != 1 {
+		t.Fatalf("expected one fetch for known kids, got %d", fetches.Load())
+	}
+
+	// Encryption keys are not for verifying signatures.
+	if _, err := c.Key(ctx, "enc"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key(enc): expected ErrUnknownKey, got %v", err)
+	}
+
+	// Unknown kids only refetch once a minute.
+	if _, err := c.Key(ctx, "rotated"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key(rotated): expected ErrUnknownKey, got %v", err)
+	}
+	if fetches.Load() != 1 {
+		t.Fatalf("unknown kid refetched too soon: %d fetches", fetches.Load())
+	}
+
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-2 * minRefetch)
+	c.mu.Unlock()
+	if _, err := c.Key(ctx, "rotated"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key(rotated): expected ErrUnknownKey, got %v", err)
+	}
+	if fetches.Load() != 2 {
+		t.Fatalf("expected unknown kid to refetch after a minute, got %d fetches", fetches.Load())
+	}
+}
+
+func TestCache_Unavailable(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa key: %v", err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	keys := []map[string]string{{"kty": "RSA", "kid": "rsa", "n": b64(key.N.Bytes()), "e": "AQAB"}}
+
+	var down atomic.Bool
+	down.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer srv.Close()
+
+	c := NewCache(srv.URL, srv.Client())
+	ctx := context.Background()
+
+	if _, err := c.Key(ctx, "rsa"); !errors.Is(err, provider.ErrUnavailable) {
+		t.Fatalf("Key with the key set down: expected ErrUnavailable, got %v", err)
+	}
+
+	down.Store(false)
+	if _, err := c.Key(ctx, "rsa"); err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+
+	// Once the cached set is stale, a failed refetch keeps known keys working.
+	down.Store(true)
+	c.mu.Lock()
+	c.fetched = time.Now().Add(-2 * DefaultTTL)
+	c.mu.Unlock()
+	if got, err := c.Key(ctx, "rsa"); err != nil || !key.PublicKey.Equal(got) {
+		t.Fatalf("Key(stale) = %v, %v; want the last fetched key", got, err)
+	}
+	if _, err := c.Key(ctx, "rotated"); !errors.Is(err, provider.ErrUnavailable) {
+		t.Fatalf("Key(unknown) with the key set down: expected ErrUnavailable, got %v", err)
+	}
+
+	srv.Close()
+	if _, err := c.Key(ctx, "rotated"); !errors.Is(err, provider.ErrUnavailable) {
+		t.Fatalf("Key with the server gone: expected ErrUnavailable, got %v", err)
+	}
+}
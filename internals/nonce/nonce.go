@@ -0,0 +1,73 @@
+// Package nonce issues the single-use nonces clients put into sign in
+// requests, so an ID token can only be redeemed once and only for a sign in we
+// started.
+package nonce
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// DefaultTTL is how long an issued nonce stays usable.
+const DefaultTTL = 5 * time.Minute
+
+const keyPrefix = "nonce:"
+
+// ErrUnknownNonce means the nonce was not issued by us, has expired or was
+// already used.
+var ErrUnknownNonce = errors.New("unknown or expired nonce")
+
+// Store keeps issued nonces in a storage.Store, so any replica can consume
+// them.
+type Store struct {
+	s   storage.Store
+	ttl time.Duration
+}
+
+// NewStore returns a Store whose nonces expire after ttl, or DefaultTTL if
+// ttl is zero.
+func NewStore(s storage.Store, ttl time.Duration) *Store {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	return &Store{s: s, ttl: ttl}
+}
+
+// TTL is how long issued nonces stay usable.
+func (st *Store) TTL() time.Duration {
+	return st.ttl
+}
+
+// Issue returns a fresh nonce.
+func (st *Store) Issue(ctx context.Context) (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	n := base64.RawURLEncoding.EncodeToString(b[:])
+
+	if err := st.s.PutOneTime(ctx, keyPrefix+n, nil, time.Now().Add(st.ttl)); err != nil {
+		return "", err
+	}
+
+	return n, nil
+}
+
+// Consume uses up n. It fails with ErrUnknownNonce unless n was issued, has
+// not expired and was not consumed before.
+func (st *Store) Consume(ctx context.Context, n string) error {
+	if n == "" {
+		return ErrUnknownNonce
+	}
+
+	_, err := st.s.TakeOneTime(ctx, keyPrefix+n)
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrUnknownNonce
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package nonce
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+func TestStore_IssueConsume(t *testing.T) {
+	ctx := context.Background()
+	st := NewStore(storage.NewMemoryStore(), 0)
+
+	n, err := st.Issue(ctx)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	if err := st.Consume(ctx, n); err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	if err := st.Consume(ctx, n); !errors.Is(err, ErrUnknownNonce) {
+		t.Fatalf("second Consume: expected ErrUnknownNonce, got %v", err)
+	}
+	if err := st.Consume(ctx, "client-chosen"); !errors.Is(err, ErrUnknownNonce) {
+		t.Fatalf("unissued nonce: expected ErrUnknownNonce, got %v", err)
+	}
+}
+
+func TestStore_Expires(t *testing.T) {
+	ctx := context.Background()
+	st := NewStore(storage.NewMemoryStore(), -time.Second)
+
+	n, err := st.Issue(ctx)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if err := st.Consume(ctx, n); !errors.Is(err, ErrUnknownNonce) {
+		t.Fatalf("expired nonce: expected ErrUnknownNonce, got %v", err)
+	}
+}
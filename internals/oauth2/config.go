@@ -0,0 +1,179 @@
+package oauth2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+type Config struct {
+	// Name identifies the provider in routes, e.g. /auth/github, and in
+	// stored records.
+	Name         string
+	ClientID     string
+	ClientSecret string
+	// RedirectURI is the public URL of GET /auth/{name}/callback, registered
+	// with the provider. It enables the browser flow.
+	RedirectURI string
+	Scopes      []string
+
+	AuthorizeURL string
+	TokenURL     string
+	// UserInfoURL answers the signed-in user as a JSON object, e.g.
+	// GitHub's /user.
+	UserInfoURL string
+	// EmailsURL, if set, lists the user's email addresses as GitHub's
+	// /user/emails does; the primary verified one becomes their email.
+	EmailsURL string
+	// RevokeURL, if set, is an RFC 7009 revocation endpoint.
+	RevokeURL string
+
+	// SubjectClaim is the user info field holding the user's stable id;
+	// "sub" if empty. Logins and emails can change, so do not use them.
+	SubjectClaim string
+	// Claims maps Record.Attrs keys to the user info fields they are read
+	// from, as for provider.MapClaims.
+	Claims map[string]string
+
+	// HTTPClient makes every request to the provider; nil leaves the choice
+	// to provider.HTTPClient.
+	HTTPClient *http.Client
+}
+
+// GitHub returns a Config for GitHub with its endpoints and fields filled in.
+// The email comes from /user/emails: /user only has the public one, which
+// may be unverified or missing.
+func GitHub() *Config {
+	return &Config{
+		Name:         "github",
+		Scopes:       []string{"read:user", "user:email"},
+		AuthorizeURL: "https://github.com/login/oauth/authorize",
+		TokenURL:     "https://github.com/login/oauth/access_token",
+		UserInfoURL:  "https://api.github.com/user",
+		EmailsURL:    "https://api.github.com/user/emails",
+		SubjectClaim: "id",
+		Claims:       map[string]string{"login": "login", "name": "name"},
+	}
+}
+
+// presets are the providers whose endpoints need not be configured.
+var presets = map[string]func() *Config{
+	"github": GitHub,
+}
+
+func (c *Config) subjectClaim() string {
+	if c.SubjectClaim == "" {
+		return "sub"
+	}
+	return c.SubjectClaim
+}
+
+func (c *Config) httpClient() *http.Client {
+	return provider.HTTPClient(c.HTTPClient)
+}
+
+func (c *Config) Validate() error {
+	if err := provider.CheckName(c.Name); err != nil {
+		return err
+	}
+
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return fmt.Errorf("missing OAuth2 client id or secret for %s", c.Name)
+	}
+
+	for _, u := range []string{c.AuthorizeURL, c.TokenURL, c.UserInfoURL} {
+		if p, err := url.Parse(u); err != nil || p.Scheme == "" || p.Host == "" {
+			return fmt.Errorf("invalid OAuth2 endpoint for %s: %q", c.Name, u)
+		}
+	}
+
+	if _, ok := c.Claims[storage.AttrEmailVerified]; ok && c.EmailsURL != "" {
+		return fmt.Errorf("OAuth2 %s: email_verified comes from the emails endpoint and cannot be mapped", c.Name)
+	}
+
+	return nil
+}
+
+// Load reads the OAuth2 providers named in OAUTH2_PROVIDERS, a comma
+// separated list. Each is configured by OAUTH2_<NAME>_* variables, NAME
+// upper-cased with dashes turned into underscores, e.g. OAUTH2_GITHUB_CLIENT_ID.
+// Endpoints of known providers, like github, default to theirs.
+func Load() ([]*Config, error) {
+	s := os.Getenv("OAUTH2_PROVIDERS")
+	if s == "" {
+		return nil, nil
+	}
+
+	var cfgs []*Config
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if slices.ContainsFunc(cfgs, func(c *Config) bool { return c.Name == name }) {
+			return nil, fmt.Errorf("OAuth2 provider %q configured twice", name)
+		}
+
+		cfg, err := load(name)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, cfg)
+	}
+
+	return cfgs, nil
+}
+
+func load(name string) (*Config, error) {
+	prefix := "OAUTH2_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	env := func(key string, def string) string {
+		if v := os.Getenv(prefix + key); v != "" {
+			return v
+		}
+		return def
+	}
+
+	cfg := &Config{Name: name}
+	if preset, ok := presets[name]; ok {
+		cfg = preset()
+	}
+
+	cfg.ClientID = env("CLIENT_ID", cfg.ClientID)
+	cfg.ClientSecret = env("CLIENT_SECRET", cfg.ClientSecret)
+	cfg.RedirectURI = env("REDIRECT_URI", cfg.RedirectURI)
+	cfg.AuthorizeURL = env("AUTHORIZE_URL", cfg.AuthorizeURL)
+	cfg.TokenURL = env("TOKEN_URL", cfg.TokenURL)
+	cfg.UserInfoURL = env("USERINFO_URL", cfg.UserInfoURL)
+	cfg.EmailsURL = env("EMAILS_URL", cfg.EmailsURL)
+	cfg.RevokeURL = env("REVOKE_URL", cfg.RevokeURL)
+	cfg.SubjectClaim = env("SUBJECT_CLAIM", cfg.SubjectClaim)
+
+	if s := env("SCOPES", ""); s != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(s, ",", " "))
+	}
+
+	// e.g. "email=email,avatar=avatar_url" on top of the preset's.
+	if s := env("CLAIMS", ""); s != "" {
+		claims, err := provider.ParseClaims(s, cfg.Claims)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sCLAIMS env var: %w", prefix, err)
+		}
+		cfg.Claims = claims
+	}
+
+	if s := env("HTTP_TIMEOUT", ""); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.HTTPClient = &http.Client{Timeout: d}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,180 @@
+// Package oauth2test runs an in-process fake of a plain OAuth2 provider,
+// shaped like GitHub, so OAuth2 sign in can be tested without the network.
+package oauth2test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/jmirfield/auth-service/internals/oauth2"
+	"github.com/jmirfield/auth-service/internals/oauthtest"
+)
+
+const (
+	clientID     = "Iv1.fakeclient"
+	clientSecret = "oauth2-client-secret"
+)
+
+// Server fakes GitHub's authorize, token, /user and /user/emails endpoints.
+// Codes are issued with IssueCode, or Authorize for the browser flow, and can
+// be redeemed once for an access token to the APIs. Like GitHub, the token
+// endpoint answers errors with a 200.
+type Server struct {
+	*httptest.Server
+
+	ClientID string
+
+	codes        oauthtest.Codes[Identity]
+	accessTokens oauthtest.Tokens[Identity]
+}
+
+// Email is one of a user's addresses, as /user/emails lists them.
+type Email struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// Identity is the user a code signs in.
+type Identity struct {
+	ID    int64
+	Login string
+	Name  string
+	// Email is the public email /user shows, which need not be verified.
+	Email  string
+	Emails []Email
+}
+
+// NewServer starts a fake provider. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{ClientID: clientID}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login/oauth/access_token", s.token)
+	mux.HandleFunc("GET /user", s.user)
+	mux.HandleFunc("GET /user/emails", s.emails)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Config returns the GitHub preset pointed at s.
+func (s *Server) Config() *oauth2.Config {
+	cfg := oauth2.GitHub()
+	cfg.ClientID = s.ClientID
+	cfg.ClientSecret = clientSecret
+	cfg.RedirectURI = "https://auth.example.com/auth/github/callback"
+	cfg.AuthorizeURL = s.URL + "/login/oauth/authorize"
+	cfg.TokenURL = s.URL + "/login/oauth/access_token"
+	cfg.UserInfoURL = s.URL + "/user"
+	cfg.EmailsURL = s.URL + "/user/emails"
+	cfg.HTTPClient = s.Client()
+	return cfg
+}
+
+// IssueCode returns a code that signs in id once, for a client that did not
+// use PKCE or a redirect URI.
+func (s *Server) IssueCode(id Identity) string {
+	return s.codes.Issue(id, "", "")
+}
+
+// Authorize stands in for GitHub's authorize page: it checks the request at
+// authorizeURL and returns the query GitHub redirects back with once id has
+// approved the app. PKCE is optional, as with GitHub.
+func (s *Server) Authorize(authorizeURL string, id Identity) (url.Values, error) {
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	switch {
+	case u.Scheme+"://"+u.Host+u.Path != s.URL+"/login/oauth/authorize":
+		return nil, errors.New("oauth2test: not an authorize url: " + authorizeURL)
+	case q.Get("client_id") != s.ClientID:
+		return nil, errors.New("oauth2test: unknown client_id")
+	}
+	if q.Get("code_challenge") != "" && q.Get("code_challenge_method") != "S256" {
+		return nil, errors.New("oauth2test: code_challenge_method must be S256")
+	}
+
+	return url.Values{
+		"code":  {s.codes.Issue(id, q.Get("redirect_uri"), q.Get("code_challenge"))},
+		"state": {q.Get("state")},
+	}, nil
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, "invalid_request")
+		return
+	}
+
+	if r.PostForm.Get("client_id") != s.ClientID || r.PostForm.Get("client_secret") != clientSecret {
+		oauthError(w, "incorrect_client_credentials")
+		return
+	}
+
+	id, ok := s.codes.Redeem(r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	if !ok {
+		oauthError(w, "bad_verification_code")
+		return
+	}
+
+	access := "gho_" + oauthtest.RandomString()
+	s.accessTokens.Put(access, id)
+
+	// Without expiring user tokens GitHub issues no refresh token.
+	oauthtest.WriteJSON(w, http.StatusOK, map[string]string{
+		"access_token": access,
+		"token_type":   "bearer",
+		"scope":        "read:user,user:email",
+	})
+}
+
+func (s *Server) identity(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	id, ok := s.accessTokens.Lookup(token)
+	if !ok {
+		oauthtest.WriteJSON(w, http.StatusUnauthorized, map[string]string{"message": "Bad credentials"})
+	}
+	return id, ok
+}
+
+func (s *Server) user(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.identity(w, r)
+	if !ok {
+		return
+	}
+
+	user := map[string]any{"id": id.ID, "login": id.Login, "name": nil, "email": nil}
+	if id.Name != "" {
+		user["name"] = id.Name
+	}
+	if id.Email != "" {
+		user["email"] = id.Email
+	}
+	oauthtest.WriteJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) emails(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.identity(w, r)
+	if !ok {
+		return
+	}
+
+	emails := id.Emails
+	if emails == nil {
+		emails = []Email{}
+	}
+	oauthtest.WriteJSON(w, http.StatusOK, emails)
+}
+
+// oauthError answers like GitHub's token endpoint, which reports errors with
+// a 200.
+func oauthError(w http.ResponseWriter, code string) {
+	oauthtest.Error(w, http.StatusOK, code)
+}
@@ -0,0 +1,275 @@
+// Package oauth2 signs users in with providers that speak plain OAuth2 but not
+// OpenID Connect, such as GitHub: with no ID token, the user is identified by
+// calling the provider's user info API with the access token.
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// ErrNoIDToken is returned by VerifyIDToken: plain OAuth2 providers have no
+// ID tokens, so clients must send a code.
+var ErrNoIDToken = errors.New("oauth2: provider issues no id tokens")
+
+// Provider is a plain OAuth2 provider as a provider.Provider. It runs the
+// browser flow, with PKCE, through AuthorizeURL and identifies users through
+// FetchUserInfo, which leaves nothing for forwarded user details to add.
+type Provider struct {
+	provider.NoUserInfo
+	config *Config
+}
+
+func NewProvider(cfg *Config) (*Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Provider{config: cfg}, nil
+}
+
+// AuthorizeURL is where the browser flow sends the user to sign in. There is
+// no ID token for a nonce to go into, so nonce is not sent.
+func (p *Provider) AuthorizeURL(_ context.Context, state, _, codeChallenge string) (string, error) {
+	if p.config.RedirectURI == "" {
+		return "", errors.New("oauth2 " + p.config.Name + ": no redirect URI configured")
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURI)
+	if len(p.config.Scopes) > 0 {
+		q.Set("scope", strings.Join(p.config.Scopes, " "))
+	}
+	q.Set("state", state)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.config.AuthorizeURL, "?") {
+		sep = "&"
+	}
+	return p.config.AuthorizeURL + sep + q.Encode(), nil
+}
+
+func (p *Provider) ExchangeCode(ctx context.Context, code provider.Code) (*provider.Tokens, error) {
+	if code.ClientID != "" && code.ClientID != p.config.ClientID {
+		return nil, provider.ErrUnknownClient
+	}
+
+	redirectURI := code.RedirectURI
+	if redirectURI == "" {
+		redirectURI = p.config.RedirectURI
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code.Code)
+	if redirectURI != "" {
+		data.Set("redirect_uri", redirectURI)
+	}
+	if code.CodeVerifier != "" {
+		data.Set("code_verifier", code.CodeVerifier)
+	}
+
+	return p.postToken(ctx, data)
+}
+
+func (p *Provider) VerifyIDToken(context.Context, string, string) (*provider.Identity, error) {
+	return nil, ErrNoIDToken
+}
+
+// FetchUserInfo identifies the user the access token belongs to. With an
+// EmailsURL, their email is the primary verified address listed there.
+func (p *Provider) FetchUserInfo(ctx context.Context, accessToken string) (*provider.Identity, error) {
+	var info map[string]any
+	if err := p.get(ctx, p.config.UserInfoURL, accessToken, &info); err != nil {
+		return nil, err
+	}
+
+	sub, _ := provider.ClaimString(info[p.config.subjectClaim()])
+	if sub == "" {
+		return nil, fmt.Errorf("oauth2 %s: user info has no %q", p.config.Name, p.config.subjectClaim())
+	}
+
+	attrs := provider.MapClaims(info, p.config.Claims)
+	if p.config.EmailsURL != "" {
+		delete(attrs, storage.AttrEmail)
+
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := p.get(ctx, p.config.EmailsURL, accessToken, &emails); err != nil {
+			return nil, err
+		}
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				attrs[storage.AttrEmail] = e.Email
+				attrs[storage.AttrEmailVerified] = "true"
+			}
+		}
+	}
+
+	return &provider.Identity{Subject: sub, Attrs: attrs}, nil
+}
+
+// Refresh redeems a refresh token, for providers that issue them; GitHub only
+// does for apps with expiring user tokens.
+func (p *Provider) Refresh(ctx context.Context, refreshToken, _ string) (*provider.Tokens, error) {
+	if refreshToken == "" {
+		return nil, errors.New("missing refresh token")
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", refreshToken)
+
+	return p.postToken(ctx, data)
+}
+
+// Revoke revokes a refresh token at cfg.RevokeURL. A provider without one has
+// nothing to revoke against, so the token is simply forgotten.
+func (p *Provider) Revoke(ctx context.Context, refreshToken, _ string) error {
+	if p.config.RevokeURL == "" {
+		return nil
+	}
+
+	data := url.Values{}
+	data.Set("token", refreshToken)
+	data.Set("token_type_hint", "refresh_token")
+
+	_, err := p.post(ctx, p.config.RevokeURL, data)
+	return err
+}
+
+func (p *Provider) postToken(ctx context.Context, data url.Values) (*provider.Tokens, error) {
+	body, err := p.post(ctx, p.config.TokenURL, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var tok struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, err
+	}
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("oauth2 %s: token response without access_token", p.config.Name)
+	}
+
+	return &provider.Tokens{AccessToken: tok.AccessToken, RefreshToken: tok.RefreshToken}, nil
+}
+
+// post sends a form, with the client's credentials, to one of the provider's
+// OAuth endpoints and returns the answer's body. Some providers, GitHub among
+// them, answer errors with a 200, so the body is checked as well.
+func (p *Provider) post(ctx context.Context, endpoint string, data url.Values) ([]byte, error) {
+	data.Set("client_id", p.config.ClientID)
+	data.Set("client_secret", p.config.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// GitHub answers form-encoded unless asked for JSON.
+	req.Header.Set("Accept", "application/json")
+
+	status, body, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var e struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	_ = json.Unmarshal(body, &e)
+	if status != http.StatusOK || e.Error != "" {
+		return nil, p.oauthError(status, e.Error, e.ErrorDescription)
+	}
+
+	return body, nil
+}
+
+// get calls one of the provider's APIs with the user's access token and
+// decodes the JSON answer into v.
+func (p *Provider) get(ctx context.Context, endpoint, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	status, body, err := p.do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case status >= 500:
+		return fmt.Errorf("%w: oauth2 %s: %s: status %d", provider.ErrUnavailable, p.config.Name, endpoint, status)
+	case status != http.StatusOK:
+		return fmt.Errorf("oauth2 %s: %s: status %d: %s", p.config.Name, endpoint, status, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (p *Provider) do(req *http.Request) (int, []byte, error) {
+	resp, err := p.config.httpClient().Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: oauth2 %s: %w", provider.ErrUnavailable, p.config.Name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// oauthError builds an error wrapping the provider.Err* value code stands
+// for. GitHub calls a bad code bad_verification_code.
+func (p *Provider) oauthError(status int, code, description string) error {
+	var target error
+	switch {
+	case code == "invalid_grant", code == "invalid_token", code == "bad_verification_code":
+		target = provider.ErrInvalidGrant
+	case code == "invalid_request":
+		target = provider.ErrInvalidRequest
+	case code == "invalid_client", code == "unauthorized_client", code == "incorrect_client_credentials":
+		target = provider.ErrClientRejected
+	case status >= 500:
+		target = provider.ErrUnavailable
+	}
+
+	msg := fmt.Sprintf("oauth2 %s: status %d", p.config.Name, status)
+	if code != "" {
+		msg += ": " + code
+		if description != "" {
+			msg += ": " + description
+		}
+	}
+	if target == nil {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%w: %s", target, msg)
+}
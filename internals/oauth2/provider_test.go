@@ -0,0 +1,121 @@
+package oauth2_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmirfield/auth-service/internals/oauth2"
+	"github.com/jmirfield/auth-service/internals/oauth2/oauth2test"
+	"github.com/jmirfield/auth-service/internals/oauthstate"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+func TestFetchUserInfo(t *testing.T) {
+	fake := oauth2test.NewServer()
+	defer fake.Close()
+
+	ctx := context.Background()
+	p, err := oauth2.NewProvider(fake.Config())
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		id        oauth2test.Identity
+		wantAttrs map[string]string
+	}{
+		{
+			name: "primary verified email",
+			id: oauth2test.Identity{ID: 583231, Login: "octocat", Name: "The Octocat", Emails: []oauth2test.Email{
+				{Email: "old@example.com", Verified: true},
+				{Email: "octocat@github.com", Primary: true, Verified: true},
+			}},
+			wantAttrs: map[string]string{"login": "octocat", "name": "The Octocat", storage.AttrEmail: "octocat@github.com", storage.AttrEmailVerified: "true"},
+		},
+		{
+			name: "unverified primary email",
+			id: oauth2test.Identity{ID: 583231, Login: "octocat", Emails: []oauth2test.Email{
+				{Email: "octocat@github.com", Primary: true},
+			}},
+			wantAttrs: map[string]string{"login": "octocat"},
+		},
+		{
+			name:      "public email is not trusted",
+			id:        oauth2test.Identity{ID: 583231, Login: "octocat", Email: "public@example.com"},
+			wantAttrs: map[string]string{"login": "octocat"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := p.ExchangeCode(ctx, provider.Code{Code: fake.IssueCode(tt.id)})
+			if err != nil {
+				t.Fatalf("ExchangeCode: %v", err)
+			}
+
+			got, err := p.FetchUserInfo(ctx, tok.AccessToken)
+			if err != nil {
+				t.Fatalf("FetchUserInfo: %v", err)
+			}
+			if got.Subject != "583231" {
+				t.Fatalf("subject: got %q, want 583231", got.Subject)
+			}
+			if len(got.Attrs) != len(tt.wantAttrs) {
+				t.Fatalf("attrs: got %v, want %v", got.Attrs, tt.wantAttrs)
+			}
+			for k, v := range tt.wantAttrs {
+				if got.Attrs[k] != v {
+					t.Fatalf("attr %s: got %q, want %q (all: %v)", k, got.Attrs[k], v, got.Attrs)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	fake := oauth2test.NewServer()
+	defer fake.Close()
+
+	ctx := context.Background()
+	p, err := oauth2.NewProvider(fake.Config())
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+
+	st := oauthstate.State{CodeVerifier: "verifier-with-enough-entropy-0123456789"}
+	authorize := func() string {
+		u, err := p.AuthorizeURL(ctx, "state-1", "", st.CodeChallenge())
+		if err != nil {
+			t.Fatalf("AuthorizeURL: %v", err)
+		}
+		q, err := fake.Authorize(u, oauth2test.Identity{ID: 1, Login: "octocat"})
+		if err != nil {
+			t.Fatalf("Authorize: %v", err)
+		}
+		return q.Get("code")
+	}
+
+	// GitHub answers a bad code with a 200 carrying the error.
+	if _, err := p.ExchangeCode(ctx, provider.Code{Code: authorize(), CodeVerifier: "wrong"}); !errors.Is(err, provider.ErrInvalidGrant) {
+		t.Fatalf("wrong verifier: expected ErrInvalidGrant, got %v", err)
+	}
+
+	tok, err := p.ExchangeCode(ctx, provider.Code{Code: authorize(), CodeVerifier: st.CodeVerifier})
+	if err != nil || tok.AccessToken == "" {
+		t.Fatalf("ExchangeCode: %+v, %v", tok, err)
+	}
+
+	if _, err := p.VerifyIDToken(ctx, "x", ""); !errors.Is(err, oauth2.ErrNoIDToken) {
+		t.Fatalf("VerifyIDToken: expected ErrNoIDToken, got %v", err)
+	}
+
+	cfg := fake.Config()
+	cfg.ClientSecret = "wrong"
+	bad, _ := oauth2.NewProvider(cfg)
+	if _, err := bad.ExchangeCode(ctx, provider.Code{Code: fake.IssueCode(oauth2test.Identity{ID: 1})}); !errors.Is(err, provider.ErrClientRejected) {
+		t.Fatalf("wrong secret: expected ErrClientRejected, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Package oauthstate keeps what a redirect-based sign in needs to remember
+// between sending the browser to the provider and the provider's callback.
+package oauthstate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// DefaultTTL is how long a user has to finish signing in with the provider.
+const DefaultTTL = 10 * time.Minute
+
+const keyPrefix = "oauth_state:"
+
+// ErrUnknownState means the state is unknown, expired or already used.
+var ErrUnknownState = errors.New("unknown or expired state")
+
+// State is a sign in in progress.
+type State struct {
+	// Provider is the provider the sign in is with; its callback must be
+	// the one to take the state.
+	Provider     string `json:"provider,omitempty"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+// CodeChallenge is the PKCE S256 challenge for the state's code verifier.
+func (s State) CodeChallenge() string {
+	sum := sha256.Sum256([]byte(s.CodeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Store holds sign ins in progress in a storage.Store, so any replica can
+// serve the callback.
+type Store struct {
+	s   storage.Store
+	ttl time.Duration
+}
+
+// NewStore returns a Store whose states expire after ttl, or DefaultTTL if
+// ttl is zero.
+func NewStore(s storage.Store, ttl time.Duration) *Store {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	return &Store{s: s, ttl: ttl}
+}
+
+// Begin starts a sign in with provider with a fresh nonce and code verifier
+// and returns the state value to send to the provider.
+func (st *Store) Begin(ctx context.Context, provider string) (string, State, error) {
+	key, err := random()
+	if err != nil {
+		return "", State{}, err
+	}
+
+	s := State{Provider: provider}
+	if s.Nonce, err = random(); err != nil {
+		return "", State{}, err
+	}
+	if s.CodeVerifier, err = random(); err != nil {
+		return "", State{}, err
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", State{}, err
+	}
+
+	if err := st.s.PutOneTime(ctx, keyPrefix+key, b, time.Now().Add(st.ttl)); err != nil {
+		return "", State{}, err
+	}
+
+	return key, s, nil
+}
+
+// Take ends the sign in for key and returns its state. Each state can be taken
+// once; after that, or once it expired, Take fails with ErrUnknownState.
+func (st *Store) Take(ctx context.Context, key string) (State, error) {
+	if key == "" {
+		return State{}, ErrUnknownState
+	}
+
+	b, err := st.s.TakeOneTime(ctx, keyPrefix+key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return State{}, ErrUnknownState
+	}
+	if err != nil {
+		return State{}, err
+	}
+
+	var s State
+	if err := json.Unmarshal(b, &s); err != nil {
+		return State{}, err
+	}
+
+	return s, nil
+}
+
+// random returns 32 random bytes, base64url encoded; 43 characters also make
+// it a valid PKCE code verifier.
+func random() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,56 @@
+package oauthstate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+func TestStore_BeginTake(t *testing.T) {
+	ctx := context.Background()
+	st := NewStore(storage.NewMemoryStore(), 0)
+
+	key, want, err := st.Begin(ctx, "apple")
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if key == "" || want.Nonce == "" || len(want.CodeVerifier) < 43 {
+		t.Fatalf("Begin returned %q, %+v", key, want)
+	}
+
+	got, err := st.Take(ctx, key)
+	if err != nil || got != want {
+		t.Fatalf("Take = %+v, %v; want %+v", got, err, want)
+	}
+
+	if _, err := st.Take(ctx, key); !errors.Is(err, ErrUnknownState) {
+		t.Fatalf("second Take: expected ErrUnknownState, got %v", err)
+	}
+	if _, err := st.Take(ctx, "forged"); !errors.Is(err, ErrUnknownState) {
+		t.Fatalf("unknown state: expected ErrUnknownState, got %v", err)
+	}
+}
+
+func TestStore_Expires(t *testing.T) {
+	ctx := context.Background()
+	st := NewStore(storage.NewMemoryStore(), -time.Second)
+
+	key, _, err := st.Begin(ctx, "apple")
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if _, err := st.Take(ctx, key); !errors.Is(err, ErrUnknownState) {
+		t.Fatalf("expired state: expected ErrUnknownState, got %v", err)
+	}
+}
+
+func TestState_CodeChallenge(t *testing.T) {
+	// RFC 7636, appendix B.
+	s := State{CodeVerifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+	if got, want := s.CodeChallenge(), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Fatalf("CodeChallenge = %q, want %q", got, want)
+	}
+}
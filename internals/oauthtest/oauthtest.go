@@ -0,0 +1,187 @@
+// Package oauthtest is the plumbing the fake identity providers in the
+// *test packages share: single-use authorization codes with PKCE, the tokens
+// redeeming them yields, an ID token signing key and its JWKS, and OAuth error
+// answers. Each fake keeps what is particular to its provider, such as how
+// clients authenticate and what its ID tokens carry.
+package oauthtest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Codes hands out authorization codes that sign in an identity of type T
+// once. The zero value is ready to use.
+type Codes[T any] struct {
+	mu    sync.Mutex
+	codes map[string]pendingCode[T]
+}
+
+type pendingCode[T any] struct {
+	id            T
+	redirectURI   string
+	codeChallenge string
+}
+
+// Issue returns a code for id. If redirectURI is set the code must be
+// redeemed with the same one, and if codeChallenge is set with the verifier
+// whose S256 challenge it is.
+func (c *Codes[T]) Issue(id T, redirectURI, codeChallenge string) string {
+	code := RandomString()
+
+	c.mu.Lock()
+	if c.codes == nil {
+		c.codes = make(map[string]pendingCode[T])
+	}
+	c.codes[code] = pendingCode[T]{id: id, redirectURI: redirectURI, codeChallenge: codeChallenge}
+	c.mu.Unlock()
+
+	return code
+}
+
+// Redeem uses up code and returns the identity it signs in, unless code is
+// unknown, was used before, or redirectURI or verifier do not match it.
+func (c *Codes[T]) Redeem(code, redirectURI, verifier string) (T, bool) {
+	c.mu.Lock()
+	p, ok := c.codes[code]
+	delete(c.codes, code)
+	c.mu.Unlock()
+
+	ok = ok && (p.redirectURI == "" || p.redirectURI == redirectURI) &&
+		(p.codeChallenge == "" || p.codeChallenge == s256(verifier))
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return p.id, true
+}
+
+func s256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Tokens remembers the tokens a fake handed out, whom they are for and which
+// were revoked. The zero value is ready to use.
+type Tokens[T any] struct {
+	mu      sync.Mutex
+	tokens  map[string]T
+	revoked map[string]bool
+}
+
+// Issue returns a new token for id.
+func (t *Tokens[T]) Issue(id T) string {
+	token := RandomString()
+	t.Put(token, id)
+	return token
+}
+
+// Put records token as issued for id.
+func (t *Tokens[T]) Put(token string, id T) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tokens == nil {
+		t.tokens = make(map[string]T)
+	}
+	t.tokens[token] = id
+}
+
+// Lookup returns whom token was issued for, unless it is unknown or revoked.
+func (t *Tokens[T]) Lookup(token string) (T, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id, ok := t.tokens[token]
+	return id, ok && !t.revoked[token]
+}
+
+// Revoke revokes token and reports whether it was live until now.
+func (t *Tokens[T]) Revoke(token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, known := t.tokens[token]
+	live := known && !t.revoked[token]
+	if t.revoked == nil {
+		t.revoked = make(map[string]bool)
+	}
+	t.revoked[token] = true
+	return live
+}
+
+// Revoked reports whether token was revoked.
+func (t *Tokens[T]) Revoked(token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.revoked[token]
+}
+
+// Key is an RSA key that signs ID tokens under a fixed kid.
+type Key struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+// NewKey generates a key published under kid.
+func NewKey(kid string) *Key {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("oauthtest: " + err.Error())
+	}
+	return &Key{kid: kid, key: key}
+}
+
+// Sign signs claims with RS256.
+func (k *Key) Sign(claims jwt.Claims) string {
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = k.kid
+
+	signed, err := tok.SignedString(k.key)
+	if err != nil {
+		panic("oauthtest: " + err.Error())
+	}
+	return signed
+}
+
+// ServeJWKS answers with the key set holding k's public key.
+func (k *Key) ServeJWKS(w http.ResponseWriter, _ *http.Request) {
+	pub := k.key.PublicKey
+	WriteJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": k.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// Error answers with an OAuth error code.
+func Error(w http.ResponseWriter, status int, code string) {
+	WriteJSON(w, status, map[string]string{"error": code})
+}
+
+// WriteJSON answers with v as JSON.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// RandomString returns a random token-like string.
+func RandomString() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
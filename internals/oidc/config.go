@@ -0,0 +1,146 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// DefaultScopes are requested when a Config names none.
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// DefaultClaims maps the standard OIDC claims onto the storage.Attr* keys.
+var DefaultClaims = map[string]string{
+	storage.AttrEmail:         "email",
+	storage.AttrEmailVerified: "email_verified",
+	storage.AttrGivenName:     "given_name",
+	storage.AttrFamilyName:    "family_name",
+}
+
+type Config struct {
+	// Name identifies the provider in routes, e.g. /auth/okta, and in
+	// stored records.
+	Name string
+	// Issuer is the provider's issuer URL; its discovery document is read
+	// from Issuer + "/.well-known/openid-configuration".
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURI is the public URL of GET /auth/{name}/callback, registered
+	// with the provider. It enables the browser flow.
+	RedirectURI string
+	// Scopes requested in the browser flow; DefaultScopes if empty.
+	Scopes []string
+	// Claims maps Record.Attrs keys to the ID token claims they are read
+	// from, as for provider.MapClaims; DefaultClaims if nil.
+	Claims map[string]string
+
+	// HTTPClient makes every request to the provider; provider.HTTPClient
+	// picks the default when it is nil.
+	HTTPClient *http.Client
+}
+
+func (c *Config) scopes() []string {
+	if len(c.Scopes) == 0 {
+		return DefaultScopes
+	}
+	return c.Scopes
+}
+
+func (c *Config) claims() map[string]string {
+	if c.Claims == nil {
+		return DefaultClaims
+	}
+	return c.Claims
+}
+
+func (c *Config) httpClient() *http.Client {
+	return provider.HTTPClient(c.HTTPClient)
+}
+
+func (c *Config) Validate() error {
+	if err := provider.CheckName(c.Name); err != nil {
+		return err
+	}
+
+	if u, err := url.Parse(c.Issuer); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid OIDC issuer for %s: %q", c.Name, c.Issuer)
+	}
+
+	if c.ClientID == "" {
+		return fmt.Errorf("missing OIDC client id for %s", c.Name)
+	}
+
+	return nil
+}
+
+// Load reads the OIDC providers named in OIDC_PROVIDERS, a comma separated
+// list. Each is configured by OIDC_<NAME>_* variables, NAME upper-cased with
+// dashes turned into underscores, e.g. OIDC_OKTA_ISSUER.
+func Load() ([]*Config, error) {
+	s := os.Getenv("OIDC_PROVIDERS")
+	if s == "" {
+		return nil, nil
+	}
+
+	var cfgs []*Config
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if slices.ContainsFunc(cfgs, func(c *Config) bool { return c.Name == name }) {
+			return nil, fmt.Errorf("OIDC provider %q configured twice", name)
+		}
+
+		cfg, err := load(name)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, cfg)
+	}
+
+	return cfgs, nil
+}
+
+func load(name string) (*Config, error) {
+	prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	env := func(key string) string { return os.Getenv(prefix + key) }
+
+	cfg := &Config{
+		Name:         name,
+		Issuer:       strings.TrimSuffix(env("ISSUER"), "/"),
+		ClientID:     env("CLIENT_ID"),
+		ClientSecret: env("CLIENT_SECRET"),
+		RedirectURI:  env("REDIRECT_URI"),
+	}
+
+	if s := env("SCOPES"); s != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(s, ",", " "))
+	}
+
+	// e.g. "email=upn,groups=groups" on top of DefaultClaims.
+	if s := env("CLAIMS"); s != "" {
+		claims, err := provider.ParseClaims(s, DefaultClaims)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sCLAIMS env var: %w", prefix, err)
+		}
+		cfg.Claims = claims
+	}
+
+	if s := env("HTTP_TIMEOUT"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			cfg.HTTPClient = &http.Client{Timeout: d}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,66 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jmirfield/auth-service/internals/jwks"
+	"github.com/jmirfield/auth-service/internals/provider"
+)
+
+// metadata is the part of the discovery document the provider uses.
+type metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	RevocationEndpoint    string   `json:"revocation_endpoint,omitempty"`
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+}
+
+// discover returns the provider's metadata, fetching the discovery document
+// on first use. A failed fetch is retried by the next call.
+func (p *Provider) discover(ctx context.Context) (*metadata, *jwks.Cache, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, p.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := p.config.httpClient().Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: oidc %s: discovery: %w", provider.ErrUnavailable, p.config.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: oidc %s: discovery: status %d", provider.ErrUnavailable, p.config.Name, resp.StatusCode)
+	}
+
+	var meta metadata
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&meta); err != nil {
+		return nil, nil, fmt.Errorf("oidc %s: discovery: %w", p.config.Name, err)
+	}
+
+	// OpenID Connect Discovery 1.0, section 4.3.
+	if meta.Issuer != p.config.Issuer {
+		return nil, nil, fmt.Errorf("oidc %s: discovery issuer %q does not match %q", p.config.Name, meta.Issuer, p.config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("oidc %s: discovery document is missing endpoints", p.config.Name)
+	}
+
+	p.meta = &meta
+	p.keys = jwks.NewCache(meta.JWKSURI, p.config.httpClient())
+	return p.meta, p.keys, nil
+}
@@ -0,0 +1,231 @@
+// Package oidctest runs an in-process fake OpenID Connect provider so OIDC
+// sign in can be tested without the network.
+package oidctest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmirfield/auth-service/internals/oauthtest"
+	"github.com/jmirfield/auth-service/internals/oidc"
+)
+
+const (
+	clientID     = "auth-service"
+	clientSecret = "oidc-client-secret"
+	signKID      = "fake-oidc-kid"
+)
+
+// Server fakes an OIDC provider's discovery, keys, token and revocation
+// endpoints; its issuer is its URL. Codes are issued with IssueCode, or
+// Authorize for the browser flow, and can be redeemed once; the refresh
+// tokens they yield stay valid until revoked.
+type Server struct {
+	*httptest.Server
+
+	// ClientID is the one client the provider knows. It authenticates with
+	// HTTP Basic, as discovery advertises.
+	ClientID string
+
+	signKey       *oauthtest.Key
+	codes         oauthtest.Codes[Identity]
+	refreshTokens oauthtest.Tokens[Identity]
+}
+
+// Identity is the user a code or token signs in.
+type Identity struct {
+	Subject       string
+	Nonce         string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+	// Claims are further claims put in the ID token, e.g. groups.
+	Claims map[string]any
+}
+
+// NewServer starts a fake OIDC provider. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{
+		ClientID: clientID,
+		signKey:  oauthtest.NewKey(signKID),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /keys", s.signKey.ServeJWKS)
+	mux.HandleFunc("POST /token", s.token)
+	mux.HandleFunc("POST /revoke", s.revoke)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Config returns an oidc.Config named "example" that talks to s.
+func (s *Server) Config() *oidc.Config {
+	return &oidc.Config{
+		Name:         "example",
+		Issuer:       s.URL,
+		ClientID:     s.ClientID,
+		ClientSecret: clientSecret,
+		RedirectURI:  "https://auth.example.com/auth/example/callback",
+		HTTPClient:   s.Client(),
+	}
+}
+
+// IssueCode returns a code that signs in id once, for a client that did not
+// use PKCE or a redirect URI.
+func (s *Server) IssueCode(id Identity) string {
+	return s.codes.Issue(id, "", "")
+}
+
+// Authorize checks the request at authorizeURL as the provider would, PKCE
+// being mandatory, and returns the query it redirects back with once id has
+// signed in. The ID token carries the requested nonce.
+func (s *Server) Authorize(authorizeURL string, id Identity) (url.Values, error) {
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	switch {
+	case u.Scheme+"://"+u.Host+u.Path != s.URL+"/authorize":
+		return nil, errors.New("oidctest: not an authorize url: " + authorizeURL)
+	case q.Get("client_id") != s.ClientID:
+		return nil, errors.New("oidctest: unknown client_id")
+	case q.Get("response_type") != "code":
+		return nil, errors.New("oidctest: response_type must be code")
+	case q.Get("redirect_uri") == "":
+		return nil, errors.New("oidctest: missing redirect_uri")
+	case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+		return nil, errors.New("oidctest: PKCE with S256 is required")
+	}
+
+	id.Nonce = q.Get("nonce")
+	return url.Values{
+		"code":  {s.codes.Issue(id, q.Get("redirect_uri"), q.Get("code_challenge"))},
+		"state": {q.Get("state")},
+	}, nil
+}
+
+// Revoked reports whether refreshToken was revoked through /revoke.
+func (s *Server) Revoked(refreshToken string) bool {
+	return s.refreshTokens.Revoked(refreshToken)
+}
+
+// IDToken signs an ID token for id, issued by the server's URL, with
+// id.Claims alongside the standard ones.
+func (s *Server) IDToken(id Identity) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": s.URL,
+		"aud": s.ClientID,
+		"sub": id.Subject,
+		"iat": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	}
+	for k, v := range id.Claims {
+		claims[k] = v
+	}
+	if id.Nonce != "" {
+		claims["nonce"] = id.Nonce
+	}
+	if id.Email != "" {
+		claims["email"] = id.Email
+		claims["email_verified"] = id.EmailVerified
+	}
+	if id.GivenName != "" {
+		claims["given_name"] = id.GivenName
+	}
+	if id.FamilyName != "" {
+		claims["family_name"] = id.FamilyName
+	}
+
+	return s.signKey.Sign(claims)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, _ *http.Request) {
+	oauthtest.WriteJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/keys",
+		"revocation_endpoint":                   s.URL + "/revoke",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) authenticated(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	return ok && user == s.ClientID && pass == clientSecret
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if !s.authenticated(r) {
+		oauthtest.Error(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var (
+		id      Identity
+		ok      bool
+		refresh string
+	)
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		id, ok = s.codes.Redeem(r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		if ok {
+			refresh = s.refreshTokens.Issue(id)
+		}
+	case "refresh_token":
+		id, ok = s.refreshTokens.Lookup(r.PostForm.Get("refresh_token"))
+		// Refreshed ID tokens carry no nonce.
+		id.Nonce = ""
+	default:
+		oauthtest.Error(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	if !ok {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	oauthtest.WriteJSON(w, http.StatusOK, map[string]any{
+		"access_token":  oauthtest.RandomString(),
+		"refresh_token": refresh,
+		"id_token":      s.IDToken(id),
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+// revoke follows RFC 7009: unknown tokens are not an error.
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oauthtest.Error(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if !s.authenticated(r) {
+		oauthtest.Error(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.refreshTokens.Revoke(r.PostForm.Get("token"))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,282 @@
+// Package oidc signs users in with any OpenID Connect provider, such as Okta,
+// Azure AD or Keycloak, configured from its discovery document.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jmirfield/auth-service/internals/jwks"
+	"github.com/jmirfield/auth-service/internals/provider"
+)
+
+// Provider is an OpenID Connect provider as a provider.Provider. It also
+// runs the browser flow, with PKCE, through AuthorizeURL. Users are described
+// by the ID token alone.
+type Provider struct {
+	provider.NoUserInfo
+	config *Config
+
+	mu   sync.Mutex
+	meta *metadata
+	keys *jwks.Cache
+}
+
+func NewProvider(cfg *Config) (*Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Provider{config: cfg}, nil
+}
+
+// AuthorizeURL is where the browser flow sends the user to sign in. The
+// provider redirects back to cfg.RedirectURI with the code in the query.
+func (p *Provider) AuthorizeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	if p.config.RedirectURI == "" {
+		return "", errors.New("oidc " + p.config.Name + ": no redirect URI configured")
+	}
+
+	meta, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURI)
+	q.Set("scope", strings.Join(p.config.scopes(), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// ExchangeCode redeems a code for the configured client. Codes from the
+// browser flow were issued for cfg.RedirectURI unless code says otherwise.
+func (p *Provider) ExchangeCode(ctx context.Context, code provider.Code) (*provider.Tokens, error) {
+	if code.ClientID != "" && code.ClientID != p.config.ClientID {
+		return nil, provider.ErrUnknownClient
+	}
+
+	redirectURI := code.RedirectURI
+	if redirectURI == "" {
+		redirectURI = p.config.RedirectURI
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code.Code)
+	if redirectURI != "" {
+		data.Set("redirect_uri", redirectURI)
+	}
+	if code.CodeVerifier != "" {
+		data.Set("code_verifier", code.CodeVerifier)
+	}
+
+	return p.postToken(ctx, data)
+}
+
+// VerifyIDToken verifies an ID token issued to the configured client and
+// maps its claims into attributes per cfg.Claims.
+func (p *Provider) VerifyIDToken(ctx context.Context, idToken, nonce string) (*provider.Identity, error) {
+	if idToken == "" {
+		return nil, errors.New("empty id_token")
+	}
+
+	meta, keys, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	algs := meta.SigningAlgs
+	if len(algs) == 0 {
+		algs = []string{jwt.SigningMethodRS256.Alg()}
+	}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(algs),
+		jwt.WithLeeway(60*time.Second),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+	)
+
+	claims := jwt.MapClaims{}
+	if _, err := parser.ParseWithClaims(idToken, claims, keys.Keyfunc(ctx)); err != nil {
+		return nil, err
+	}
+
+	// A token for several audiences must name us as the authorized party.
+	aud, _ := claims.GetAudience()
+	if azp, ok := claims["azp"].(string); (ok || len(aud) > 1) && azp != p.config.ClientID {
+		return nil, errors.New("invalid azp")
+	}
+
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		return nil, errors.New("missing sub")
+	}
+
+	if nonce != "" {
+		if got, _ := claims["nonce"].(string); got != nonce {
+			return nil, errors.New("nonce mismatch")
+		}
+	}
+
+	return &provider.Identity{Subject: sub, Attrs: provider.MapClaims(claims, p.config.claims())}, nil
+}
+
+func (p *Provider) Refresh(ctx context.Context, refreshToken, _ string) (*provider.Tokens, error) {
+	if refreshToken == "" {
+		return nil, errors.New("missing refresh token")
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", refreshToken)
+
+	return p.postToken(ctx, data)
+}
+
+// Revoke revokes a refresh token at the provider's revocation endpoint. A
+// provider that publishes none has nothing to revoke against, so the token is
+// simply forgotten.
+func (p *Provider) Revoke(ctx context.Context, refreshToken, _ string) error {
+	meta, _, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if meta.RevocationEndpoint == "" {
+		return nil
+	}
+
+	data := url.Values{}
+	data.Set("token", refreshToken)
+	data.Set("token_type_hint", "refresh_token")
+
+	_, err = p.post(ctx, meta, meta.RevocationEndpoint, data)
+	return err
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func (p *Provider) postToken(ctx context.Context, data url.Values) (*provider.Tokens, error) {
+	meta, _, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.post(ctx, meta, meta.TokenEndpoint, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var tok tokenResponse
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, err
+	}
+
+	return &provider.Tokens{
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		IDToken:      tok.IDToken,
+	}, nil
+}
+
+// post sends an authenticated form to one of the provider's endpoints and
+// returns the body of a 200 answer. The client authenticates with HTTP Basic
+// unless the provider only supports client_secret_post.
+func (p *Provider) post(ctx context.Context, meta *metadata, endpoint string, data url.Values) ([]byte, error) {
+	basic := p.config.ClientSecret != "" &&
+		(len(meta.TokenAuthMethods) == 0 || slices.Contains(meta.TokenAuthMethods, "client_secret_basic"))
+	if !basic {
+		data.Set("client_id", p.config.ClientID)
+		if p.config.ClientSecret != "" {
+			data.Set("client_secret", p.config.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		// RFC 6749, section 2.3.1: both parts are form-encoded first.
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.config.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: oidc %s: %w", provider.ErrUnavailable, p.config.Name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, p.parseError(resp.StatusCode, body)
+	}
+
+	return body, nil
+}
+
+// parseError turns a failed answer into an error wrapping the provider.Err*
+// value it stands for.
+func (p *Provider) parseError(status int, body []byte) error {
+	var e struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	_ = json.Unmarshal(body, &e)
+
+	var target error
+	switch {
+	case e.Error == "invalid_grant", e.Error == "invalid_token":
+		target = provider.ErrInvalidGrant
+	case e.Error == "invalid_request":
+		target = provider.ErrInvalidRequest
+	case e.Error == "invalid_client", e.Error == "unauthorized_client":
+		target = provider.ErrClientRejected
+	case status >= 500:
+		target = provider.ErrUnavailable
+	}
+
+	msg := fmt.Sprintf("oidc %s: status %d", p.config.Name, status)
+	if e.Error != "" {
+		msg += ": " + e.Error
+		if e.ErrorDescription != "" {
+			msg += ": " + e.ErrorDescription
+		}
+	}
+	if target == nil {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%w: %s", target, msg)
+}
@@ -0,0 +1,140 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmirfield/auth-service/internals/oauthstate"
+	"github.com/jmirfield/auth-service/internals/oidc"
+	"github.com/jmirfield/auth-service/internals/oidc/oidctest"
+	"github.com/jmirfield/auth-service/internals/provider"
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+func TestVerifyIDToken(t *testing.T) {
+	fake := oidctest.NewServer()
+	defer fake.Close()
+
+	ctx := context.Background()
+	valid := oidctest.Identity{
+		Subject: "00u1", Email: "jane@corp.example", EmailVerified: true, GivenName: "Jane", Nonce: "n-1",
+		Claims: map[string]any{"groups": []string{"admins", "staff"}},
+	}
+
+	tests := []struct {
+		name      string
+		cfg       func(*oidc.Config)
+		id        func(*oidctest.Identity)
+		nonce     string
+		wantErr   bool
+		wantAttrs map[string]string
+	}{
+		{
+			name: "valid", nonce: "n-1",
+			wantAttrs: map[string]string{storage.AttrEmail: "jane@corp.example", storage.AttrEmailVerified: "true", storage.AttrGivenName: "Jane"},
+		},
+		{name: "nonce mismatch", nonce: "other", wantErr: true},
+		{name: "other audience", cfg: func(c *oidc.Config) { c.ClientID = "someone-else" }, wantErr: true},
+		{name: "other authorized party", id: func(id *oidctest.Identity) { id.Claims = map[string]any{"azp": "someone-else"} }, wantErr: true},
+		{name: "issuer not discovered", cfg: func(c *oidc.Config) { c.Issuer += "/tenant" }, wantErr: true},
+		{
+			name:      "claim mapping",
+			cfg:       func(c *oidc.Config) { c.Claims = map[string]string{"groups": "groups", storage.AttrEmail: "email"} },
+			wantAttrs: map[string]string{"groups": "admins,staff", storage.AttrEmail: "jane@corp.example"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := fake.Config()
+			if tt.cfg != nil {
+				tt.cfg(cfg)
+			}
+			p, err := oidc.NewProvider(cfg)
+			if err != nil {
+				t.Fatalf("NewProvider: %v", err)
+			}
+
+			id := valid
+			if tt.id != nil {
+				tt.id(&id)
+			}
+
+			got, err := p.VerifyIDToken(ctx, fake.IDToken(id), tt.nonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyIDToken: %v", err)
+			}
+			if got.Subject != id.Subject {
+				t.Fatalf("subject: got %q, want %q", got.Subject, id.Subject)
+			}
+			if tt.wantAttrs != nil && len(got.Attrs) != len(tt.wantAttrs) {
+				t.Fatalf("attrs: got %v, want %v", got.Attrs, tt.wantAttrs)
+			}
+			for k, v := range tt.wantAttrs {
+				if got.Attrs[k] != v {
+					t.Fatalf("attr %s: got %q, want %q (all: %v)", k, got.Attrs[k], v, got.Attrs)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	fake := oidctest.NewServer()
+	defer fake.Close()
+
+	ctx := context.Background()
+	p, err := oidc.NewProvider(fake.Config())
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+
+	// What the handler keeps server side for the state.
+	st := oauthstate.State{Nonce: "n-1", CodeVerifier: "verifier-with-enough-entropy-0123456789"}
+	authorize := func() string {
+		u, err := p.AuthorizeURL(ctx, "state-1", st.Nonce, st.CodeChallenge())
+		if err != nil {
+			t.Fatalf("AuthorizeURL: %v", err)
+		}
+		q, err := fake.Authorize(u, oidctest.Identity{Subject: "00u1"})
+		if err != nil {
+			t.Fatalf("Authorize: %v", err)
+		}
+		if q.Get("state") != "state-1" {
+			t.Fatalf("state not passed through: %v", q)
+		}
+		return q.Get("code")
+	}
+
+	if _, err := p.ExchangeCode(ctx, provider.Code{Code: authorize(), CodeVerifier: "wrong"}); !errors.Is(err, provider.ErrInvalidGrant) {
+		t.Fatalf("wrong verifier: expected ErrInvalidGrant, got %v", err)
+	}
+
+	tok, err := p.ExchangeCode(ctx, provider.Code{Code: authorize(), CodeVerifier: st.CodeVerifier})
+	if err != nil {
+		t.Fatalf("ExchangeCode: %v", err)
+	}
+	if id, err := p.VerifyIDToken(ctx, tok.IDToken, st.Nonce); err != nil || id.Subject != "00u1" {
+		t.Fatalf("VerifyIDToken: %+v, %v", id, err)
+	}
+
+	if _, err := p.Refresh(ctx, tok.RefreshToken, ""); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if err := p.Revoke(ctx, tok.RefreshToken, ""); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if !fake.Revoked(tok.RefreshToken) {
+		t.Fatalf("token not revoked at the provider")
+	}
+	if _, err := p.Refresh(ctx, tok.RefreshToken, ""); !errors.Is(err, provider.ErrInvalidGrant) {
+		t.Fatalf("revoked token: expected ErrInvalidGrant, got %v", err)
+	}
+}
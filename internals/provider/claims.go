@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// reserved are names a configured provider cannot take: they belong to the
+// built in providers or to other routes under /auth.
+var reserved = []string{storage.ProviderApple, storage.ProviderGoogle, "refresh", "revoke", "nonce", "account", "link", "identities"}
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// CheckName reports whether name can be given to a configured provider.
+func CheckName(name string) error {
+	if !validName.MatchString(name) || slices.Contains(reserved, name) {
+		return fmt.Errorf("invalid provider name %q", name)
+	}
+	return nil
+}
+
+// MapClaims picks the attributes mapping names out of claims: each key of
+// mapping is an attribute, each value the claim it is read from, with dots
+// reaching into nested objects. Claims that are missing or not a string,
+// boolean, number or list of strings are left out.
+func MapClaims(claims map[string]any, mapping map[string]string) map[string]string {
+	attrs := map[string]string{}
+	for attr, claim := range mapping {
+		if v, ok := ClaimString(lookup(claims, claim)); ok {
+			attrs[attr] = v
+		}
+	}
+	return attrs
+}
+
+func lookup(claims map[string]any, path string) any {
+	var v any = claims
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = obj[key]
+	}
+	return v
+}
+
+// ClaimString renders a claim as an attribute value. Lists of strings, like
+// groups, are joined with commas.
+func ClaimString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), len(parts) > 0
+	}
+	return "", false
+}
+
+// ParseClaims reads a claims mapping from comma separated attr=claim pairs,
+// e.g. "email=upn,groups=groups", on top of a copy of base.
+func ParseClaims(s string, base map[string]string) (map[string]string, error) {
+	mapping := maps.Clone(base)
+	if mapping == nil {
+		mapping = map[string]string{}
+	}
+	for _, pair := range strings.Split(s, ",") {
+		attr, claim, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || attr == "" || claim == "" {
+			return nil, errors.New("want attr=claim pairs")
+		}
+		mapping[attr] = claim
+	}
+	return mapping, nil
+}
@@ -0,0 +1,28 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+var defaultHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+// HTTPClient returns c, or the client providers are called with by default
+// if c is nil, which gives up after 5 seconds. Requests also end when the
+// caller's context does.
+func HTTPClient(c *http.Client) *http.Client {
+	if c == nil {
+		return defaultHTTPClient
+	}
+	return c
+}
+
+// NoUserInfo is embedded by providers whose ID token or user info API says
+// everything there is to know, so that user details forwarded along with a
+// sign in add nothing.
+type NoUserInfo struct{}
+
+func (NoUserInfo) UserInfo(json.RawMessage) (map[string]string, error) {
+	return nil, nil
+}
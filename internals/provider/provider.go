@@ -0,0 +1,92 @@
+// Package provider is what the service needs from an identity provider, such
+// as Apple or Google, to sign users in and look after the tokens it issues.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Provider signs users in with an identity provider and manages the refresh
+// tokens it hands out. Errors wrap the Err* values below where one applies.
+type Provider interface {
+	// ExchangeCode redeems an authorization code.
+	ExchangeCode(ctx context.Context, code Code) (*Tokens, error)
+	// VerifyIDToken checks an ID token and, if nonce is set, that the token
+	// was issued for it.
+	VerifyIDToken(ctx context.Context, idToken, nonce string) (*Identity, error)
+	// UserInfo turns user details the client forwards along with the sign
+	// in, like the user object Apple only hands out the first time, into
+	// attributes. raw may be empty.
+	UserInfo(raw json.RawMessage) (map[string]string, error)
+	// Refresh redeems a refresh token issued to clientID, which is empty if
+	// the provider has a single client.
+	Refresh(ctx context.Context, refreshToken, clientID string) (*Tokens, error)
+	// Revoke invalidates a refresh token issued to clientID.
+	Revoke(ctx context.Context, refreshToken, clientID string) error
+}
+
+// NonceRequirer is implemented by providers that are configured to refuse
+// sign ins without a nonce.
+type NonceRequirer interface {
+	RequireNonce() bool
+}
+
+// Authorizer is implemented by providers that sign users in through the
+// browser: the service redirects to AuthorizeURL and the provider sends the
+// code back to the service's redirect URI.
+type Authorizer interface {
+	AuthorizeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error)
+}
+
+// UserInfoFetcher is implemented by plain OAuth2 providers, which issue no ID
+// token: the user is identified by calling the provider's API with the
+// access token instead.
+type UserInfoFetcher interface {
+	FetchUserInfo(ctx context.Context, accessToken string) (*Identity, error)
+}
+
+// Code is an authorization code and what it was issued for.
+type Code struct {
+	Code string
+	// ClientID is the client the code was issued to. Empty means the
+	// provider's default client.
+	ClientID string
+	// RedirectURI and CodeVerifier are set for codes from a web flow.
+	RedirectURI  string
+	CodeVerifier string
+}
+
+// Tokens are what a provider answers a code or refresh token with.
+type Tokens struct {
+	AccessToken  string
+	RefreshToken string
+	IDToken      string
+	// ClientID is the client the tokens were issued to, if the provider has
+	// several. It must be passed back to Refresh and Revoke.
+	ClientID string
+}
+
+// Identity is a signed-in user as the provider describes them. Attrs uses the
+// storage.Attr* keys; details the provider did not share are left out.
+type Identity struct {
+	Subject string
+	Attrs   map[string]string
+}
+
+var (
+	// ErrUnknownClient means the client id is not one the provider is
+	// configured with.
+	ErrUnknownClient = errors.New("provider: unknown client")
+	// ErrInvalidGrant means the code or refresh token is invalid, expired,
+	// already used or revoked.
+	ErrInvalidGrant = errors.New("provider: invalid grant")
+	// ErrInvalidRequest means the provider found the request malformed.
+	ErrInvalidRequest = errors.New("provider: invalid request")
+	// ErrClientRejected means the provider rejected this service's client
+	// credentials.
+	ErrClientRejected = errors.New("provider: client rejected")
+	// ErrUnavailable means the provider could not be reached or kept failing.
+	ErrUnavailable = errors.New("provider: unavailable")
+)
@@ -0,0 +1,24 @@
+package provider
+
+// Registry holds the configured providers by name, one of the
+// storage.Provider* constants. Providers are registered at startup; a
+// Registry is safe for concurrent lookups after that.
+type Registry struct {
+	providers map[string]Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]Provider)}
+}
+
+// Register adds p under name, replacing any provider already registered
+// under it.
+func (r *Registry) Register(name string, p Provider) {
+	r.providers[name] = p
+}
+
+// Get returns the provider registered under name.
+func (r *Registry) Get(name string) (Provider, bool) {
+	p, ok := r.providers[name]
+	return p, ok
+}
@@ -1,24 +1,73 @@
 package session
 
 import (
+	"crypto"
 	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Secret          string
+	// Secret is the HS256 signing secret. It is only used when no PrivateKey
+	// is configured.
+	Secret string
+	// PrivateKey is an RSA, ECDSA P-256 or Ed25519 key; tokens are then
+	// signed with RS256, ES256 or EdDSA and can be verified with the public
+	// half alone.
+	PrivateKey crypto.PrivateKey
+	// Keys is the signing keyring. When set it replaces Secret and
+	// PrivateKey: the key named by ActiveKeyID signs new tokens and the
+	// others only verify them.
+	Keys        []Key
+	ActiveKeyID string
+	// KeyGrace is how long a retired key keeps verifying. It defaults to
+	// RefreshLifetime so every token it signed can run its course.
+	KeyGrace        time.Duration
 	Issuer          string
 	Audience        string
 	AccessLifetime  time.Duration
 	RefreshLifetime time.Duration
 	ClockSkewLeeway time.Duration
+	// AccessAttrs lists the stored user attributes, e.g. email, that are
+	// copied into access tokens. Everything else stays server side.
+	AccessAttrs []string
 }
 
 // Validate checks that required fields are present.
 func (c *Config) Validate() error {
-	if c.Secret == "" {
-		return errors.New("missing required session secret env var")
+	if len(c.Keys) == 0 && c.Secret == "" && c.PrivateKey == nil {
+		return errors.New("missing required session secret, private key or keys env var")
+	}
+
+	keys, active := c.keyring()
+	seen := make(map[string]bool, len(keys))
+	activeFound := false
+	for _, k := range keys {
+		sk, err := newSigningKey(k)
+		if err != nil {
+			return err
+		}
+		if seen[sk.id] {
+			return fmt.Errorf("duplicate session key id %q", sk.id)
+		}
+		seen[sk.id] = true
+
+		if k.ID == active {
+			if !k.RetiredAt.IsZero() {
+				return fmt.Errorf("active session key %q is retired", active)
+			}
+			activeFound = true
+		}
+	}
+
+	if !activeFound {
+		return fmt.Errorf("active session key %q not found", active)
+	}
+
+	if c.KeyGrace < 0 {
+		return errors.New("invalid session key grace env var")
 	}
 
 	if c.Issuer == "" {
@@ -44,6 +93,23 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// keyring returns the configured keys and the id of the one that signs. The
+// single Secret or PrivateKey form is a keyring of one key.
+func (c *Config) keyring() ([]Key, string) {
+	if len(c.Keys) > 0 {
+		if c.ActiveKeyID == "" && len(c.Keys) == 1 {
+			return c.Keys, c.Keys[0].ID
+		}
+		return c.Keys, c.ActiveKeyID
+	}
+
+	if c.PrivateKey != nil {
+		return []Key{{PrivateKey: c.PrivateKey}}, ""
+	}
+
+	return []Key{{Secret: []byte(c.Secret)}}, ""
+}
+
 func Load() (*Config, error) {
 	cfg := &Config{
 		Secret:   os.Getenv("APP_JWT_SECRET"),
@@ -51,6 +117,39 @@ func Load() (*Config, error) {
 		Audience: os.Getenv("APP_JWT_AUDIENCE"),
 	}
 
+	if path := os.Getenv("APP_JWT_PRIVATE_KEY_PATH"); path != "" {
+		var err error
+		cfg.PrivateKey, err = readPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keysFile, keysDir := os.Getenv("APP_JWT_KEYS_FILE"), os.Getenv("APP_JWT_KEYS_DIR")
+	switch {
+	case keysFile != "" && keysDir != "":
+		return nil, errors.New("set only one of APP_JWT_KEYS_FILE and APP_JWT_KEYS_DIR")
+	case keysFile != "":
+		var err error
+		cfg.Keys, cfg.ActiveKeyID, err = LoadKeysFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+	case keysDir != "":
+		var err error
+		cfg.Keys, err = LoadKeysDir(keysDir)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ActiveKeyID = os.Getenv("APP_JWT_ACTIVE_KID")
+	}
+
+	if s := os.Getenv("APP_JWT_KEY_GRACE"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			cfg.KeyGrace = d
+		}
+	}
+
 	if s := os.Getenv("APP_JWT_ACCESS_LIFETIME"); s != "" {
 		if d, err := time.ParseDuration(s); err == nil && d > 0 {
 			cfg.AccessLifetime = d
@@ -63,6 +162,14 @@ func Load() (*Config, error) {
 		}
 	}
 
+	if s := os.Getenv("APP_JWT_ACCESS_ATTRS"); s != "" {
+		for _, a := range strings.Split(s, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				cfg.AccessAttrs = append(cfg.AccessAttrs, a)
+			}
+		}
+	}
+
 	if s := os.Getenv("APP_JWT_CLOCK_SKEW_LEEWAY"); s != "" {
 		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
 			cfg.ClockSkewLeeway = d
@@ -0,0 +1,124 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// JWK is the public half of a session signing key as published in the JWKS.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that verify session tokens: the active key,
+// keys not yet signing and retired keys still within their grace period.
+// HS256 secrets are never published, so the set is empty for a shared secret.
+func (m *Manager) JWKS() JWKS {
+	out := JWKS{Keys: []JWK{}}
+	now := time.Now()
+	for _, sk := range m.keys {
+		if _, shared := sk.verifyKey.([]byte); shared || !sk.verifiesAt(now, m.keyGrace) {
+			continue
+		}
+
+		k, err := publicJWK(sk.verifyKey)
+		if err != nil {
+			continue
+		}
+
+		k.Kid = sk.id
+		k.Alg = sk.method.Alg()
+		k.Use = "sig"
+		out.Keys = append(out.Keys, k)
+	}
+	return out
+}
+
+// publicJWK encodes the key material of pub, leaving kid, alg and use unset.
+func publicJWK(pub any) (JWK, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   b64(k.N.Bytes()),
+			E:   b64(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Crv: k.Curve.Params().Name,
+			X:   b64(k.X.FillBytes(make([]byte, size))),
+			Y:   b64(k.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(k)}, nil
+	default:
+		return JWK{}, errors.New("unsupported public key type")
+	}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint of pub, which serves as the
+// key id.
+func thumbprint(pub any) (string, error) {
+	k, err := publicJWK(pub)
+	if err != nil {
+		return "", err
+	}
+
+	// Required members only, in lexicographic order, no whitespace.
+	var members any
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	}
+
+	raw, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
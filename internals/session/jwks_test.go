@@ -0,0 +1,110 @@
+package session
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Example key from RFC 7638 section 3.1.
+func TestThumbprint_RFC7638Vector(t *testing.T) {
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatalf("decode n: %v", err)
+	}
+
+	got, err := thumbprint(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+	if err != nil {
+		t.Fatalf("thumbprint: %v", err)
+	}
+
+	const want = "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"
+	if got != want {
+		t.Fatalf("thumbprint = %q, want %q", got, want)
+	}
+}
+
+func TestJWKS_VerifiesIssuedTokens(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519 key: %v", err)
+	}
+
+	for _, key := range []crypto.PrivateKey{rsaKey, ecKey, edKey} {
+		mgr := newTestMgr(t, func(c *Config) {
+			c.Secret = ""
+			c.PrivateKey = key
+		})
+
+		set := mgr.JWKS()
+		if len(set.Keys) != 1 {
+			t.Fatalf("got %d keys, want 1", len(set.Keys))
+		}
+		k := set.Keys[0]
+		if k.Kid == "" || k.Use != "sig" || k.Alg != mgr.method.Alg() {
+			t.Fatalf("unexpected jwk metadata: %+v", k)
+		}
+
+		access, err := mgr.IssueAccess("uid1", nil)
+		if err != nil {
+			t.Fatalf("IssueAccess: %v", err)
+		}
+
+		// Verify the way a downstream service would: pick the key by kid and
+		// rebuild it from the published members only.
+		_, err = jwt.Parse(access, func(tok *jwt.Token) (any, error) {
+			if tok.Header["kid"] != k.Kid {
+				t.Fatalf("token kid %v, want %q", tok.Header["kid"], k.Kid)
+			}
+			return jwkPublicKey(t, k), nil
+		}, jwt.WithValidMethods([]string{k.Alg}))
+		if err != nil {
+			t.Fatalf("%s: verify with published key: %v", k.Alg, err)
+		}
+	}
+}
+
+func TestJWKS_EmptyForSharedSecret(t *testing.T) {
+	mgr := newTestMgr(t)
+	if keys := mgr.JWKS().Keys; keys == nil || len(keys) != 0 {
+		t.Fatalf("expected an empty, non-nil key list for HS256, got %#v", keys)
+	}
+}
+
+func jwkPublicKey(t *testing.T, k JWK) any {
+	t.Helper()
+	dec := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("decode jwk member: %v", err)
+		}
+		return b
+	}
+
+	switch k.Kty {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(dec(k.N)), E: int(new(big.Int).SetBytes(dec(k.E)).Int64())}
+	case "EC":
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(dec(k.X)), Y: new(big.Int).SetBytes(dec(k.Y))}
+	case "OKP":
+		return ed25519.PublicKey(dec(k.X))
+	}
+	t.Fatalf("unexpected kty %q", k.Kty)
+	return nil
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is one entry of the session signing keyring. Exactly one of Secret and
+// PrivateKey must be set.
+type Key struct {
+	// ID is stamped into the kid header of the tokens the key signs. It
+	// defaults to the RFC 7638 thumbprint for asymmetric keys.
+	ID         string
+	Secret     []byte
+	PrivateKey crypto.PrivateKey
+	// RetiredAt marks when the key stopped signing. It keeps verifying for
+	// the configured grace period afterwards. Zero means the key verifies for
+	// as long as it is configured.
+	RetiredAt time.Time
+}
+
+// signingKey is a Key resolved to its JWT signing method.
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+	retiredAt time.Time
+}
+
+func newSigningKey(k Key) (signingKey, error) {
+	if (len(k.Secret) == 0) == (k.PrivateKey == nil) {
+		return signingKey{}, fmt.Errorf("session key %q must set exactly one of secret or private key", k.ID)
+	}
+
+	if len(k.Secret) > 0 {
+		return signingKey{
+			id:        k.ID,
+			method:    jwt.SigningMethodHS256,
+			signKey:   k.Secret,
+			verifyKey: k.Secret,
+			retiredAt: k.RetiredAt,
+		}, nil
+	}
+
+	method, pub, err := signingMethodFor(k.PrivateKey)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	id := k.ID
+	if id == "" {
+		if id, err = thumbprint(pub); err != nil {
+			return signingKey{}, err
+		}
+	}
+
+	return signingKey{
+		id:        id,
+		method:    method,
+		signKey:   k.PrivateKey,
+		verifyKey: pub,
+		retiredAt: k.RetiredAt,
+	}, nil
+}
+
+// verifiesAt reports whether tokens signed with k are still accepted at now.
+func (k signingKey) verifiesAt(now time.Time, grace time.Duration) bool {
+	return k.retiredAt.IsZero() || now.Before(k.retiredAt.Add(grace))
+}
+
+// keyFor selects the verification key for t by its kid header. Tokens without
+// a kid, such as those issued before key rotation was configured, are checked
+// against every usable key of the same algorithm.
+func (m *Manager) keyFor(t *jwt.Token) (any, error) {
+	now := time.Now()
+	kid, _ := t.Header["kid"].(string)
+
+	var set jwt.VerificationKeySet
+	for _, k := range m.keys {
+		if k.method.Alg() != t.Method.Alg() || !k.verifiesAt(now, m.keyGrace) {
+			continue
+		}
+		if kid == "" {
+			set.Keys = append(set.Keys, k.verifyKey)
+			continue
+		}
+		if k.id == kid {
+			return k.verifyKey, nil
+		}
+	}
+
+	if len(set.Keys) == 0 {
+		return nil, errors.New("unknown signing key")
+	}
+
+	return set, nil
+}
+
+type keysFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID             string    `json:"kid"`
+		PrivateKeyPath string    `json:"private_key_path"`
+		Secret         string    `json:"secret"`
+		RetiredAt      time.Time `json:"retired_at"`
+	} `json:"keys"`
+}
+
+// LoadKeysFile reads a JSON keyring of the form
+//
+//	{
+//	  "active": "2025-06",
+//	  "keys": [
+//	    {"kid": "2025-06", "private_key_path": "2025-06.pem"},
+//	    {"kid": "2025-01", "private_key_path": "2025-01.pem", "retired_at": "2025-06-01T00:00:00Z"},
+//	    {"kid": "legacy", "secret": "...", "retired_at": "2025-01-01T00:00:00Z"}
+//	  ]
+//	}
+//
+// and returns its keys and the active key id. Relative key paths are resolved
+// against the file's directory.
+func LoadKeysFile(path string) ([]Key, string, error) {
+	raw, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var f keysFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, "", fmt.Errorf("parse session keys file: %w", err)
+	}
+
+	keys := make([]Key, 0, len(f.Keys))
+	for _, e := range f.Keys {
+		k := Key{ID: e.ID, Secret: []byte(e.Secret), RetiredAt: e.RetiredAt}
+		if e.PrivateKeyPath != "" {
+			p := e.PrivateKeyPath
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(filepath.Dir(path), p)
+			}
+			if k.PrivateKey, err = readPrivateKey(p); err != nil {
+				return nil, "", fmt.Errorf("session key %q: %w", e.ID, err)
+			}
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, f.Active, nil
+}
+
+// LoadKeysDir loads every <kid>.pem private key in dir. None of them is
+// retired; each keeps verifying until its file is removed.
+func LoadKeysDir(dir string) ([]Key, error) {
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".pem" {
+			continue
+		}
+
+		key, err := readPrivateKey(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("session key %s: %w", e.Name(), err)
+		}
+		keys = append(keys, Key{ID: strings.TrimSuffix(e.Name(), ".pem"), PrivateKey: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no session keys found in " + dir)
+	}
+
+	return keys, nil
+}
+
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	pemBytes, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePrivateKeyPEM(pemBytes)
+}
@@ -0,0 +1,259 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeyring_RotationKeepsOldTokensValid(t *testing.T) {
+	oldKey := Key{ID: "k1", Secret: []byte("old-secret-32-bytes-minimum-please")}
+	newKey := Key{ID: "k2", Secret: []byte("new-secret-32-bytes-minimum-please")}
+
+	before := newTestMgr(t, func(c *Config) {
+		c.Keys = []Key{oldKey}
+	})
+	oldTok, err := before.IssueRefresh("uid1")
+	if err != nil {
+		t.Fatalf("IssueRefresh: %v", err)
+	}
+
+	oldKey.RetiredAt = time.Now()
+	after := newTestMgr(t, func(c *Config) {
+		c.Keys = []Key{newKey, oldKey}
+		c.ActiveKeyID = "k2"
+	})
+
+	if _, err := after.ParseRefresh(oldTok); err != nil {
+		t.Fatalf("token signed by retired key within grace: %v", err)
+	}
+
+	newTok, err := after.IssueAccess("uid1", nil)
+	if err != nil {
+		t.Fatalf("IssueAccess: %v", err)
+	}
+	if kid := tokenKid(t, newTok); kid != "k2" {
+		t.Fatalf("new token kid = %q, want k2", kid)
+	}
+
+	// Once the grace period is over the retired key stops verifying.
+	oldKey.RetiredAt = time.Now().Add(-time.Hour)
+	expired := newTestMgr(t, func(c *Config) {
+		c.Keys = []Key{newKey, oldKey}
+		c.ActiveKeyID = "k2"
+		c.KeyGrace = time.Minute
+	})
+	if _, err := expired.ParseRefresh(oldTok); err == nil {
+		t.Fatalf("expected token signed by expired key to be rejected")
+	}
+	if _, err := expired.ParseAccess(newTok); err != nil {
+		t.Fatalf("active key token: %v", err)
+	}
+}
+
+func TestKeyring_SelectsKeyByKid(t *testing.T) {
+	k1 := Key{ID: "k1", Secret: []byte("secret-one-32-bytes-minimum-please")}
+	k2 := Key{ID: "k2", Secret: []byte("secret-two-32-bytes-minimum-please")}
+
+	mgr := newTestMgr(t, func(c *Config) {
+		c.Keys = []Key{k1, k2}
+		c.ActiveKeyID = "k1"
+	})
+	tok, err := mgr.IssueAccess("uid1", nil)
+	if err != nil {
+		t.Fatalf("IssueAccess: %v", err)
+	}
+
+	// A token claiming to be signed by k2 must not be verified with k1.
+	parsed, _, err := jwt.NewParser().ParseUnverified(tok, &Claims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	parsed.Header["kid"] = "k2"
+	forged, err := parsed.SignedString(k1.Secret)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := mgr.ParseAccess(forged); err == nil {
+		t.Fatalf("expected token with mismatched kid to be rejected")
+	}
+
+	parsed.Header["kid"] = "unknown"
+	unknown, err := parsed.SignedString(k1.Secret)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := mgr.ParseAccess(unknown); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("expected unknown signing key error, got %v", err)
+	}
+}
+
+func TestKeyring_AcceptsTokensWithoutKid(t *testing.T) {
+	legacy := newTestMgr(t)
+	tok, err := legacy.IssueAccess("uid1", nil)
+	if err != nil {
+		t.Fatalf("IssueAccess: %v", err)
+	}
+	if kid := tokenKid(t, tok); kid != "" {
+		t.Fatalf("single secret should not stamp a kid, got %q", kid)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519 key: %v", err)
+	}
+	mgr := newTestMgr(t, func(c *Config) {
+		c.Keys = []Key{
+			{ID: "new", PrivateKey: edKey},
+			{ID: "legacy", Secret: hmacKey(t, legacy), RetiredAt: time.Now()},
+		}
+		c.ActiveKeyID = "new"
+	})
+
+	if _, err := mgr.ParseAccess(tok); err != nil {
+		t.Fatalf("legacy token without kid: %v", err)
+	}
+}
+
+func TestKeyring_JWKSIncludesKeysInGrace(t *testing.T) {
+	active, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+	retired, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+	gone, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+
+	mgr := newTestMgr(t, func(c *Config) {
+		c.Keys = []Key{
+			{ID: "retired", PrivateKey: retired, RetiredAt: time.Now()},
+			{ID: "gone", PrivateKey: gone, RetiredAt: time.Now().Add(-48 * time.Hour)},
+			{ID: "active", PrivateKey: active},
+			{ID: "legacy", Secret: []byte("secret"), RetiredAt: time.Now()},
+		}
+		c.ActiveKeyID = "active"
+		c.KeyGrace = 24 * time.Hour
+	})
+
+	var kids []string
+	for _, k := range mgr.JWKS().Keys {
+		kids = append(kids, k.Kid)
+	}
+	if strings.Join(kids, ",") != "active,retired" {
+		t.Fatalf("published kids = %v, want [active retired]", kids)
+	}
+}
+
+func TestConfig_ValidateKeyring(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Issuer:          "issuer.test",
+			Audience:        "aud.test",
+			AccessLifetime:  time.Minute,
+			RefreshLifetime: time.Hour,
+		}
+	}
+
+	cases := map[string][]Key{
+		"duplicate id":   {{ID: "a", Secret: []byte("x")}, {ID: "a", Secret: []byte("y")}},
+		"retired active": {{ID: "a", Secret: []byte("x"), RetiredAt: time.Now()}},
+		"missing active": {{ID: "b", Secret: []byte("x")}, {ID: "c", Secret: []byte("y")}},
+		"no material":    {{ID: "a"}},
+	}
+	for name, keys := range cases {
+		cfg := base()
+		cfg.Keys = keys
+		cfg.ActiveKeyID = "a"
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+
+	cfg := base()
+	cfg.Keys = []Key{{ID: "only", Secret: []byte("x")}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("single key without active id: %v", err)
+	}
+}
+
+func TestLoadKeysFileAndDir(t *testing.T) {
+	dir := t.TempDir()
+	writeECKey(t, filepath.Join(dir, "2025-06.pem"))
+	writeECKey(t, filepath.Join(dir, "2025-01.pem"))
+
+	keysJSON := `{
+		"active": "2025-06",
+		"keys": [
+			{"kid": "2025-06", "private_key_path": "2025-06.pem"},
+			{"kid": "2025-01", "private_key_path": "2025-01.pem", "retired_at": "2025-06-01T00:00:00Z"},
+			{"kid": "legacy", "secret": "s3cret"}
+		]
+	}`
+	path := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(path, []byte(keysJSON), 0o600); err != nil {
+		t.Fatalf("write keys file: %v", err)
+	}
+
+	keys, active, err := LoadKeysFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeysFile: %v", err)
+	}
+	if active != "2025-06" || len(keys) != 3 {
+		t.Fatalf("got active %q and %d keys", active, len(keys))
+	}
+	if keys[0].PrivateKey == nil || keys[1].RetiredAt.IsZero() || string(keys[2].Secret) != "s3cret" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+
+	keys, err = LoadKeysDir(dir)
+	if err != nil {
+		t.Fatalf("LoadKeysDir: %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "2025-01" || keys[1].ID != "2025-06" {
+		t.Fatalf("unexpected dir keys: %+v", keys)
+	}
+
+	if _, err := LoadKeysDir(t.TempDir()); err == nil {
+		t.Fatalf("expected error for empty key directory")
+	}
+}
+
+func tokenKid(t *testing.T, tok string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(tok, &Claims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func writeECKey(t *testing.T, path string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ParsePrivateKeyPEM parses a PEM encoded RSA, ECDSA or Ed25519 private key in
+// PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) form.
+func ParsePrivateKeyPEM(pemBytes []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+}
+
+// signingMethodFor picks the JWT signing method matching key and returns the
+// key to verify its signatures with.
+func signingMethodFor(key crypto.PrivateKey) (jwt.SigningMethod, any, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, nil, errors.New("rsa session key must be at least 2048 bits")
+		}
+		return jwt.SigningMethodRS256, &k.PublicKey, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, nil, errors.New("ecdsa session key must use curve P-256")
+		}
+		return jwt.SigningMethodES256, &k.PublicKey, nil
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, k.Public(), nil
+	default:
+		return nil, nil, errors.New("unsupported session private key type")
+	}
+}
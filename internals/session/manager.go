@@ -19,35 +19,98 @@ type Claims struct {
 	UserID    string            `json:"uid"`
 	Attrs     map[string]string `json:"attrs,omitempty"`
 	TokenType string            `json:"token_type"`
+	FamilyID  string            `json:"fam,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type Manager struct {
-	secret          []byte
+	// The active key signs new tokens.
+	method  jwt.SigningMethod
+	signKey any
+	kid     string
+
+	// keys verifies tokens, the active key first.
+	keys     []signingKey
+	algs     []string
+	keyGrace time.Duration
+
 	issuer          string
 	audience        string
 	accessTTL       time.Duration
 	refreshTTL      time.Duration
 	clockSkewLeeway time.Duration
+	accessAttrs     []string
 }
 
 func NewManager(cfg *Config) (*Manager, error) {
-	return &Manager{
-		secret:          []byte(cfg.Secret),
+	m := &Manager{
+		keyGrace:        cfg.KeyGrace,
 		issuer:          cfg.Issuer,
 		audience:        cfg.Audience,
 		accessTTL:       cfg.AccessLifetime,
 		refreshTTL:      cfg.RefreshLifetime,
 		clockSkewLeeway: cfg.ClockSkewLeeway,
-	}, nil
+		accessAttrs:     slices.Clone(cfg.AccessAttrs),
+	}
+	if m.keyGrace == 0 {
+		m.keyGrace = cfg.RefreshLifetime
+	}
+
+	keys, active := cfg.keyring()
+	for _, k := range keys {
+		sk, err := newSigningKey(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(m.algs, sk.method.Alg()) {
+			m.algs = append(m.algs, sk.method.Alg())
+		}
+
+		if k.ID != active || m.method != nil {
+			m.keys = append(m.keys, sk)
+			continue
+		}
+
+		m.method = sk.method
+		m.signKey = sk.signKey
+		m.kid = sk.id
+		m.keys = append([]signingKey{sk}, m.keys...)
+	}
+
+	if m.method == nil {
+		return nil, errors.New("active session key not found")
+	}
+
+	return m, nil
+}
+
+// HasAccessAttrs reports whether any user attributes go into access tokens.
+func (m *Manager) HasAccessAttrs() bool {
+	return len(m.accessAttrs) > 0
+}
+
+// AccessAttrs picks the attributes configured for access tokens out of attrs.
+func (m *Manager) AccessAttrs(attrs map[string]string) map[string]string {
+	var out map[string]string
+	for _, k := range m.accessAttrs {
+		if v, ok := attrs[k]; ok {
+			if out == nil {
+				out = make(map[string]string, len(m.accessAttrs))
+			}
+			out[k] = v
+		}
+	}
+	return out
 }
 
 func (m *Manager) IssueAccess(userID string, attrs map[string]string) (string, error) {
-	return m.issue(userID, attrs, tokenTypeAccess, m.accessTTL)
+	return m.issue(userID, attrs, tokenTypeAccess, "", m.accessTTL)
 }
 
+// IssueRefresh issues a refresh token that starts a new token family.
 func (m *Manager) IssueRefresh(userID string) (string, error) {
-	return m.issue(userID, nil, tokenTypeRefresh, m.refreshTTL)
+	return m.issue(userID, nil, tokenTypeRefresh, newJTI(), m.refreshTTL)
 }
 
 func (m *Manager) IssuePair(userID string, attrs map[string]string) (access string, refresh string, err error) {
@@ -64,7 +127,7 @@ func (m *Manager) IssuePair(userID string, attrs map[string]string) (access stri
 	return access, refresh, nil
 }
 
-func (m *Manager) issue(userID string, attrs map[string]string, typ string, ttl time.Duration) (string, error) {
+func (m *Manager) issue(userID string, attrs map[string]string, typ, family string, ttl time.Duration) (string, error) {
 	if userID == "" {
 		return "", errors.New("empty userID")
 	}
@@ -81,14 +144,18 @@ func (m *Manager) issue(userID string, attrs map[string]string, typ string, ttl
 		ID:        newJTI(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+	token := jwt.NewWithClaims(m.method, Claims{
 		UserID:           userID,
 		Attrs:            attrs,
 		TokenType:        typ,
+		FamilyID:         family,
 		RegisteredClaims: rc,
 	})
+	if m.kid != "" {
+		token.Header["kid"] = m.kid
+	}
 
-	return token.SignedString(m.secret)
+	return token.SignedString(m.signKey)
 }
 
 func newJTI() string {
@@ -109,6 +176,8 @@ func (m *Manager) ParseRefresh(tokenString string) (*Claims, error) {
 	return m.parseTyped(tokenString, tokenTypeRefresh)
 }
 
+// RefreshFrom issues a new access token from a valid refresh token. When rotate
+// is set, a new refresh token is issued in the same family as the presented one.
 func (m *Manager) RefreshFrom(refreshToken string, attrs map[string]string, rotate bool) (newAccess, newRefresh string, err error) {
 	refreshClaims, err := m.ParseRefresh(refreshToken)
 	if err != nil {
@@ -121,7 +190,12 @@ func (m *Manager) RefreshFrom(refreshToken string, attrs map[string]string, rota
 	}
 
 	if rotate {
-		newRefresh, err = m.IssueRefresh(refreshClaims.UserID)
+		family := refreshClaims.FamilyID
+		if family == "" {
+			family = newJTI()
+		}
+
+		newRefresh, err = m.issue(refreshClaims.UserID, nil, tokenTypeRefresh, family, m.refreshTTL)
 		if err != nil {
 			return "", "", err
 		}
@@ -136,14 +210,12 @@ func (m *Manager) parseTyped(tokenString, wantType string) (*Claims, error) {
 	}
 
 	parser := jwt.NewParser(
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithValidMethods(m.algs),
 		jwt.WithLeeway(m.clockSkewLeeway),
 	)
 
 	claims := &Claims{}
-	_, err := parser.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
-		return m.secret, nil
-	})
+	_, err := parser.ParseWithClaims(tokenString, claims, m.keyFor)
 
 	if err != nil {
 		return nil, err
@@ -1,6 +1,14 @@
 package session
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"slices"
 	"strings"
@@ -31,6 +39,16 @@ func newTestMgr(t *testing.T, opts ...func(*Config)) *Manager {
 	return mgr
 }
 
+// hmacKey returns the HS256 key m signs new tokens with.
+func hmacKey(t *testing.T, m *Manager) []byte {
+	t.Helper()
+	key, ok := m.keys[0].signKey.([]byte)
+	if !ok {
+		t.Fatalf("active session key is not an HS256 secret")
+	}
+	return key
+}
+
 func TestIssueAndParseAccess(t *testing.T) {
 	mgr := newTestMgr(t)
 
@@ -97,7 +115,7 @@ func TestInvalidIssuer(t *testing.T) {
 	// Parse with issuer B (same secret & aud) -> should fail issuer check
 	issuerB := newTestMgr(t, func(c *Config) {
 		c.Issuer = "issuerB"
-		c.Secret = string(issuerA.secret) // keep same secret to pass signature
+		c.Secret = string(hmacKey(t, issuerA)) // keep same secret to pass signature
 	})
 	_, err = issuerB.ParseAccess(tok)
 	if err == nil || !strings.Contains(err.Error(), "invalid issuer") {
@@ -115,7 +133,7 @@ func TestInvalidAudience(t *testing.T) {
 	// Parse with audience B (same secret & issuer) -> should fail audience check
 	audB := newTestMgr(t, func(c *Config) {
 		c.Audience = "audB"
-		c.Secret = string(audA.secret)
+		c.Secret = string(hmacKey(t, audA))
 		c.Issuer = audA.issuer
 	})
 	_, err = audB.ParseAccess(tok)
@@ -223,7 +241,7 @@ func TestExpiredTokenRejected(t *testing.T) {
 	}
 
 	tk := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := tk.SignedString(mgr.secret)
+	signed, err := tk.SignedString(hmacKey(t, mgr))
 	if err != nil {
 		t.Fatalf("sign expired token: %v", err)
 	}
@@ -236,3 +254,161 @@ func TestExpiredTokenRejected(t *testing.T) {
 		t.Fatalf("expected jwt.ErrTokenExpired, got %v", err)
 	}
 }
+
+func TestRefreshFrom_RotateKeepsFamily(t *testing.T) {
+	mgr := newTestMgr(t)
+
+	first, err := mgr.IssueRefresh("uid-xyz")
+	if err != nil {
+		t.Fatalf("IssueRefresh: %v", err)
+	}
+	firstClaims, err := mgr.ParseRefresh(first)
+	if err != nil {
+		t.Fatalf("ParseRefresh(first): %v", err)
+	}
+	if firstClaims.FamilyID == "" {
+		t.Fatalf("expected refresh token to carry a family id")
+	}
+
+	_, rotated, err := mgr.RefreshFrom(first, nil, true)
+	if err != nil {
+		t.Fatalf("RefreshFrom: %v", err)
+	}
+	rotatedClaims, err := mgr.ParseRefresh(rotated)
+	if err != nil {
+		t.Fatalf("ParseRefresh(rotated): %v", err)
+	}
+	if rotatedClaims.FamilyID != firstClaims.FamilyID {
+		t.Fatalf("got family %q, want %q", rotatedClaims.FamilyID, firstClaims.FamilyID)
+	}
+	if rotatedClaims.ID == firstClaims.ID {
+		t.Fatalf("expected rotated token to have a new jti")
+	}
+
+	other, err := mgr.IssueRefresh("uid-xyz")
+	if err != nil {
+		t.Fatalf("IssueRefresh: %v", err)
+	}
+	otherClaims, err := mgr.ParseRefresh(other)
+	if err != nil {
+		t.Fatalf("ParseRefresh(other): %v", err)
+	}
+	if otherClaims.FamilyID == firstClaims.FamilyID {
+		t.Fatalf("expected a fresh login to start a new family")
+	}
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519 key: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		key  crypto.PrivateKey
+		alg  string
+	}{
+		{"RS256", rsaKey, "RS256"},
+		{"ES256", ecKey, "ES256"},
+		{"EdDSA", edKey, "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestMgr(t, func(c *Config) {
+				c.Secret = ""
+				c.PrivateKey = tt.key
+			})
+
+			access, refresh, err := mgr.IssuePair("uid1", nil)
+			if err != nil {
+				t.Fatalf("IssuePair: %v", err)
+			}
+
+			tok, _, err := jwt.NewParser().ParseUnverified(access, &Claims{})
+			if err != nil {
+				t.Fatalf("ParseUnverified: %v", err)
+			}
+			if tok.Method.Alg() != tt.alg {
+				t.Fatalf("got alg %q, want %q", tok.Method.Alg(), tt.alg)
+			}
+
+			if _, err := mgr.ParseAccess(access); err != nil {
+				t.Fatalf("ParseAccess: %v", err)
+			}
+			if _, err := mgr.ParseRefresh(refresh); err != nil {
+				t.Fatalf("ParseRefresh: %v", err)
+			}
+
+			// An HS256 token must not verify, whatever secret it used.
+			hs := newTestMgr(t)
+			hsTok, err := hs.IssueAccess("uid1", nil)
+			if err != nil {
+				t.Fatalf("IssueAccess(HS256): %v", err)
+			}
+			if _, err := mgr.ParseAccess(hsTok); err == nil {
+				t.Fatalf("expected HS256 token to be rejected by %s manager", tt.alg)
+			}
+		})
+	}
+}
+
+func TestAsymmetricSigning_RejectsUnsupportedKeys(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+
+	cfg := &Config{
+		PrivateKey:      p384,
+		Issuer:          "issuer.test",
+		Audience:        "aud.test",
+		AccessLifetime:  time.Minute,
+		RefreshLifetime: time.Hour,
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("expected P-384 key to be rejected")
+	}
+	if _, err := NewManager(cfg); err == nil {
+		t.Fatalf("expected NewManager to reject a P-384 key")
+	}
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa key: %v", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	for typ, der := range map[string][]byte{"PRIVATE KEY": pkcs8, "EC PRIVATE KEY": sec1} {
+		key, err := ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+		if err != nil {
+			t.Fatalf("ParsePrivateKeyPEM(%s): %v", typ, err)
+		}
+		if !ecKey.Equal(key) {
+			t.Fatalf("ParsePrivateKeyPEM(%s) returned a different key", typ)
+		}
+	}
+
+	if _, err := ParsePrivateKeyPEM([]byte("not pem")); err == nil {
+		t.Fatalf("expected error for non-PEM input")
+	}
+}
@@ -0,0 +1,635 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsersBucket   = []byte("users")
+	boltHashesBucket  = []byte("refresh_token_hashes") // hash -> user id
+	boltJTIsBucket    = []byte("refresh_token_jtis")   // jti -> hash
+	boltOneTimeBucket = []byte("one_time")             // key -> boltOneTime
+
+	boltIdentitiesBucket      = []byte("identities")       // provider:subject -> Identity
+	boltUserIdentitiesBucket  = []byte("user_identities")  // user id \0 provider:subject -> nothing
+	boltEmailIdentitiesBucket = []byte("email_identities") // email \0 provider:subject -> nothing
+)
+
+type boltOneTime struct {
+	Value     []byte    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BoltStore keeps records in a single bbolt file. Every write is a bolt
+// transaction, which is fsynced before it commits, so a crash leaves the file
+// at the last committed state.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (or creates) the database file at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{
+			boltUsersBucket, boltHashesBucket, boltJTIsBucket, boltOneTimeBucket,
+			boltIdentitiesBucket, boltUserIdentitiesBucket, boltEmailIdentitiesBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Put(ctx context.Context, userID string, r Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.UserID = userID
+	r.EnsureInit()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltWrite(tx, r)
+	})
+}
+
+func (s *BoltStore) Get(ctx context.Context, userID string) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	var r Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = boltRead(tx, userID)
+		return err
+	})
+	return r, err
+}
+
+func (s *BoltStore) Update(ctx context.Context, userID string, fn func(Record) Record) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	var out Record
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		curr, err := boltRead(tx, userID)
+		if err == ErrNotFound {
+			curr = Record{UserID: userID}
+			curr.EnsureInit()
+		} else if err != nil {
+			return err
+		}
+
+		next := fn(curr)
+		next.UserID = userID
+		next.EnsureInit()
+
+		if err := boltWrite(tx, next); err != nil {
+			return err
+		}
+
+		out = deepCopyRecord(next)
+		return nil
+	})
+	if err != nil {
+		return Record{}, err
+	}
+
+	return out, nil
+}
+
+func (s *BoltStore) Delete(ctx context.Context, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ids, err := boltScanIdentities(tx, boltUserIdentitiesBucket, userID)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := boltUnlinkIdentity(tx, id); err != nil {
+				return err
+			}
+		}
+
+		return boltDelete(tx, userID)
+	})
+}
+
+func (s *BoltStore) UserExists(ctx context.Context, userID string) (bool, error) {
+	return s.exists(ctx, boltUsersBucket, userID)
+}
+
+func (s *BoltStore) RefreshTokenExists(ctx context.Context, hash string) (bool, error) {
+	return s.exists(ctx, boltHashesBucket, hash)
+}
+
+func (s *BoltStore) exists(ctx context.Context, bucket []byte, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(bucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+// ForEach collects the user ids first so fn runs outside any transaction and
+// may write to the store.
+func (s *BoltStore) ForEach(ctx context.Context, fn func(Record) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var ids []string
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		r, err := s.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) PruneAllExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		total = 0
+
+		var recs []Record
+		if err := tx.Bucket(boltUsersBucket).ForEach(func(_, v []byte) error {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			recs = append(recs, r)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, r := range recs {
+			out := r.RefreshTokens[:0]
+			for _, rt := range r.RefreshTokens {
+				if rt.ExpiresAt.After(now) {
+					out = append(out, rt)
+					continue
+				}
+				if err := boltUnindex(tx, rt); err != nil {
+					return err
+				}
+				total++
+			}
+
+			if len(out) == len(r.RefreshTokens) {
+				continue
+			}
+			r.RefreshTokens = out
+			if err := boltPutRecord(tx, r); err != nil {
+				return err
+			}
+		}
+
+		// Deleting while iterating a bucket skips keys, so collect first.
+		oneTime := tx.Bucket(boltOneTimeBucket)
+		var expired [][]byte
+		if err := oneTime.ForEach(func(k, v []byte) error {
+			var ot boltOneTime
+			if err := json.Unmarshal(v, &ot); err != nil {
+				return err
+			}
+			if !ot.ExpiresAt.After(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := oneTime.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+func (s *BoltStore) PutOneTime(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(boltOneTime{Value: value, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOneTimeBucket).Put([]byte(key), b)
+	})
+}
+
+func (s *BoltStore) TakeOneTime(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var ot boltOneTime
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltOneTimeBucket)
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(v, &ot); err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !ot.ExpiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return ot.Value, nil
+}
+
+func (s *BoltStore) FindRefreshTokenByHash(ctx context.Context, hash string) (string, RefreshTokenRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return "", RefreshTokenRecord{}, err
+	}
+
+	var (
+		userID string
+		found  RefreshTokenRecord
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		uid := tx.Bucket(boltHashesBucket).Get([]byte(hash))
+		if uid == nil {
+			return ErrNotFound
+		}
+
+		r, err := boltRead(tx, string(uid))
+		if err != nil {
+			return err
+		}
+
+		for _, rt := range r.RefreshTokens {
+			if rt.Hash == hash {
+				userID, found = r.UserID, rt
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	if err != nil {
+		return "", RefreshTokenRecord{}, err
+	}
+
+	return userID, found, nil
+}
+
+func (s *BoltStore) RevokeRefreshTokenByJTI(ctx context.Context, userID, jti string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	revoked := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		revoked = false
+		hash := tx.Bucket(boltJTIsBucket).Get([]byte(jti))
+		if hash == nil || string(tx.Bucket(boltHashesBucket).Get(hash)) != userID {
+			return nil
+		}
+
+		r, err := boltRead(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		out := r.RefreshTokens[:0]
+		for _, rt := range r.RefreshTokens {
+			if rt.JTI != jti {
+				out = append(out, rt)
+			}
+		}
+		r.RefreshTokens = out
+
+		revoked = true
+		return boltWrite(tx, r)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+func (s *BoltStore) ListRefreshTokens(ctx context.Context, userID string) ([]RefreshTokenRecord, error) {
+	r, err := s.Get(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.RefreshTokens) == 0 {
+		return nil, nil
+	}
+
+	return r.RefreshTokens, nil
+}
+
+func (s *BoltStore) LinkIdentity(ctx context.Context, id Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		prev, err := boltReadIdentity(tx, id.Provider, id.Subject)
+		switch {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			return err
+		case prev.UserID != id.UserID:
+			return ErrIdentityTaken
+		default:
+			if err := boltUnlinkIdentity(tx, prev); err != nil {
+				return err
+			}
+			prev.Email = id.Email
+			id = prev
+		}
+
+		v, err := json.Marshal(id)
+		if err != nil {
+			return err
+		}
+
+		k := boltIdentityKey(id.Provider, id.Subject)
+		if err := tx.Bucket(boltIdentitiesBucket).Put(k, v); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltUserIdentitiesBucket).Put(boltIndexKey(id.UserID, k), nil); err != nil {
+			return err
+		}
+		if id.Email == "" {
+			return nil
+		}
+		return tx.Bucket(boltEmailIdentitiesBucket).Put(boltIndexKey(id.Email, k), nil)
+	})
+}
+
+func (s *BoltStore) GetIdentity(ctx context.Context, provider, subject string) (Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return Identity{}, err
+	}
+
+	var id Identity
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		id, err = boltReadIdentity(tx, provider, subject)
+		return err
+	})
+	return id, err
+}
+
+func (s *BoltStore) ListIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	return s.scanIdentities(ctx, boltUserIdentitiesBucket, userID)
+}
+
+func (s *BoltStore) FindIdentitiesByEmail(ctx context.Context, email string) ([]Identity, error) {
+	if email == "" {
+		return nil, ctx.Err()
+	}
+	return s.scanIdentities(ctx, boltEmailIdentitiesBucket, email)
+}
+
+func (s *BoltStore) scanIdentities(ctx context.Context, index []byte, value string) ([]Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var out []Identity
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		out, err = boltScanIdentities(tx, index, value)
+		return err
+	})
+	return out, err
+}
+
+func (s *BoltStore) UnlinkIdentity(ctx context.Context, userID, provider, subject string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	unlinked := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		unlinked = false
+		id, err := boltReadIdentity(tx, provider, subject)
+		if errors.Is(err, ErrNotFound) || (err == nil && id.UserID != userID) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		unlinked = true
+		return boltUnlinkIdentity(tx, id)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return unlinked, nil
+}
+
+func boltIdentityKey(provider, subject string) []byte {
+	return []byte(provider + ":" + subject)
+}
+
+// boltIndexKey is the key under which an index bucket lists identity k for
+// value, e.g. a user id; all of a value's keys share its prefix.
+func boltIndexKey(value string, k []byte) []byte {
+	return append([]byte(value+"\x00"), k...)
+}
+
+func boltReadIdentity(tx *bolt.Tx, provider, subject string) (Identity, error) {
+	v := tx.Bucket(boltIdentitiesBucket).Get(boltIdentityKey(provider, subject))
+	if v == nil {
+		return Identity{}, ErrNotFound
+	}
+
+	var id Identity
+	if err := json.Unmarshal(v, &id); err != nil {
+		return Identity{}, err
+	}
+	return id, nil
+}
+
+// boltScanIdentities returns the identities an index bucket lists for value.
+func boltScanIdentities(tx *bolt.Tx, index []byte, value string) ([]Identity, error) {
+	prefix := boltIndexKey(value, nil)
+	identities := tx.Bucket(boltIdentitiesBucket)
+
+	var out []Identity
+	c := tx.Bucket(index).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		v := identities.Get(k[len(prefix):])
+		if v == nil {
+			continue
+		}
+
+		var id Identity
+		if err := json.Unmarshal(v, &id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+
+	slices.SortFunc(out, compareIdentities)
+	return out, nil
+}
+
+func boltUnlinkIdentity(tx *bolt.Tx, id Identity) error {
+	k := boltIdentityKey(id.Provider, id.Subject)
+	if err := tx.Bucket(boltIdentitiesBucket).Delete(k); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltUserIdentitiesBucket).Delete(boltIndexKey(id.UserID, k)); err != nil {
+		return err
+	}
+	if id.Email == "" {
+		return nil
+	}
+	return tx.Bucket(boltEmailIdentitiesBucket).Delete(boltIndexKey(id.Email, k))
+}
+
+func boltRead(tx *bolt.Tx, userID string) (Record, error) {
+	v := tx.Bucket(boltUsersBucket).Get([]byte(userID))
+	if v == nil {
+		return Record{}, ErrNotFound
+	}
+
+	var r Record
+	if err := json.Unmarshal(v, &r); err != nil {
+		return Record{}, err
+	}
+
+	r.EnsureInit()
+	return r, nil
+}
+
+// boltWrite replaces the stored record and keeps the hash index in step with
+// the record's refresh tokens.
+func boltWrite(tx *bolt.Tx, r Record) error {
+	if err := boltDelete(tx, r.UserID); err != nil {
+		return err
+	}
+
+	hashes, jtis := tx.Bucket(boltHashesBucket), tx.Bucket(boltJTIsBucket)
+	for _, rt := range r.RefreshTokens {
+		if err := hashes.Put([]byte(rt.Hash), []byte(r.UserID)); err != nil {
+			return err
+		}
+		if err := jtis.Put([]byte(rt.JTI), []byte(rt.Hash)); err != nil {
+			return err
+		}
+	}
+
+	return boltPutRecord(tx, r)
+}
+
+func boltPutRecord(tx *bolt.Tx, r Record) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltUsersBucket).Put([]byte(r.UserID), v)
+}
+
+func boltDelete(tx *bolt.Tx, userID string) error {
+	prev, err := boltRead(tx, userID)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, rt := range prev.RefreshTokens {
+		if err := boltUnindex(tx, rt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(boltUsersBucket).Delete([]byte(userID))
+}
+
+func boltUnindex(tx *bolt.Tx, rt RefreshTokenRecord) error {
+	if err := tx.Bucket(boltHashesBucket).Delete([]byte(rt.Hash)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltJTIsBucket).Delete([]byte(rt.JTI))
+}
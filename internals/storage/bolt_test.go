@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBolt(t *testing.T) (*BoltStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "auth.db")
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s, path
+}
+
+func TestBolt_SurvivesReopen(t *testing.T) {
+	s, path := newTestBolt(t)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	if _, err := s.Update(ctx, "uid1", func(r Record) Record {
+		r.RefreshTokensByProvider[ProviderApple] = "enc"
+		r.RefreshTokens = append(r.RefreshTokens, RefreshTokenRecord{Hash: "h1", JTI: "j1", ExpiresAt: now.Add(time.Hour), CreatedAt: now})
+		return r
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.RefreshTokensByProvider[ProviderApple] != "enc" || len(got.RefreshTokens) != 1 {
+		t.Fatalf("record not persisted: %+v", got)
+	}
+
+	uid, rt, err := reopened.FindRefreshTokenByHash(ctx, "h1")
+	if err != nil || uid != "uid1" || rt.JTI != "j1" {
+		t.Fatalf("FindRefreshTokenByHash = %q, %+v, %v", uid, rt, err)
+	}
+}
+
+func TestBolt_HashIndexFollowsWrites(t *testing.T) {
+	s, _ := newTestBolt(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	if err := s.Put(ctx, "uid1", Record{RefreshTokens: []RefreshTokenRecord{
+		{Hash: "live", JTI: "j1", ExpiresAt: now.Add(time.Hour), CreatedAt: now},
+		{Hash: "dead", JTI: "j2", ExpiresAt: now.Add(-time.Hour), CreatedAt: now},
+	}}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	n, err := s.PruneAllExpired(ctx, now)
+	if err != nil || n != 1 {
+		t.Fatalf("PruneAllExpired = %d, %v; want 1, nil", n, err)
+	}
+	if _, _, err := s.FindRefreshTokenByHash(ctx, "dead"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected pruned hash to be unindexed, got %v", err)
+	}
+
+	if _, err := s.Update(ctx, "uid1", func(r Record) Record {
+		r.RotateRefreshToken("live", RefreshTokenRecord{Hash: "next", JTI: "j3", ExpiresAt: now.Add(time.Hour), CreatedAt: now})
+		return r
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, _, err := s.FindRefreshTokenByHash(ctx, "live"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected rotated hash to be unindexed, got %v", err)
+	}
+	if uid, _, err := s.FindRefreshTokenByHash(ctx, "next"); err != nil || uid != "uid1" {
+		t.Fatalf("FindRefreshTokenByHash(next) = %q, %v", uid, err)
+	}
+
+	if err := s.Delete(ctx, "uid1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := s.FindRefreshTokenByHash(ctx, "next"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected deleted user's hashes to be unindexed, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+const (
+	DriverMemory   = "memory"
+	DriverPostgres = "postgres"
+	DriverBolt     = "bolt"
+	DriverRedis    = "redis"
+)
+
+type Config struct {
+	Driver string
+	DSN    string
+	Path   string
+}
+
+// Validate checks that the selected driver is known and has what it needs.
+func (c *Config) Validate() error {
+	switch c.Driver {
+	case DriverMemory:
+		return nil
+	case DriverPostgres, DriverRedis:
+		if c.DSN == "" {
+			return errors.New("missing required storage dsn env var")
+		}
+		return nil
+	case DriverBolt:
+		if c.Path == "" {
+			return errors.New("missing required storage path env var")
+		}
+		return nil
+	default:
+		return errors.New("unknown storage driver")
+	}
+}
+
+func Load() (*Config, error) {
+	cfg := &Config{
+		Driver: os.Getenv("STORAGE_DRIVER"),
+		DSN:    os.Getenv("STORAGE_DSN"),
+		Path:   os.Getenv("STORAGE_PATH"),
+	}
+
+	if cfg.Driver == "" {
+		cfg.Driver = DriverMemory
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"maps"
+	"slices"
 	"sync"
 	"time"
 )
@@ -10,22 +12,60 @@ import (
 type MemoryStore struct {
 	mu   sync.RWMutex
 	data map[string]Record
+
+	// Secondary indexes over every record's refresh tokens, kept in step by
+	// store().
+	byHash map[string]memoryTokenRef // hash -> owner and token
+	byJTI  map[string]string         // jti -> hash
+
+	oneTime map[string]memoryOneTime
+
+	identities map[memoryIdentityKey]Identity
+}
+
+type memoryIdentityKey struct {
+	provider, subject string
+}
+
+type memoryOneTime struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+type memoryTokenRef struct {
+	userID string
+	token  RefreshTokenRecord
 }
 
 func NewMemoryStore() Store {
-	return &MemoryStore{data: make(map[string]Record)}
+	return &MemoryStore{
+		data:   make(map[string]Record),
+		byHash: make(map[string]memoryTokenRef),
+		byJTI:  make(map[string]string),
+
+		oneTime:    make(map[string]memoryOneTime),
+		identities: make(map[memoryIdentityKey]Identity),
+	}
 }
 
-func (s *MemoryStore) Put(_ context.Context, userID string, r Record) error {
+func (s *MemoryStore) Put(ctx context.Context, userID string, r Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	r.UserID = userID
 	r.EnsureInit()
-	s.data[userID] = deepCopyRecord(r)
+	s.store(userID, deepCopyRecord(r))
 	s.mu.Unlock()
 	return nil
 }
 
-func (s *MemoryStore) Get(_ context.Context, userID string) (Record, error) {
+func (s *MemoryStore) Get(ctx context.Context, userID string) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
 	s.mu.RLock()
 	r, ok := s.data[userID]
 	s.mu.RUnlock()
@@ -36,7 +76,11 @@ func (s *MemoryStore) Get(_ context.Context, userID string) (Record, error) {
 	return deepCopyRecord(r), nil
 }
 
-func (s *MemoryStore) Update(_ context.Context, userID string, fn func(Record) Record) (Record, error) {
+func (s *MemoryStore) Update(ctx context.Context, userID string, fn func(Record) Record) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
 	s.mu.Lock()
 
 	var curr Record
@@ -52,27 +96,142 @@ func (s *MemoryStore) Update(_ context.Context, userID string, fn func(Record) R
 	next.EnsureInit()
 
 	stored := deepCopyRecord(next)
-	s.data[userID] = stored
+	s.store(userID, stored)
 	s.mu.Unlock()
 
 	return deepCopyRecord(stored), nil
 }
 
-func (s *MemoryStore) Delete(_ context.Context, userID string) error {
+func (s *MemoryStore) Delete(ctx context.Context, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
+	s.unindex(userID)
 	delete(s.data, userID)
+	for k, id := range s.identities {
+		if id.UserID == userID {
+			delete(s.identities, k)
+		}
+	}
 	s.mu.Unlock()
 	return nil
 }
 
-func (s *MemoryStore) Exists(_ context.Context, userID string) (bool, error) {
+func (s *MemoryStore) UserExists(ctx context.Context, userID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
 	s.mu.RLock()
 	_, ok := s.data[userID]
 	s.mu.RUnlock()
 	return ok, nil
 }
 
-func (s *MemoryStore) PruneAllExpired(_ context.Context, now time.Time) (int, error) {
+func (s *MemoryStore) RefreshTokenExists(ctx context.Context, hash string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	_, ok := s.byHash[hash]
+	s.mu.RUnlock()
+	return ok, nil
+}
+
+func (s *MemoryStore) FindRefreshTokenByHash(ctx context.Context, hash string) (string, RefreshTokenRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return "", RefreshTokenRecord{}, err
+	}
+
+	s.mu.RLock()
+	ref, ok := s.byHash[hash]
+	s.mu.RUnlock()
+	if !ok {
+		return "", RefreshTokenRecord{}, ErrNotFound
+	}
+
+	return ref.userID, ref.token, nil
+}
+
+func (s *MemoryStore) RevokeRefreshTokenByJTI(ctx context.Context, userID, jti string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash, ok := s.byJTI[jti]
+	if !ok || s.byHash[hash].userID != userID {
+		return false, nil
+	}
+
+	rec := s.data[userID]
+	out := make([]RefreshTokenRecord, 0, len(rec.RefreshTokens)-1)
+	for _, rt := range rec.RefreshTokens {
+		if rt.Hash != hash {
+			out = append(out, rt)
+		}
+	}
+	rec.RefreshTokens = out
+	s.data[userID] = rec
+
+	delete(s.byHash, hash)
+	delete(s.byJTI, jti)
+	return true, nil
+}
+
+func (s *MemoryStore) ListRefreshTokens(ctx context.Context, userID string) ([]RefreshTokenRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, ok := s.data[userID]
+	if !ok || len(rec.RefreshTokens) == 0 {
+		return nil, nil
+	}
+
+	out := make([]RefreshTokenRecord, len(rec.RefreshTokens))
+	copy(out, rec.RefreshTokens)
+	return out, nil
+}
+
+func (s *MemoryStore) ForEach(ctx context.Context, fn func(Record) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	ids := slices.Collect(maps.Keys(s.data))
+	s.mu.RUnlock()
+
+	for _, id := range ids {
+		r, err := s.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) PruneAllExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -83,20 +242,158 @@ func (s *MemoryStore) PruneAllExpired(_ context.Context, now time.Time) (int, er
 		for _, rt := range rec.RefreshTokens {
 			if rt.ExpiresAt.After(now) {
 				out = append(out, rt)
+				continue
 			}
+			delete(s.byHash, rt.Hash)
+			delete(s.byJTI, rt.JTI)
 		}
 		rec.RefreshTokens = out
 		s.data[uid] = rec
 		total += before - len(out)
 	}
+
+	for k, v := range s.oneTime {
+		if !v.expiresAt.After(now) {
+			delete(s.oneTime, k)
+		}
+	}
 	return total, nil
 }
 
+func (s *MemoryStore) PutOneTime(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.oneTime[key] = memoryOneTime{value: slices.Clone(value), expiresAt: expiresAt}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) TakeOneTime(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	v, ok := s.oneTime[key]
+	delete(s.oneTime, key)
+	s.mu.Unlock()
+
+	if !ok || !v.expiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return v.value, nil
+}
+
+func (s *MemoryStore) LinkIdentity(ctx context.Context, id Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := memoryIdentityKey{id.Provider, id.Subject}
+	if prev, ok := s.identities[k]; ok {
+		if prev.UserID != id.UserID {
+			return ErrIdentityTaken
+		}
+		prev.Email = id.Email
+		s.identities[k] = prev
+		return nil
+	}
+
+	s.identities[k] = id
+	return nil
+}
+
+func (s *MemoryStore) GetIdentity(ctx context.Context, provider, subject string) (Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return Identity{}, err
+	}
+
+	s.mu.RLock()
+	id, ok := s.identities[memoryIdentityKey{provider, subject}]
+	s.mu.RUnlock()
+	if !ok {
+		return Identity{}, ErrNotFound
+	}
+
+	return id, nil
+}
+
+func (s *MemoryStore) ListIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	return s.findIdentities(ctx, func(id Identity) bool { return id.UserID == userID })
+}
+
+func (s *MemoryStore) FindIdentitiesByEmail(ctx context.Context, email string) ([]Identity, error) {
+	return s.findIdentities(ctx, func(id Identity) bool { return id.Email != "" && id.Email == email })
+}
+
+// findIdentities scans every identity; the memory store is for development
+// and tests, where there are few.
+func (s *MemoryStore) findIdentities(ctx context.Context, match func(Identity) bool) ([]Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	var out []Identity
+	for _, id := range s.identities {
+		if match(id) {
+			out = append(out, id)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(out, compareIdentities)
+	return out, nil
+}
+
+func (s *MemoryStore) UnlinkIdentity(ctx context.Context, userID, provider, subject string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := memoryIdentityKey{provider, subject}
+	if id, ok := s.identities[k]; !ok || id.UserID != userID {
+		return false, nil
+	}
+
+	delete(s.identities, k)
+	return true, nil
+}
+
+// store replaces the user's record and re-indexes its refresh tokens. The
+// caller holds the write lock.
+func (s *MemoryStore) store(userID string, r Record) {
+	s.unindex(userID)
+	s.data[userID] = r
+	for _, rt := range r.RefreshTokens {
+		s.byHash[rt.Hash] = memoryTokenRef{userID: userID, token: rt}
+		s.byJTI[rt.JTI] = rt.Hash
+	}
+}
+
+func (s *MemoryStore) unindex(userID string) {
+	for _, rt := range s.data[userID].RefreshTokens {
+		delete(s.byHash, rt.Hash)
+		delete(s.byJTI, rt.JTI)
+	}
+}
+
 // internals/storage/memory.go (add slice copy)
 func deepCopyRecord(r Record) Record {
 	out := r
 	out.RefreshTokensByProvider = maps.Clone(r.RefreshTokensByProvider)
 	out.Attrs = maps.Clone(r.Attrs)
+	out.ProviderValidatedAt = maps.Clone(r.ProviderValidatedAt)
+	out.ProviderClientIDs = maps.Clone(r.ProviderClientIDs)
 	if r.RefreshTokens != nil {
 		out.RefreshTokens = make([]RefreshTokenRecord, len(r.RefreshTokens))
 		copy(out.RefreshTokens, r.RefreshTokens)
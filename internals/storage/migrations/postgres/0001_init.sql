@@ -0,0 +1,18 @@
+CREATE TABLE users (
+    user_id            TEXT PRIMARY KEY,
+    tokens_by_provider JSONB NOT NULL DEFAULT '{}',
+    attrs              JSONB NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE refresh_tokens (
+    hash       TEXT PRIMARY KEY,
+    jti        TEXT NOT NULL,
+    user_id    TEXT NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    family_id  TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX refresh_tokens_jti_idx ON refresh_tokens (jti);
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+CREATE INDEX refresh_tokens_expires_at_idx ON refresh_tokens (expires_at);
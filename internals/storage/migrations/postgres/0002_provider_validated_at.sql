@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN provider_validated_at JSONB NOT NULL DEFAULT '{}';
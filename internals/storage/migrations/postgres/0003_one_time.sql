@@ -0,0 +1,7 @@
+CREATE TABLE one_time (
+    key        TEXT PRIMARY KEY,
+    value      BYTEA NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX one_time_expires_at_idx ON one_time (expires_at);
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN provider_client_ids JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,480 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// postgresMigrationLock is the advisory lock key held while migrating so that
+// replicas starting together do not race each other.
+const postgresMigrationLock = 7_318_254_001
+
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore connects to dsn and applies any pending schema migrations.
+func NewPostgresStore(ctx context.Context, dsn string) (*PostgresStore, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &PostgresStore{pool: pool}, nil
+}
+
+func (s *PostgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+func (s *PostgresStore) Put(ctx context.Context, userID string, r Record) error {
+	r.UserID = userID
+	r.EnsureInit()
+
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		return writeRecord(ctx, tx, r)
+	})
+}
+
+// Get reads the user's row and its refresh tokens in one read-only snapshot,
+// so a concurrent Update cannot be seen half applied.
+func (s *PostgresStore) Get(ctx context.Context, userID string) (Record, error) {
+	var out Record
+	err := pgx.BeginTxFunc(ctx, s.pool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		var err error
+		out, err = readRecord(ctx, tx, userID, false)
+		return err
+	})
+	if err != nil {
+		return Record{}, err
+	}
+
+	return out, nil
+}
+
+func (s *PostgresStore) Update(ctx context.Context, userID string, fn func(Record) Record) (Record, error) {
+	var out Record
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		// Make sure there is a row to lock, then hold it for the rest of the
+		// transaction so concurrent updates for the same user serialize.
+		if _, err := tx.Exec(ctx, `INSERT INTO users (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING`, userID); err != nil {
+			return err
+		}
+
+		curr, err := readRecord(ctx, tx, userID, true)
+		if err != nil {
+			return err
+		}
+
+		next := fn(curr)
+		next.UserID = userID
+		next.EnsureInit()
+
+		if err := writeRecord(ctx, tx, next); err != nil {
+			return err
+		}
+
+		out = deepCopyRecord(next)
+		return nil
+	})
+	if err != nil {
+		return Record{}, err
+	}
+
+	return out, nil
+}
+
+// Delete also removes the user's identities. They are not tied to users by a
+// foreign key because a new user's identity is linked before their record is
+// first written.
+func (s *PostgresStore) Delete(ctx context.Context, userID string) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM identities WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM users WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+func (s *PostgresStore) UserExists(ctx context.Context, userID string) (bool, error) {
+	var ok bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE user_id = $1)`, userID).Scan(&ok)
+	return ok, err
+}
+
+func (s *PostgresStore) RefreshTokenExists(ctx context.Context, hash string) (bool, error) {
+	var ok bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE hash = $1)`, hash).Scan(&ok)
+	return ok, err
+}
+
+func (s *PostgresStore) FindRefreshTokenByHash(ctx context.Context, hash string) (string, RefreshTokenRecord, error) {
+	var (
+		userID string
+		rt     RefreshTokenRecord
+	)
+	err := s.pool.QueryRow(ctx, `
+		SELECT user_id, hash, jti, family_id, expires_at, created_at
+		FROM refresh_tokens
+		WHERE hash = $1`, hash,
+	).Scan(&userID, &rt.Hash, &rt.JTI, &rt.FamilyID, &rt.ExpiresAt, &rt.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", RefreshTokenRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return "", RefreshTokenRecord{}, err
+	}
+
+	return userID, rt, nil
+}
+
+func (s *PostgresStore) RevokeRefreshTokenByJTI(ctx context.Context, userID, jti string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM refresh_tokens WHERE jti = $1 AND user_id = $2`, jti, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) ListRefreshTokens(ctx context.Context, userID string) ([]RefreshTokenRecord, error) {
+	return readRefreshTokens(ctx, s.pool, userID)
+}
+
+// ForEach pages through users by id so no connection is held while fn runs.
+func (s *PostgresStore) ForEach(ctx context.Context, fn func(Record) error) error {
+	const batch = 500
+
+	after := ""
+	for {
+		rows, err := s.pool.Query(ctx, `SELECT user_id FROM users WHERE user_id > $1 ORDER BY user_id LIMIT $2`, after, batch)
+		if err != nil {
+			return err
+		}
+
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			r, err := s.Get(ctx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+
+		if len(ids) < batch {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+func (s *PostgresStore) PruneAllExpired(ctx context.Context, now time.Time) (int, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM refresh_tokens WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := s.pool.Exec(ctx, `DELETE FROM one_time WHERE expires_at <= $1`, now); err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+func (s *PostgresStore) PutOneTime(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	// pgx sends a nil slice as NULL, which the column does not allow.
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO one_time (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at`,
+		key, value, expiresAt)
+	return err
+}
+
+func (s *PostgresStore) TakeOneTime(ctx context.Context, key string) ([]byte, error) {
+	var (
+		value     []byte
+		expiresAt time.Time
+	)
+	err := s.pool.QueryRow(ctx, `DELETE FROM one_time WHERE key = $1 RETURNING value, expires_at`, key).Scan(&value, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !expiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *PostgresStore) LinkIdentity(ctx context.Context, id Identity) error {
+	// A conflicting row is only updated, and so only counted, when it is
+	// already the same user's.
+	tag, err := s.pool.Exec(ctx, `
+		INSERT INTO identities (provider, subject, user_id, email, created_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (provider, subject) DO UPDATE SET email = EXCLUDED.email
+		WHERE identities.user_id = EXCLUDED.user_id`,
+		id.Provider, id.Subject, id.UserID, id.Email, id.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrIdentityTaken
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetIdentity(ctx context.Context, provider, subject string) (Identity, error) {
+	rows, err := s.pool.Query(ctx, identitySelect+` WHERE provider = $1 AND subject = $2`, provider, subject)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	id, err := pgx.CollectExactlyOneRow(rows, scanIdentity)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Identity{}, ErrNotFound
+	}
+	return id, err
+}
+
+func (s *PostgresStore) ListIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	return s.queryIdentities(ctx, identitySelect+` WHERE user_id = $1 ORDER BY provider, subject`, userID)
+}
+
+func (s *PostgresStore) FindIdentitiesByEmail(ctx context.Context, email string) ([]Identity, error) {
+	return s.queryIdentities(ctx, identitySelect+` WHERE email = $1 AND email <> '' ORDER BY provider, subject`, email)
+}
+
+func (s *PostgresStore) UnlinkIdentity(ctx context.Context, userID, provider, subject string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM identities WHERE provider = $1 AND subject = $2 AND user_id = $3`, provider, subject, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+const identitySelect = `SELECT provider, subject, user_id, email, created_at FROM identities`
+
+func (s *PostgresStore) queryIdentities(ctx context.Context, sql string, arg string) ([]Identity, error) {
+	rows, err := s.pool.Query(ctx, sql, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := pgx.CollectRows(rows, scanIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+func scanIdentity(row pgx.CollectableRow) (Identity, error) {
+	var id Identity
+	err := row.Scan(&id.Provider, &id.Subject, &id.UserID, &id.Email, &id.CreatedAt)
+	return id, err
+}
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func readRecord(ctx context.Context, q querier, userID string, forUpdate bool) (Record, error) {
+	sql := `SELECT tokens_by_provider, attrs, provider_validated_at, provider_client_ids FROM users WHERE user_id = $1`
+	if forUpdate {
+		sql += ` FOR UPDATE`
+	}
+
+	r := Record{UserID: userID}
+	err := q.QueryRow(ctx, sql, userID).Scan(&r.RefreshTokensByProvider, &r.Attrs, &r.ProviderValidatedAt, &r.ProviderClientIDs)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Record{}, ErrNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	r.RefreshTokens, err = readRefreshTokens(ctx, q, userID)
+	if err != nil {
+		return Record{}, err
+	}
+
+	r.EnsureInit()
+	return r, nil
+}
+
+func readRefreshTokens(ctx context.Context, q querier, userID string) ([]RefreshTokenRecord, error) {
+	rows, err := q.Query(ctx, `
+		SELECT hash, jti, family_id, expires_at, created_at
+		FROM refresh_tokens
+		WHERE user_id = $1
+		ORDER BY created_at, hash`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (RefreshTokenRecord, error) {
+		var rt RefreshTokenRecord
+		err := row.Scan(&rt.Hash, &rt.JTI, &rt.FamilyID, &rt.ExpiresAt, &rt.CreatedAt)
+		return rt, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	return out, nil
+}
+
+func writeRecord(ctx context.Context, tx pgx.Tx, r Record) error {
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO users (user_id, tokens_by_provider, attrs, provider_validated_at, provider_client_ids)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE
+		SET tokens_by_provider = EXCLUDED.tokens_by_provider,
+			attrs = EXCLUDED.attrs,
+			provider_validated_at = EXCLUDED.provider_validated_at,
+			provider_client_ids = EXCLUDED.provider_client_ids`,
+		r.UserID, r.RefreshTokensByProvider, r.Attrs, r.ProviderValidatedAt, r.ProviderClientIDs,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1`, r.UserID); err != nil {
+		return err
+	}
+
+	if len(r.RefreshTokens) == 0 {
+		return nil
+	}
+
+	n := len(r.RefreshTokens)
+	hashes, jtis, families := make([]string, n), make([]string, n), make([]string, n)
+	expires, created := make([]time.Time, n), make([]time.Time, n)
+	for i, rt := range r.RefreshTokens {
+		hashes[i], jtis[i], families[i] = rt.Hash, rt.JTI, rt.FamilyID
+		expires[i], created[i] = rt.ExpiresAt, rt.CreatedAt
+	}
+
+	_, err := tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (hash, jti, user_id, family_id, expires_at, created_at)
+		SELECT h, j, $1, f, e, c
+		FROM unnest($2::text[], $3::text[], $4::text[], $5::timestamptz[], $6::timestamptz[]) AS t (h, j, f, e, c)`,
+		r.UserID, hashes, jtis, families, expires, created,
+	)
+	return err
+}
+
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	names, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version    INTEGER PRIMARY KEY,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			)`); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			version, err := migrationVersion(name)
+			if err != nil {
+				return err
+			}
+
+			var applied bool
+			if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied); err != nil {
+				return err
+			}
+			if applied {
+				continue
+			}
+
+			sql, err := postgresMigrations.ReadFile(name)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(ctx, string(sql)); err != nil {
+				return fmt.Errorf("migration %s: %w", path.Base(name), err)
+			}
+
+			if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// migrationVersion reads the numeric prefix of a migration file name such as
+// "0001_init.sql".
+func migrationVersion(name string) (int, error) {
+	base := path.Base(name)
+	prefix, _, ok := strings.Cut(base, "_")
+	if !ok {
+		return 0, fmt.Errorf("migration %s: missing version prefix", base)
+	}
+
+	return strconv.Atoi(prefix)
+}
@@ -0,0 +1,633 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKeyPrefix = "auth:"
+
+	// redisMaxTxRetries bounds how often Update retries when a watched key
+	// changes under it; retries back off for up to redisMaxTxBackoff.
+	redisMaxTxRetries = 64
+	redisMaxTxBackoff = 20 * time.Millisecond
+)
+
+// RedisStore keeps each user record under one key and each refresh token
+// under its own key that Redis expires at the token's ExpiresAt, so expired
+// tokens disappear without a pruning job. A per-user set tracks which token
+// keys belong to the user.
+//
+//	auth:user:{uid}     record without refresh tokens (JSON)
+//	auth:user_rt:{uid}  set of refresh token hashes
+//	auth:rt:{hash}      redisRefreshToken (JSON), expiring at ExpiresAt
+//	auth:rt_jti:{jti}   hash of the refresh token, expiring with it
+//	auth:once:{key}     one-time value, expiring at its expiresAt
+//
+//	auth:identity:{provider}:{subject}  Identity (JSON)
+//	auth:user_identities:{uid}          set of the user's provider:subject
+//	auth:email_identities:{email}       set of provider:subject recorded with email
+type RedisStore struct {
+	rdb *redis.Client
+}
+
+type redisRefreshToken struct {
+	UserID string `json:"user_id"`
+	RefreshTokenRecord
+}
+
+// NewRedisStore connects to the Redis server at url, e.g. redis://localhost:6379/0.
+func NewRedisStore(ctx context.Context, url string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	rdb := redis.NewClient(opts)
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		_ = rdb.Close()
+		return nil, err
+	}
+
+	return &RedisStore{rdb: rdb}, nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.rdb.Close()
+}
+
+func (s *RedisStore) Put(ctx context.Context, userID string, r Record) error {
+	_, err := s.Update(ctx, userID, func(Record) Record { return r })
+	return err
+}
+
+func (s *RedisStore) Get(ctx context.Context, userID string) (Record, error) {
+	return redisRead(ctx, s.rdb, userID)
+}
+
+func (s *RedisStore) Update(ctx context.Context, userID string, fn func(Record) Record) (Record, error) {
+	var out Record
+	txf := func(tx *redis.Tx) error {
+		prev, err := tx.SMembers(ctx, redisUserTokensKey(userID)).Result()
+		if err != nil {
+			return err
+		}
+
+		curr, err := redisRead(ctx, tx, userID)
+		if errors.Is(err, ErrNotFound) {
+			curr = Record{UserID: userID}
+			curr.EnsureInit()
+		} else if err != nil {
+			return err
+		}
+
+		next := fn(curr)
+		next.UserID = userID
+		next.EnsureInit()
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			return redisWrite(ctx, p, next, prev, curr.RefreshTokens)
+		})
+		if err != nil {
+			return err
+		}
+
+		out = deepCopyRecord(next)
+		return nil
+	}
+
+	err := redisWatch(ctx, func() error {
+		return s.rdb.Watch(ctx, txf, redisUserKey(userID), redisUserTokensKey(userID))
+	})
+	if err != nil {
+		return Record{}, err
+	}
+
+	return out, nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, userID string) error {
+	setKey, idsKey := redisUserTokensKey(userID), redisUserIdentitiesKey(userID)
+	return redisWatch(ctx, func() error {
+		return s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			hashes, err := tx.SMembers(ctx, setKey).Result()
+			if err != nil {
+				return err
+			}
+
+			tokens, err := redisReadTokens(ctx, tx, userID)
+			if err != nil {
+				return err
+			}
+
+			ids, err := redisReadIdentities(ctx, tx, idsKey, func(id Identity) bool { return id.UserID == userID })
+			if err != nil {
+				return err
+			}
+
+			keys := []string{redisUserKey(userID), setKey, idsKey}
+			for _, h := range hashes {
+				keys = append(keys, redisTokenKey(h))
+			}
+			for _, rt := range tokens {
+				keys = append(keys, redisJTIKey(rt.JTI))
+			}
+			for _, id := range ids {
+				keys = append(keys, redisIdentityKey(id.Provider, id.Subject))
+			}
+
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				for _, id := range ids {
+					if id.Email != "" {
+						p.SRem(ctx, redisEmailIdentitiesKey(id.Email), redisIdentityMember(id.Provider, id.Subject))
+					}
+				}
+				return p.Del(ctx, keys...).Err()
+			})
+			return err
+		}, setKey, idsKey)
+	})
+}
+
+func (s *RedisStore) UserExists(ctx context.Context, userID string) (bool, error) {
+	n, err := s.rdb.Exists(ctx, redisUserKey(userID)).Result()
+	return n > 0, err
+}
+
+func (s *RedisStore) RefreshTokenExists(ctx context.Context, hash string) (bool, error) {
+	n, err := s.rdb.Exists(ctx, redisTokenKey(hash)).Result()
+	return n > 0, err
+}
+
+func (s *RedisStore) FindRefreshTokenByHash(ctx context.Context, hash string) (string, RefreshTokenRecord, error) {
+	raw, err := s.rdb.Get(ctx, redisTokenKey(hash)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return "", RefreshTokenRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return "", RefreshTokenRecord{}, err
+	}
+
+	var rt redisRefreshToken
+	if err := json.Unmarshal(raw, &rt); err != nil {
+		return "", RefreshTokenRecord{}, err
+	}
+
+	return rt.UserID, rt.RefreshTokenRecord, nil
+}
+
+func (s *RedisStore) RevokeRefreshTokenByJTI(ctx context.Context, userID, jti string) (bool, error) {
+	setKey := redisUserTokensKey(userID)
+	revoked := false
+	err := redisWatch(ctx, func() error {
+		return s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			revoked = false
+			hash, err := tx.Get(ctx, redisJTIKey(jti)).Result()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			ok, err := tx.SIsMember(ctx, setKey, hash).Result()
+			if err != nil || !ok {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.Del(ctx, redisTokenKey(hash), redisJTIKey(jti))
+				p.SRem(ctx, setKey, hash)
+				return nil
+			})
+			revoked = err == nil
+			return err
+		}, setKey, redisJTIKey(jti))
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+func (s *RedisStore) ListRefreshTokens(ctx context.Context, userID string) ([]RefreshTokenRecord, error) {
+	return redisReadTokens(ctx, s.rdb, userID)
+}
+
+// ForEach scans the user keys. SCAN may return a key more than once, so ids
+// already visited are skipped.
+func (s *RedisStore) ForEach(ctx context.Context, fn func(Record) error) error {
+	prefix := redisUserKey("")
+	seen := make(map[string]bool)
+	iter := s.rdb.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		id := strings.TrimPrefix(iter.Val(), prefix)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		r, err := redisRead(ctx, s.rdb, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+func (s *RedisStore) PutOneTime(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	if !expiresAt.After(time.Now()) {
+		// Redis rejects an expiry in the past; an expired value reads as
+		// missing anyway.
+		return s.rdb.Del(ctx, redisOneTimeKey(key)).Err()
+	}
+	return s.rdb.SetArgs(ctx, redisOneTimeKey(key), value, redis.SetArgs{ExpireAt: expiresAt}).Err()
+}
+
+func (s *RedisStore) TakeOneTime(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.rdb.GetDel(ctx, redisOneTimeKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *RedisStore) LinkIdentity(ctx context.Context, id Identity) error {
+	key := redisIdentityKey(id.Provider, id.Subject)
+	member := redisIdentityMember(id.Provider, id.Subject)
+	return redisWatch(ctx, func() error {
+		return s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			next := id
+			prev, err := redisReadIdentity(ctx, tx, key)
+			switch {
+			case errors.Is(err, ErrNotFound):
+			case err != nil:
+				return err
+			case prev.UserID != id.UserID:
+				return ErrIdentityTaken
+			default:
+				next = prev
+				next.Email = id.Email
+			}
+
+			raw, err := json.Marshal(next)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.Set(ctx, key, raw, 0)
+				p.SAdd(ctx, redisUserIdentitiesKey(next.UserID), member)
+				if prev.Email != "" && prev.Email != next.Email {
+					p.SRem(ctx, redisEmailIdentitiesKey(prev.Email), member)
+				}
+				if next.Email != "" {
+					p.SAdd(ctx, redisEmailIdentitiesKey(next.Email), member)
+				}
+				return nil
+			})
+			return err
+		}, key)
+	})
+}
+
+func (s *RedisStore) GetIdentity(ctx context.Context, provider, subject string) (Identity, error) {
+	return redisReadIdentity(ctx, s.rdb, redisIdentityKey(provider, subject))
+}
+
+func (s *RedisStore) ListIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	return redisReadIdentities(ctx, s.rdb, redisUserIdentitiesKey(userID), func(id Identity) bool { return id.UserID == userID })
+}
+
+func (s *RedisStore) FindIdentitiesByEmail(ctx context.Context, email string) ([]Identity, error) {
+	if email == "" {
+		return nil, ctx.Err()
+	}
+	return redisReadIdentities(ctx, s.rdb, redisEmailIdentitiesKey(email), func(id Identity) bool { return id.Email == email })
+}
+
+func (s *RedisStore) UnlinkIdentity(ctx context.Context, userID, provider, subject string) (bool, error) {
+	key := redisIdentityKey(provider, subject)
+	unlinked := false
+	err := redisWatch(ctx, func() error {
+		return s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			unlinked = false
+			id, err := redisReadIdentity(ctx, tx, key)
+			if errors.Is(err, ErrNotFound) || (err == nil && id.UserID != userID) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			member := redisIdentityMember(provider, subject)
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.Del(ctx, key)
+				p.SRem(ctx, redisUserIdentitiesKey(userID), member)
+				if id.Email != "" {
+					p.SRem(ctx, redisEmailIdentitiesKey(id.Email), member)
+				}
+				return nil
+			})
+			unlinked = err == nil
+			return err
+		}, key)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return unlinked, nil
+}
+
+// PruneAllExpired only has to drop the set members left behind by refresh
+// token keys Redis has already expired; the tokens themselves are gone. It
+// returns how many such members were removed. Calling it is optional, since
+// every Update rewrites the user's set as well.
+func (s *RedisStore) PruneAllExpired(ctx context.Context, _ time.Time) (int, error) {
+	total := 0
+	iter := s.rdb.Scan(ctx, 0, redisKeyPrefix+"user_rt:*", 100).Iterator()
+	for iter.Next(ctx) {
+		setKey := iter.Val()
+		hashes, err := s.rdb.SMembers(ctx, setKey).Result()
+		if err != nil {
+			return total, err
+		}
+
+		var stale []any
+		for _, h := range hashes {
+			n, err := s.rdb.Exists(ctx, redisTokenKey(h)).Result()
+			if err != nil {
+				return total, err
+			}
+			if n == 0 {
+				stale = append(stale, h)
+			}
+		}
+
+		if len(stale) == 0 {
+			continue
+		}
+
+		n, err := s.rdb.SRem(ctx, setKey, stale...).Result()
+		if err != nil {
+			return total, err
+		}
+		total += int(n)
+	}
+
+	return total, iter.Err()
+}
+
+// redisWatch runs a WATCH/MULTI transaction, retrying with jittered backoff
+// while a watched key keeps changing underneath it.
+func redisWatch(ctx context.Context, watch func() error) error {
+	backoff := time.Millisecond
+	for range redisMaxTxRetries {
+		err := watch()
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+
+		select {
+		case <-time.After(rand.N(backoff) + 1):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, redisMaxTxBackoff)
+	}
+
+	return errors.New("update conflict: too many retries")
+}
+
+func redisRead(ctx context.Context, c redis.Cmdable, userID string) (Record, error) {
+	raw, err := c.Get(ctx, redisUserKey(userID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Record{}, ErrNotFound
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	var r Record
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return Record{}, err
+	}
+	r.UserID = userID
+	r.EnsureInit()
+
+	r.RefreshTokens, err = redisReadTokens(ctx, c, userID)
+	if err != nil {
+		return Record{}, err
+	}
+
+	return r, nil
+}
+
+func redisReadTokens(ctx context.Context, c redis.Cmdable, userID string) ([]RefreshTokenRecord, error) {
+	hashes, err := c.SMembers(ctx, redisUserTokensKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(hashes))
+	for i, h := range hashes {
+		keys[i] = redisTokenKey(h)
+	}
+
+	vals, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []RefreshTokenRecord
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			// expired since the set was read
+			continue
+		}
+
+		var rt redisRefreshToken
+		if err := json.Unmarshal([]byte(s), &rt); err != nil {
+			return nil, err
+		}
+		out = append(out, rt.RefreshTokenRecord)
+	}
+
+	slices.SortFunc(out, func(a, b RefreshTokenRecord) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Hash, b.Hash)
+	})
+
+	return out, nil
+}
+
+// redisWrite queues the commands that replace the stored record with r. prev
+// holds the token hashes currently in the user's set and prevTokens the ones
+// among them that have not expired yet.
+func redisWrite(ctx context.Context, p redis.Pipeliner, r Record, prev []string, prevTokens []RefreshTokenRecord) error {
+	tokens := r.RefreshTokens
+	r.RefreshTokens = nil
+
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	p.Set(ctx, redisUserKey(r.UserID), raw, 0)
+
+	setKey := redisUserTokensKey(r.UserID)
+	keep := make(map[string]bool, len(tokens))
+	now := time.Now()
+	for _, rt := range tokens {
+		if !rt.ExpiresAt.After(now) {
+			continue
+		}
+
+		v, err := json.Marshal(redisRefreshToken{UserID: r.UserID, RefreshTokenRecord: rt})
+		if err != nil {
+			return err
+		}
+
+		p.SetArgs(ctx, redisTokenKey(rt.Hash), v, redis.SetArgs{ExpireAt: rt.ExpiresAt})
+		p.SetArgs(ctx, redisJTIKey(rt.JTI), rt.Hash, redis.SetArgs{ExpireAt: rt.ExpiresAt})
+		p.SAdd(ctx, setKey, rt.Hash)
+		keep[rt.Hash] = true
+	}
+
+	for _, h := range prev {
+		if keep[h] {
+			continue
+		}
+		p.Del(ctx, redisTokenKey(h))
+		p.SRem(ctx, setKey, h)
+	}
+
+	for _, rt := range prevTokens {
+		if !keep[rt.Hash] {
+			p.Del(ctx, redisJTIKey(rt.JTI))
+		}
+	}
+
+	return nil
+}
+
+func redisReadIdentity(ctx context.Context, c redis.Cmdable, key string) (Identity, error) {
+	raw, err := c.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Identity{}, ErrNotFound
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var id Identity
+	if err := json.Unmarshal(raw, &id); err != nil {
+		return Identity{}, err
+	}
+	return id, nil
+}
+
+// redisReadIdentities reads the identities listed in the set under setKey.
+// Sets are only trimmed as identities move, so members are checked against
+// the identity they name with match.
+func redisReadIdentities(ctx context.Context, c redis.Cmdable, setKey string, match func(Identity) bool) ([]Identity, error) {
+	members, err := c.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(members))
+	for i, m := range members {
+		keys[i] = redisKeyPrefix + "identity:" + m
+	}
+
+	vals, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Identity
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		var id Identity
+		if err := json.Unmarshal([]byte(s), &id); err != nil {
+			return nil, err
+		}
+		if match(id) {
+			out = append(out, id)
+		}
+	}
+
+	slices.SortFunc(out, compareIdentities)
+	return out, nil
+}
+
+func redisIdentityMember(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+func redisIdentityKey(provider, subject string) string {
+	return redisKeyPrefix + "identity:" + redisIdentityMember(provider, subject)
+}
+
+func redisUserIdentitiesKey(userID string) string {
+	return redisKeyPrefix + "user_identities:" + userID
+}
+
+func redisEmailIdentitiesKey(email string) string {
+	return redisKeyPrefix + "email_identities:" + email
+}
+
+func redisOneTimeKey(key string) string {
+	return redisKeyPrefix + "once:" + key
+}
+
+func redisUserKey(userID string) string {
+	return redisKeyPrefix + "user:" + userID
+}
+
+func redisUserTokensKey(userID string) string {
+	return redisKeyPrefix + "user_rt:" + userID
+}
+
+func redisTokenKey(hash string) string {
+	return redisKeyPrefix + "rt:" + hash
+}
+
+func redisJTIKey(jti string) string {
+	return redisKeyPrefix + "rt_jti:" + jti
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s, err := NewRedisStore(context.Background(), "redis://"+mr.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisStore: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s, mr
+}
+
+func TestRedis_PutGetRoundTrip(t *testing.T) {
+	s, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	if err := s.Put(ctx, "uid1", Record{
+		RefreshTokensByProvider: map[string]string{ProviderApple: "enc"},
+		RefreshTokens: []RefreshTokenRecord{
+			{Hash: "h2", JTI: "j2", FamilyID: "f", ExpiresAt: now.Add(time.Hour), CreatedAt: now.Add(time.Second)},
+			{Hash: "h1", JTI: "j1", FamilyID: "f", ExpiresAt: now.Add(time.Hour), CreatedAt: now},
+		},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.RefreshTokensByProvider[ProviderApple] != "enc" {
+		t.Fatalf("provider token not round-tripped: %+v", got)
+	}
+	if len(got.RefreshTokens) != 2 || got.RefreshTokens[0].Hash != "h1" || got.RefreshTokens[1].Hash != "h2" {
+		t.Fatalf("refresh tokens not round-tripped in creation order: %+v", got.RefreshTokens)
+	}
+
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRedis_RefreshTokensExpireNatively(t *testing.T) {
+	s, mr := newTestRedis(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	if err := s.Put(ctx, "uid1", Record{RefreshTokens: []RefreshTokenRecord{
+		{Hash: "short", JTI: "j1", ExpiresAt: now.Add(time.Minute), CreatedAt: now},
+		{Hash: "long", JTI: "j2", ExpiresAt: now.Add(time.Hour), CreatedAt: now},
+	}}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if ttl := mr.TTL(redisTokenKey("short")); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("unexpected ttl for short token: %v", ttl)
+	}
+
+	mr.FastForward(2 * time.Minute)
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got.RefreshTokens) != 1 || got.RefreshTokens[0].Hash != "long" {
+		t.Fatalf("expected only the long-lived token, got %+v", got.RefreshTokens)
+	}
+
+	n, err := s.PruneAllExpired(ctx, time.Now())
+	if err != nil || n != 1 {
+		t.Fatalf("PruneAllExpired = %d, %v; want 1, nil", n, err)
+	}
+	if ok, _ := mr.SIsMember(redisUserTokensKey("uid1"), "short"); ok {
+		t.Fatalf("expected stale set member to be removed")
+	}
+}
+
+func TestRedis_DeleteRemovesTokenKeys(t *testing.T) {
+	s, mr := newTestRedis(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	if err := s.Put(ctx, "uid1", Record{RefreshTokens: []RefreshTokenRecord{
+		{Hash: "h1", JTI: "j1", ExpiresAt: now.Add(time.Hour), CreatedAt: now},
+	}}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := s.Delete(ctx, "uid1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ok, _ := s.UserExists(ctx, "uid1"); ok {
+		t.Fatalf("expected user to be gone")
+	}
+	if mr.Exists(redisTokenKey("h1")) {
+		t.Fatalf("expected refresh token key to be deleted")
+	}
+}
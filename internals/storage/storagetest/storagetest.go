@@ -0,0 +1,789 @@
+// Package storagetest holds the conformance suite every storage.Store
+// implementation is expected to pass.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmirfield/auth-service/internals/storage"
+)
+
+// Run exercises the Store contract against stores returned by newStore. Each
+// subtest calls newStore once and expects an empty store back.
+func Run(t *testing.T, newStore func() storage.Store) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.Store)
+	}{
+		{"GetMissing", testGetMissing},
+		{"PutGet", testPutGet},
+		{"PutReplaces", testPutReplaces},
+		{"UpdateCreatesMissing", testUpdateCreatesMissing},
+		{"UpdateSeesCurrent", testUpdateSeesCurrent},
+		{"CopyIsolation", testCopyIsolation},
+		{"ConcurrentUpdate", testConcurrentUpdate},
+		{"DeleteAndUserExists", testDeleteAndUserExists},
+		{"PruneAllExpired", testPruneAllExpired},
+		{"FindRefreshTokenByHash", testFindRefreshTokenByHash},
+		{"RevokeRefreshTokenByJTI", testRevokeRefreshTokenByJTI},
+		{"ListRefreshTokens", testListRefreshTokens},
+		{"ForEach", testForEach},
+		{"OneTime", testOneTime},
+		{"Identities", testIdentities},
+		{"DeleteRemovesIdentities", testDeleteRemovesIdentities},
+		{"ContextCanceled", testContextCanceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore())
+		})
+	}
+}
+
+// now is truncated to microseconds so stores backed by SQL timestamps compare
+// equal after a round trip.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func token(hash string, expiresAt time.Time) storage.RefreshTokenRecord {
+	return storage.RefreshTokenRecord{
+		Hash:      hash,
+		JTI:       "jti-" + hash,
+		FamilyID:  "family",
+		ExpiresAt: expiresAt,
+		CreatedAt: expiresAt.Add(-time.Hour),
+	}
+}
+
+func testGetMissing(t *testing.T, s storage.Store) {
+	if _, err := s.Get(context.Background(), "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get(missing): expected ErrNotFound, got %v", err)
+	}
+}
+
+func testPutGet(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	// Nil maps on the way in must come back initialized.
+	if err := s.Put(ctx, "uid1", storage.Record{
+		UserID:        "ignored",
+		RefreshTokens: []storage.RefreshTokenRecord{token("h1", exp)},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.UserID != "uid1" {
+		t.Fatalf("got uid %q, want %q", got.UserID, "uid1")
+	}
+	if got.RefreshTokensByProvider == nil || got.Attrs == nil || got.ProviderClientIDs == nil {
+		t.Fatalf("expected initialized maps, got %+v", got)
+	}
+	if len(got.RefreshTokens) != 1 {
+		t.Fatalf("got %d refresh tokens, want 1", len(got.RefreshTokens))
+	}
+	assertToken(t, got.RefreshTokens[0], token("h1", exp))
+
+	got.ProviderClientIDs[storage.ProviderApple] = "com.example.web"
+	if err := s.Put(ctx, "uid1", got); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if again, err := s.Get(ctx, "uid1"); err != nil || again.ProviderClientIDs[storage.ProviderApple] != "com.example.web" {
+		t.Fatalf("ProviderClientIDs not stored: %+v, %v", again.ProviderClientIDs, err)
+	}
+}
+
+func testPutReplaces(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	if err := s.Put(ctx, "uid1", storage.Record{
+		RefreshTokensByProvider: map[string]string{storage.ProviderApple: "old"},
+		Attrs:                   map[string]string{"stale": "yes"},
+		RefreshTokens:           []storage.RefreshTokenRecord{token("h1", exp)},
+	}); err != nil {
+		t.Fatalf("Put #1: %v", err)
+	}
+	if err := s.Put(ctx, "uid1", storage.Record{
+		RefreshTokensByProvider: map[string]string{storage.ProviderApple: "new"},
+		RefreshTokens:           []storage.RefreshTokenRecord{token("h2", exp)},
+	}); err != nil {
+		t.Fatalf("Put #2: %v", err)
+	}
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.RefreshTokensByProvider[storage.ProviderApple] != "new" {
+		t.Fatalf("provider token not replaced: %v", got.RefreshTokensByProvider)
+	}
+	if _, ok := got.Attrs["stale"]; ok {
+		t.Fatalf("attrs not replaced: %v", got.Attrs)
+	}
+	if len(got.RefreshTokens) != 1 || got.RefreshTokens[0].Hash != "h2" {
+		t.Fatalf("refresh tokens not replaced: %+v", got.RefreshTokens)
+	}
+}
+
+func testUpdateCreatesMissing(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	var seen storage.Record
+	out, err := s.Update(ctx, "uid1", func(r storage.Record) storage.Record {
+		seen = r
+		r.Attrs["k"] = "v"
+		return r
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	if seen.UserID != "uid1" || seen.RefreshTokensByProvider == nil || seen.Attrs == nil || len(seen.RefreshTokens) != 0 {
+		t.Fatalf("fn got %+v, want an empty initialized record for uid1", seen)
+	}
+	if out.UserID != "uid1" || out.Attrs["k"] != "v" {
+		t.Fatalf("Update returned %+v", out)
+	}
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Attrs["k"] != "v" {
+		t.Fatalf("update not stored: %+v", got)
+	}
+}
+
+func testUpdateSeesCurrent(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	if err := s.Put(ctx, "uid1", storage.Record{
+		RefreshTokens: []storage.RefreshTokenRecord{token("h1", exp)},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	out, err := s.Update(ctx, "uid1", func(r storage.Record) storage.Record {
+		if len(r.RefreshTokens) != 1 || r.RefreshTokens[0].Hash != "h1" {
+			t.Errorf("fn got %+v, want the stored token", r.RefreshTokens)
+		}
+		r.UserID = "someone-else"
+		r.RefreshTokens = append(r.RefreshTokens, token("h2", exp))
+		return r
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if out.UserID != "uid1" {
+		t.Fatalf("Update must keep the user id, got %q", out.UserID)
+	}
+	if len(out.RefreshTokens) != 2 {
+		t.Fatalf("Update returned %d tokens, want 2", len(out.RefreshTokens))
+	}
+
+	if _, err := s.Get(ctx, "someone-else"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("record must not move to the user id set by fn, got %v", err)
+	}
+}
+
+func testCopyIsolation(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	in := storage.Record{
+		RefreshTokensByProvider: map[string]string{storage.ProviderApple: "enc"},
+		Attrs:                   map[string]string{"k": "v"},
+		RefreshTokens:           []storage.RefreshTokenRecord{token("h1", exp)},
+	}
+	if err := s.Put(ctx, "uid1", in); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Mutating the value handed to Put must not reach the store.
+	in.RefreshTokensByProvider[storage.ProviderApple] = "mutated"
+	in.Attrs["k"] = "mutated"
+	in.RefreshTokens[0].Hash = "mutated"
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	// Neither must mutating a value returned by Get or Update.
+	got.RefreshTokensByProvider[storage.ProviderApple] = "mutated"
+	got.Attrs["k"] = "mutated"
+	got.RefreshTokens[0].Hash = "mutated"
+
+	out, err := s.Update(ctx, "uid1", func(r storage.Record) storage.Record { return r })
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	out.Attrs["k"] = "mutated"
+	out.RefreshTokens[0].Hash = "mutated"
+
+	got, err = s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.RefreshTokensByProvider[storage.ProviderApple] != "enc" || got.Attrs["k"] != "v" || got.RefreshTokens[0].Hash != "h1" {
+		t.Fatalf("stored record was mutated through a copy: %+v", got)
+	}
+}
+
+func testConcurrentUpdate(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	const n = 25
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Update(ctx, "uid1", func(r storage.Record) storage.Record {
+				r.RefreshTokens = append(r.RefreshTokens, token(fmt.Sprintf("h%02d", i), exp))
+				return r
+			}); err != nil {
+				t.Errorf("Update: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got.RefreshTokens) != n {
+		t.Fatalf("lost updates: got %d refresh tokens, want %d", len(got.RefreshTokens), n)
+	}
+}
+
+func testDeleteAndUserExists(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	if ok, err := s.UserExists(ctx, "uid1"); err != nil || ok {
+		t.Fatalf("UserExists before Put = %v, %v; want false, nil", ok, err)
+	}
+
+	if err := s.Put(ctx, "uid1", storage.Record{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if ok, err := s.UserExists(ctx, "uid1"); err != nil || !ok {
+		t.Fatalf("UserExists after Put = %v, %v; want true, nil", ok, err)
+	}
+
+	if err := s.Delete(ctx, "uid1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "uid1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get after Delete: expected ErrNotFound, got %v", err)
+	}
+	if ok, err := s.UserExists(ctx, "uid1"); err != nil || ok {
+		t.Fatalf("UserExists after Delete = %v, %v; want false, nil", ok, err)
+	}
+
+	if err := s.Delete(ctx, "uid1"); err != nil {
+		t.Fatalf("Delete of a missing record should succeed, got %v", err)
+	}
+}
+
+func testPruneAllExpired(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	ts := now()
+
+	// Stores may drop expired tokens before PruneAllExpired runs (Redis
+	// never keeps them), so only an upper bound on the count is part of
+	// the contract.
+	for _, uid := range []string{"uid1", "uid2"} {
+		if err := s.Put(ctx, uid, storage.Record{RefreshTokens: []storage.RefreshTokenRecord{
+			token(uid+"-live", ts.Add(time.Hour)),
+			token(uid+"-dead", ts.Add(-time.Hour)),
+		}}); err != nil {
+			t.Fatalf("Put(%s): %v", uid, err)
+		}
+	}
+
+	n, err := s.PruneAllExpired(ctx, ts)
+	if err != nil {
+		t.Fatalf("PruneAllExpired: %v", err)
+	}
+	if n < 0 || n > 2 {
+		t.Fatalf("PruneAllExpired pruned %d, want at most 2", n)
+	}
+
+	for _, uid := range []string{"uid1", "uid2"} {
+		got, err := s.Get(ctx, uid)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", uid, err)
+		}
+		if len(got.RefreshTokens) != 1 || got.RefreshTokens[0].Hash != uid+"-live" {
+			t.Fatalf("%s: expected only the live token, got %+v", uid, got.RefreshTokens)
+		}
+	}
+}
+
+func testFindRefreshTokenByHash(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	if _, _, err := s.FindRefreshTokenByHash(ctx, "h1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("FindRefreshTokenByHash(missing): expected ErrNotFound, got %v", err)
+	}
+
+	if err := s.Put(ctx, "uid1", storage.Record{
+		RefreshTokens: []storage.RefreshTokenRecord{token("h1", exp), token("h2", exp)},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if ok, err := s.RefreshTokenExists(ctx, "h2"); err != nil || !ok {
+		t.Fatalf("RefreshTokenExists(h2) = %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := s.RefreshTokenExists(ctx, "uid1"); err != nil || ok {
+		t.Fatalf("RefreshTokenExists must not match user ids, got %v, %v", ok, err)
+	}
+
+	uid, rt, err := s.FindRefreshTokenByHash(ctx, "h2")
+	if err != nil {
+		t.Fatalf("FindRefreshTokenByHash: %v", err)
+	}
+	if uid != "uid1" {
+		t.Fatalf("got owner %q, want %q", uid, "uid1")
+	}
+	assertToken(t, rt, token("h2", exp))
+
+	// The index must follow rotation through Update...
+	if _, err := s.Update(ctx, "uid1", func(r storage.Record) storage.Record {
+		r.RotateRefreshToken("h2", token("h3", exp))
+		return r
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, _, err := s.FindRefreshTokenByHash(ctx, "h2"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("rotated-out token still found, err = %v", err)
+	}
+	if ok, err := s.RefreshTokenExists(ctx, "h2"); err != nil || ok {
+		t.Fatalf("RefreshTokenExists(h2) after rotation = %v, %v; want false, nil", ok, err)
+	}
+	if uid, _, err := s.FindRefreshTokenByHash(ctx, "h3"); err != nil || uid != "uid1" {
+		t.Fatalf("FindRefreshTokenByHash(h3) = %q, %v", uid, err)
+	}
+
+	// ...and deletion of the whole record.
+	if err := s.Delete(ctx, "uid1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, h := range []string{"h1", "h3"} {
+		if _, _, err := s.FindRefreshTokenByHash(ctx, h); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("%s still found after Delete, err = %v", h, err)
+		}
+	}
+}
+
+func testRevokeRefreshTokenByJTI(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	if err := s.Put(ctx, "uid1", storage.Record{
+		RefreshTokens: []storage.RefreshTokenRecord{token("h1", exp), token("h2", exp)},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if ok, err := s.RevokeRefreshTokenByJTI(ctx, "uid2", "jti-h1"); err != nil || ok {
+		t.Fatalf("revoking another user's token = %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := s.RevokeRefreshTokenByJTI(ctx, "uid1", "jti-missing"); err != nil || ok {
+		t.Fatalf("revoking a missing jti = %v, %v; want false, nil", ok, err)
+	}
+
+	if ok, err := s.RevokeRefreshTokenByJTI(ctx, "uid1", "jti-h1"); err != nil || !ok {
+		t.Fatalf("RevokeRefreshTokenByJTI = %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := s.RevokeRefreshTokenByJTI(ctx, "uid1", "jti-h1"); err != nil || ok {
+		t.Fatalf("second revoke = %v, %v; want false, nil", ok, err)
+	}
+
+	if _, _, err := s.FindRefreshTokenByHash(ctx, "h1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("revoked token still found, err = %v", err)
+	}
+	if ok, err := s.RefreshTokenExists(ctx, "h1"); err != nil || ok {
+		t.Fatalf("RefreshTokenExists(h1) after revoke = %v, %v; want false, nil", ok, err)
+	}
+
+	got, err := s.Get(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got.RefreshTokens) != 1 || got.RefreshTokens[0].Hash != "h2" {
+		t.Fatalf("expected only h2 to remain, got %+v", got.RefreshTokens)
+	}
+}
+
+func testListRefreshTokens(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	if got, err := s.ListRefreshTokens(ctx, "missing"); err != nil || len(got) != 0 {
+		t.Fatalf("ListRefreshTokens(missing) = %+v, %v; want none, nil", got, err)
+	}
+
+	if err := s.Put(ctx, "uid1", storage.Record{
+		RefreshTokens: []storage.RefreshTokenRecord{token("h1", exp), token("h2", exp)},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.Put(ctx, "uid2", storage.Record{
+		RefreshTokens: []storage.RefreshTokenRecord{token("other", exp)},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	got, err := s.ListRefreshTokens(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("ListRefreshTokens: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d refresh tokens, want 2", len(got))
+	}
+
+	got[0].Hash = "mutated"
+	again, err := s.ListRefreshTokens(ctx, "uid1")
+	if err != nil {
+		t.Fatalf("ListRefreshTokens: %v", err)
+	}
+	for _, rt := range again {
+		if rt.Hash == "mutated" {
+			t.Fatalf("stored tokens were mutated through the returned slice")
+		}
+	}
+}
+
+func testForEach(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	exp := now().Add(time.Hour)
+
+	for _, uid := range []string{"uid1", "uid2", "uid3"} {
+		if err := s.Put(ctx, uid, storage.Record{
+			RefreshTokens: []storage.RefreshTokenRecord{token("h-"+uid, exp)},
+		}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	// fn may write back to the store while the walk is in progress.
+	validated := now()
+	seen := map[string]int{}
+	if err := s.ForEach(ctx, func(r storage.Record) error {
+		seen[r.UserID]++
+		if len(r.RefreshTokens) != 1 || r.RefreshTokens[0].Hash != "h-"+r.UserID {
+			t.Errorf("%s: unexpected refresh tokens %+v", r.UserID, r.RefreshTokens)
+		}
+
+		_, err := s.Update(ctx, r.UserID, func(rec storage.Record) storage.Record {
+			rec.ProviderValidatedAt[storage.ProviderApple] = validated
+			return rec
+		})
+		return err
+	}); err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+
+	if len(seen) != 3 || seen["uid1"] != 1 || seen["uid2"] != 1 || seen["uid3"] != 1 {
+		t.Fatalf("expected every record exactly once, got %v", seen)
+	}
+
+	got, err := s.Get(ctx, "uid2")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !got.ProviderValidatedAt[storage.ProviderApple].Equal(validated) {
+		t.Fatalf("ProviderValidatedAt = %v, want %v", got.ProviderValidatedAt, validated)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	if err := s.ForEach(ctx, func(storage.Record) error {
+		calls++
+		return stop
+	}); !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("ForEach should stop at fn's error, got %v after %d calls", err, calls)
+	}
+}
+
+func testOneTime(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	if _, err := s.TakeOneTime(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("TakeOneTime(missing): expected ErrNotFound, got %v", err)
+	}
+
+	if err := s.PutOneTime(ctx, "k1", []byte("old"), now().Add(time.Hour)); err != nil {
+		t.Fatalf("PutOneTime: %v", err)
+	}
+	if err := s.PutOneTime(ctx, "k1", []byte("v1"), now().Add(time.Hour)); err != nil {
+		t.Fatalf("PutOneTime: %v", err)
+	}
+	got, err := s.TakeOneTime(ctx, "k1")
+	if err != nil || string(got) != "v1" {
+		t.Fatalf("TakeOneTime = %q, %v; want v1", got, err)
+	}
+	if _, err := s.TakeOneTime(ctx, "k1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("second TakeOneTime: expected ErrNotFound, got %v", err)
+	}
+
+	// Values may be empty, e.g. nonces that only need to exist.
+	for _, value := range [][]byte{nil, {}} {
+		if err := s.PutOneTime(ctx, "empty", value, now().Add(time.Hour)); err != nil {
+			t.Fatalf("PutOneTime(%#v): %v", value, err)
+		}
+		if got, err := s.TakeOneTime(ctx, "empty"); err != nil || len(got) != 0 {
+			t.Fatalf("TakeOneTime(empty) = %q, %v; want an empty value", got, err)
+		}
+	}
+
+	if err := s.PutOneTime(ctx, "expired", []byte("v"), now().Add(-time.Second)); err != nil {
+		t.Fatalf("PutOneTime: %v", err)
+	}
+	if _, err := s.TakeOneTime(ctx, "expired"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("TakeOneTime(expired): expected ErrNotFound, got %v", err)
+	}
+
+	// Pruning keeps live values and does not count them as refresh tokens.
+	if err := s.PutOneTime(ctx, "live", []byte("v"), now().Add(time.Hour)); err != nil {
+		t.Fatalf("PutOneTime: %v", err)
+	}
+	if n, err := s.PruneAllExpired(ctx, now()); err != nil || n != 0 {
+		t.Fatalf("PruneAllExpired = %d, %v; want 0", n, err)
+	}
+	if got, err := s.TakeOneTime(ctx, "live"); err != nil || string(got) != "v" {
+		t.Fatalf("TakeOneTime(live) after prune = %q, %v", got, err)
+	}
+
+	// Concurrent takers: exactly one wins.
+	if err := s.PutOneTime(ctx, "race", []byte("v"), now().Add(time.Hour)); err != nil {
+		t.Fatalf("PutOneTime: %v", err)
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		wins int
+	)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.TakeOneTime(ctx, "race"); err == nil {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Fatalf("expected exactly one concurrent TakeOneTime to win, got %d", wins)
+	}
+}
+
+func identity(provider, subject, userID, email string) storage.Identity {
+	return storage.Identity{Provider: provider, Subject: subject, UserID: userID, Email: email, CreatedAt: now()}
+}
+
+func testIdentities(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	if _, err := s.GetIdentity(ctx, "google", "g1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetIdentity(missing): expected ErrNotFound, got %v", err)
+	}
+
+	apple := identity(storage.ProviderApple, "a1", "uid1", "jane@example.com")
+	google := identity(storage.ProviderGoogle, "g1", "uid1", "")
+	for _, id := range []storage.Identity{google, apple} {
+		if err := s.LinkIdentity(ctx, id); err != nil {
+			t.Fatalf("LinkIdentity(%s): %v", id.Provider, err)
+		}
+	}
+
+	got, err := s.GetIdentity(ctx, storage.ProviderApple, "a1")
+	if err != nil {
+		t.Fatalf("GetIdentity: %v", err)
+	}
+	assertIdentity(t, got, apple)
+
+	if err := s.LinkIdentity(ctx, identity(storage.ProviderApple, "a1", "uid2", "")); !errors.Is(err, storage.ErrIdentityTaken) {
+		t.Fatalf("linking another user's identity: expected ErrIdentityTaken, got %v", err)
+	}
+
+	ids, err := s.ListIdentities(ctx, "uid1")
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("ListIdentities = %+v, %v; want 2 identities", ids, err)
+	}
+	assertIdentity(t, ids[0], apple)
+	assertIdentity(t, ids[1], google)
+	if ids, err := s.ListIdentities(ctx, "uid2"); err != nil || len(ids) != 0 {
+		t.Fatalf("ListIdentities(uid2) = %+v, %v; want none", ids, err)
+	}
+
+	if ids, err := s.FindIdentitiesByEmail(ctx, "jane@example.com"); err != nil || len(ids) != 1 || ids[0].Subject != "a1" {
+		t.Fatalf("FindIdentitiesByEmail = %+v, %v", ids, err)
+	}
+	if ids, err := s.FindIdentitiesByEmail(ctx, ""); err != nil || len(ids) != 0 {
+		t.Fatalf("FindIdentitiesByEmail(\"\") = %+v, %v; want none", ids, err)
+	}
+
+	// Linking again keeps the identity but records its current email.
+	relinked := apple
+	relinked.Email = "jane@example.org"
+	relinked.CreatedAt = now().Add(time.Hour)
+	if err := s.LinkIdentity(ctx, relinked); err != nil {
+		t.Fatalf("LinkIdentity again: %v", err)
+	}
+	got, err = s.GetIdentity(ctx, storage.ProviderApple, "a1")
+	if err != nil || got.Email != "jane@example.org" || !got.CreatedAt.Equal(apple.CreatedAt) {
+		t.Fatalf("relinked identity = %+v, %v", got, err)
+	}
+	if ids, err := s.FindIdentitiesByEmail(ctx, "jane@example.com"); err != nil || len(ids) != 0 {
+		t.Fatalf("old email still finds %+v, %v", ids, err)
+	}
+	if ids, err := s.FindIdentitiesByEmail(ctx, "jane@example.org"); err != nil || len(ids) != 1 {
+		t.Fatalf("new email finds %+v, %v", ids, err)
+	}
+
+	if ok, err := s.UnlinkIdentity(ctx, "uid2", storage.ProviderApple, "a1"); err != nil || ok {
+		t.Fatalf("UnlinkIdentity by another user = %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := s.UnlinkIdentity(ctx, "uid1", storage.ProviderApple, "a1"); err != nil || !ok {
+		t.Fatalf("UnlinkIdentity = %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := s.UnlinkIdentity(ctx, "uid1", storage.ProviderApple, "a1"); err != nil || ok {
+		t.Fatalf("second UnlinkIdentity = %v, %v; want false, nil", ok, err)
+	}
+	if _, err := s.GetIdentity(ctx, storage.ProviderApple, "a1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetIdentity after unlink: expected ErrNotFound, got %v", err)
+	}
+	if ids, err := s.FindIdentitiesByEmail(ctx, "jane@example.org"); err != nil || len(ids) != 0 {
+		t.Fatalf("unlinked identity still found by email: %+v, %v", ids, err)
+	}
+
+	// Once unlinked, the identity is free for another user.
+	if err := s.LinkIdentity(ctx, identity(storage.ProviderApple, "a1", "uid2", "")); err != nil {
+		t.Fatalf("LinkIdentity to uid2: %v", err)
+	}
+}
+
+func testDeleteRemovesIdentities(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "uid1", storage.Record{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	for _, id := range []storage.Identity{
+		identity(storage.ProviderApple, "a1", "uid1", "jane@example.com"),
+		identity(storage.ProviderGoogle, "g1", "uid1", ""),
+		identity(storage.ProviderGoogle, "g2", "uid2", "jane@example.com"),
+	} {
+		if err := s.LinkIdentity(ctx, id); err != nil {
+			t.Fatalf("LinkIdentity(%s): %v", id.Subject, err)
+		}
+	}
+
+	if err := s.Delete(ctx, "uid1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if ids, err := s.ListIdentities(ctx, "uid1"); err != nil || len(ids) != 0 {
+		t.Fatalf("ListIdentities after Delete = %+v, %v; want none", ids, err)
+	}
+	if _, err := s.GetIdentity(ctx, storage.ProviderApple, "a1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetIdentity after Delete: expected ErrNotFound, got %v", err)
+	}
+	if ids, err := s.FindIdentitiesByEmail(ctx, "jane@example.com"); err != nil || len(ids) != 1 || ids[0].UserID != "uid2" {
+		t.Fatalf("FindIdentitiesByEmail after Delete = %+v, %v; want only uid2's", ids, err)
+	}
+
+	// Identities go even when their user has no record.
+	if err := s.Delete(ctx, "uid2"); err != nil {
+		t.Fatalf("Delete(no record): %v", err)
+	}
+	if _, err := s.GetIdentity(ctx, storage.ProviderGoogle, "g2"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetIdentity after Delete(no record): expected ErrNotFound, got %v", err)
+	}
+}
+
+func testContextCanceled(t *testing.T, s storage.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	checks := map[string]error{}
+	_, checks["Get"] = s.Get(ctx, "uid1")
+	checks["Put"] = s.Put(ctx, "uid1", storage.Record{})
+	_, checks["Update"] = s.Update(ctx, "uid1", func(r storage.Record) storage.Record {
+		called = true
+		return r
+	})
+	checks["Delete"] = s.Delete(ctx, "uid1")
+	_, checks["UserExists"] = s.UserExists(ctx, "uid1")
+	_, checks["RefreshTokenExists"] = s.RefreshTokenExists(ctx, "h1")
+	_, checks["PruneAllExpired"] = s.PruneAllExpired(ctx, time.Now())
+	_, _, checks["FindRefreshTokenByHash"] = s.FindRefreshTokenByHash(ctx, "h1")
+	_, checks["RevokeRefreshTokenByJTI"] = s.RevokeRefreshTokenByJTI(ctx, "uid1", "jti-h1")
+	_, checks["ListRefreshTokens"] = s.ListRefreshTokens(ctx, "uid1")
+	checks["ForEach"] = s.ForEach(ctx, func(storage.Record) error { return nil })
+	checks["PutOneTime"] = s.PutOneTime(ctx, "k", []byte("v"), time.Now().Add(time.Hour))
+	_, checks["TakeOneTime"] = s.TakeOneTime(ctx, "k")
+	checks["LinkIdentity"] = s.LinkIdentity(ctx, identity(storage.ProviderApple, "a1", "uid1", ""))
+	_, checks["GetIdentity"] = s.GetIdentity(ctx, storage.ProviderApple, "a1")
+	_, checks["ListIdentities"] = s.ListIdentities(ctx, "uid1")
+	_, checks["FindIdentitiesByEmail"] = s.FindIdentitiesByEmail(ctx, "jane@example.com")
+	_, checks["UnlinkIdentity"] = s.UnlinkIdentity(ctx, "uid1", storage.ProviderApple, "a1")
+
+	for op, err := range checks {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s with canceled context: expected context.Canceled, got %v", op, err)
+		}
+	}
+	if called {
+		t.Errorf("Update must not call fn once the context is canceled")
+	}
+
+	if ok, err := s.UserExists(context.Background(), "uid1"); err != nil || ok {
+		t.Fatalf("canceled Put must not store anything, UserExists = %v, %v", ok, err)
+	}
+	if _, err := s.GetIdentity(context.Background(), storage.ProviderApple, "a1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("canceled LinkIdentity must not store anything, got %v", err)
+	}
+}
+
+func assertToken(t *testing.T, got, want storage.RefreshTokenRecord) {
+	t.Helper()
+	if got.Hash != want.Hash || got.JTI != want.JTI || got.FamilyID != want.FamilyID ||
+		!got.ExpiresAt.Equal(want.ExpiresAt) || !got.CreatedAt.Equal(want.CreatedAt) {
+		t.Fatalf("got token %+v, want %+v", got, want)
+	}
+}
+
+func assertIdentity(t *testing.T, got, want storage.Identity) {
+	t.Helper()
+	if got.Provider != want.Provider || got.Subject != want.Subject || got.UserID != want.UserID ||
+		got.Email != want.Email || !got.CreatedAt.Equal(want.CreatedAt) {
+		t.Fatalf("got identity %+v, want %+v", got, want)
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
@@ -15,8 +16,92 @@ type Store interface {
 	// Update atomically reads, transforms, and writes the record.
 	Update(ctx context.Context, userID string, fn func(Record) Record) (Record, error)
 
+	// Delete removes the user's record along with their identities.
 	Delete(ctx context.Context, userID string) error
-	Exists(ctx context.Context, refreshToken string) (bool, error)
 
+	// UserExists reports whether a record is stored for userID.
+	UserExists(ctx context.Context, userID string) (bool, error)
+
+	// RefreshTokenExists reports whether a refresh token with the given hash
+	// is stored, i.e. has been neither revoked nor pruned.
+	RefreshTokenExists(ctx context.Context, hash string) (bool, error)
+
+	// FindRefreshTokenByHash returns the refresh token with the given hash and
+	// the id of the user it belongs to, or ErrNotFound.
+	FindRefreshTokenByHash(ctx context.Context, hash string) (userID string, rt RefreshTokenRecord, err error)
+
+	// RevokeRefreshTokenByJTI removes the user's refresh token with the given
+	// jti and reports whether there was one to remove.
+	RevokeRefreshTokenByJTI(ctx context.Context, userID, jti string) (bool, error)
+
+	// ListRefreshTokens returns the user's refresh tokens. A missing user has
+	// none.
+	ListRefreshTokens(ctx context.Context, userID string) ([]RefreshTokenRecord, error)
+
+	// ForEach calls fn with every stored record, in no particular order, and
+	// stops at the first error fn returns. fn may call back into the store.
+	ForEach(ctx context.Context, fn func(Record) error) error
+
+	// PutOneTime stores a short-lived value, such as the state of a sign in
+	// in progress, under key until expiresAt, replacing any value there.
+	PutOneTime(ctx context.Context, key string, value []byte, expiresAt time.Time) error
+
+	// TakeOneTime removes the value stored under key and returns it, or
+	// ErrNotFound if there is none or it has expired. Of several concurrent
+	// callers only one gets the value.
+	TakeOneTime(ctx context.Context, key string) ([]byte, error)
+
+	// LinkIdentity links id.Provider's id.Subject to id.UserID. Linking an
+	// identity again to the same user only updates its Email; linking one
+	// that belongs to another user fails with ErrIdentityTaken.
+	LinkIdentity(ctx context.Context, id Identity) error
+
+	// GetIdentity returns the identity provider knows by subject, or
+	// ErrNotFound.
+	GetIdentity(ctx context.Context, provider, subject string) (Identity, error)
+
+	// ListIdentities returns the identities linked to the user, ordered by
+	// provider and subject. A missing user has none.
+	ListIdentities(ctx context.Context, userID string) ([]Identity, error)
+
+	// FindIdentitiesByEmail returns the identities recorded with exactly
+	// email, ordered by provider and subject.
+	FindIdentitiesByEmail(ctx context.Context, email string) ([]Identity, error)
+
+	// UnlinkIdentity removes the user's identity at provider known by
+	// subject and reports whether there was one to remove.
+	UnlinkIdentity(ctx context.Context, userID, provider, subject string) (bool, error)
+
+	// PruneAllExpired removes expired refresh tokens and returns how many it
+	// removed. Expired one-time values are dropped as well but not counted.
 	PruneAllExpired(ctx context.Context, now time.Time) (pruned int, err error)
 }
+
+// Open returns the Store selected by cfg. Stores that hold connections or
+// files also implement io.Closer.
+func Open(ctx context.Context, cfg *Config) (Store, error) {
+	switch cfg.Driver {
+	case DriverPostgres:
+		s, err := NewPostgresStore(ctx, cfg.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case DriverBolt:
+		s, err := NewBoltStore(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case DriverRedis:
+		s, err := NewRedisStore(ctx, cfg.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, errors.New("unknown storage driver")
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"cmp"
 	"errors"
 	"time"
 
@@ -13,11 +14,43 @@ const (
 	// add more as needed
 )
 
-var ErrNotFound = errors.New("record not found")
+// Well-known Record.Attrs keys.
+const (
+	AttrEmail          = "email"
+	AttrEmailVerified  = "email_verified"
+	AttrIsPrivateEmail = "is_private_email"
+	AttrRealUserStatus = "real_user_status"
+	AttrGivenName      = "given_name"
+	AttrFamilyName     = "family_name"
+)
+
+var (
+	ErrNotFound = errors.New("record not found")
+	// ErrIdentityTaken means the identity is linked to another user.
+	ErrIdentityTaken = errors.New("identity linked to another user")
+)
+
+// Identity links an account at a provider, known there by Subject, to the
+// user it signs in as.
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	UserID   string `json:"user_id"`
+	// Email is the address the provider verified for the account, if any.
+	// Unverified addresses are never recorded.
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// compareIdentities orders identities by provider, then subject.
+func compareIdentities(a, b Identity) int {
+	return cmp.Or(cmp.Compare(a.Provider, b.Provider), cmp.Compare(a.Subject, b.Subject))
+}
 
 type RefreshTokenRecord struct {
 	Hash      string    `json:"hash"`
 	JTI       string    `json:"jti"`
+	FamilyID  string    `json:"family_id,omitempty"`
 	ExpiresAt time.Time `json:"expires_at"`
 	CreatedAt time.Time `json:"created_at"`
 }
@@ -27,6 +60,12 @@ type Record struct {
 	RefreshTokensByProvider map[string]string    `json:"tokens_by_provider"`
 	RefreshTokens           []RefreshTokenRecord `json:"refresh_token"`
 	Attrs                   map[string]string    `json:"attributes"`
+	// ProviderValidatedAt records when each provider token was last confirmed
+	// to still be valid.
+	ProviderValidatedAt map[string]time.Time `json:"provider_validated_at,omitempty"`
+	// ProviderClientIDs records which of the provider's client ids each
+	// provider token was issued to; it must be presented along with it.
+	ProviderClientIDs map[string]string `json:"provider_client_ids,omitempty"`
 }
 
 func (r *Record) EnsureInit() {
@@ -37,6 +76,14 @@ func (r *Record) EnsureInit() {
 	if r.Attrs == nil {
 		r.Attrs = make(map[string]string)
 	}
+
+	if r.ProviderValidatedAt == nil {
+		r.ProviderValidatedAt = make(map[string]time.Time)
+	}
+
+	if r.ProviderClientIDs == nil {
+		r.ProviderClientIDs = make(map[string]string)
+	}
 }
 
 func (r *Record) GetRefreshToken(provider string) (string, bool) {
@@ -45,12 +92,54 @@ func (r *Record) GetRefreshToken(provider string) (string, bool) {
 	return token, ok
 }
 
+// RemoveProviderToken forgets the user's token for provider along with what
+// is recorded about it.
+func (r *Record) RemoveProviderToken(provider string) {
+	delete(r.RefreshTokensByProvider, provider)
+	delete(r.ProviderValidatedAt, provider)
+	delete(r.ProviderClientIDs, provider)
+}
+
 func (r *Record) FindRefreshToken(token string) (RefreshTokenRecord, bool) {
+	hash := secret.Hash(token)
 	for _, rt := range r.RefreshTokens {
-		if rt.Hash == secret.Hash(token) {
+		if rt.Hash == hash {
 			return rt, true
 		}
 	}
 
 	return RefreshTokenRecord{}, false
 }
+
+// RotateRefreshToken replaces the refresh token whose hash is oldHash with next.
+// It reports false, leaving the record untouched, if no such token is stored.
+func (r *Record) RotateRefreshToken(oldHash string, next RefreshTokenRecord) bool {
+	for i, rt := range r.RefreshTokens {
+		if rt.Hash == oldHash {
+			r.RefreshTokens[i] = next
+			return true
+		}
+	}
+
+	return false
+}
+
+// RevokeFamily removes every refresh token in the given family and returns how
+// many were removed.
+func (r *Record) RevokeFamily(familyID string) int {
+	if familyID == "" {
+		return 0
+	}
+
+	out := r.RefreshTokens[:0]
+	for _, rt := range r.RefreshTokens {
+		if rt.FamilyID == familyID {
+			continue
+		}
+		out = append(out, rt)
+	}
+
+	removed := len(r.RefreshTokens) - len(out)
+	r.RefreshTokens = out
+	return removed
+}